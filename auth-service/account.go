@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	subjectUserDeleted       = "user.deleted"
+	subjectUserDeletionCheck = "user.deletion.check"
+	deletionCheckTimeout     = 3 * time.Second
+)
+
+// deletionCheck asks the other services whether the account may be deleted.
+// Tests replace it.
+var deletionCheck = requestDeletionCheck
+
+// requestDeletionCheck sends a NATS request answered by payment-service, which
+// refuses while the user still has money. No answer means no deletion.
+func requestDeletionCheck(userID uint) (bool, string, error) {
+	if natsConn == nil {
+		return false, "", errors.New("NATS not initialized")
+	}
+	data, _ := json.Marshal(map[string]interface{}{"user_id": userID})
+	msg, err := natsConn.Request(subjectUserDeletionCheck, data, deletionCheckTimeout)
+	if err != nil {
+		return false, "", err
+	}
+
+	var reply struct {
+		Allowed bool   `json:"allowed"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.Unmarshal(msg.Data, &reply); err != nil {
+		return false, "", err
+	}
+	return reply.Allowed, reply.Reason, nil
+}
+
+// invalidPasswordResponse answers a sensitive change whose password
+// confirmation failed.
+func invalidPasswordResponse(c echo.Context) error {
+	return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid password"})
+}
+
+func requestPhoneChange(c echo.Context) error {
+	type PhoneChangeRequest struct {
+		NewPhoneNumber string `json:"new_phone_number"`
+		Password       string `json:"password"`
+	}
+	var req PhoneChangeRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if !validatePhone(req.NewPhoneNumber) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid phone format"})
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if err := confirmPassword(c, user, req.Password); err != nil {
+		return confirmPasswordResponse(c, err)
+	}
+	if req.NewPhoneNumber == user.PhoneNumber {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "This is already your phone number"})
+	}
+
+	var count int64
+	if err := db.Model(&User{}).Where("phone_number = ?", req.NewPhoneNumber).Count(&count).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	if count > 0 {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Phone number is already in use"})
+	}
+
+	if err := issueVerificationCode(user.ID, PurposePhoneChange, req.NewPhoneNumber); err != nil {
+		return otpErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message":    "Verification code sent to the new phone number",
+		"expires_in": OTPCodeExpiry.Seconds(),
+	})
+}
+
+// confirmPhoneChange switches to the number the code was sent to. Tokens carry
+// the phone number, so every session ends and the caller gets a new one.
+func confirmPhoneChange(c echo.Context) error {
+	type ConfirmRequest struct {
+		Code string `json:"code"`
+	}
+	var req ConfirmRequest
+	if err := c.Bind(&req); err != nil || req.Code == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	verification, err := verifyVerificationCode(user.ID, PurposePhoneChange, req.Code)
+	if err != nil {
+		return otpErrorResponse(c, err)
+	}
+
+	oldPhone := user.PhoneNumber
+	now := time.Now()
+	if err := db.Model(user).Updates(map[string]interface{}{"phone_number": verification.Target, "phone_verified_at": now}).Error; err != nil {
+		var count int64
+		db.Model(&User{}).Where("phone_number = ?", verification.Target).Count(&count)
+		if count > 0 {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Phone number is already in use"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to change phone number"})
+	}
+
+	if err := revokeAllSessions(user.ID); err != nil {
+		log.Printf("Failed to revoke sessions of user %d after phone change: %v", user.ID, err)
+	}
+	// The old number hears about it in case the account was taken over
+	publishSecurityEvent("phone_changed", user.ID, map[string]interface{}{"phone_number": oldPhone})
+
+	tokenResponse, err := createTokenPair(*user, newSession(c, ""))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate tokens"})
+	}
+	return c.JSON(http.StatusOK, tokenResponse)
+}
+
+// deactivateUser blocks logins and ends every session and API key use. The
+// account and its data stay until an admin reactivates or the user deletes it.
+func deactivateUser(userID uint) error {
+	result := db.Model(&User{}).
+		Where("id = ? AND status = ?", userID, UserStatusActive).
+		Updates(map[string]interface{}{"status": UserStatusDeactivated, "deactivated_at": time.Now()})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	if err := revokeAllSessions(userID); err != nil {
+		return err
+	}
+	return revokeUserAPIKeys(db, userID)
+}
+
+func deactivateAccount(c echo.Context) error {
+	type DeactivateRequest struct {
+		Password string `json:"password"`
+	}
+	var req DeactivateRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if err := confirmPassword(c, user, req.Password); err != nil {
+		return confirmPasswordResponse(c, err)
+	}
+
+	if err := deactivateUser(user.ID); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to deactivate account"})
+	}
+	publishSecurityEvent("account_deactivated", user.ID, map[string]interface{}{"phone_number": user.PhoneNumber})
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Account deactivated"})
+}
+
+func adminDeactivateUser(c echo.Context) error {
+	user, err := findUserParam(c)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+	if err := deactivateUser(user.ID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Only active accounts can be deactivated"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to deactivate account"})
+	}
+	publishSecurityEvent("account_deactivated", user.ID, map[string]interface{}{"phone_number": user.PhoneNumber})
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Account deactivated"})
+}
+
+func adminReactivateUser(c echo.Context) error {
+	user, err := findUserParam(c)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+	result := db.Model(&User{}).
+		Where("id = ? AND status = ?", user.ID, UserStatusDeactivated).
+		Updates(map[string]interface{}{"status": UserStatusActive, "deactivated_at": nil})
+	if result.Error != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to reactivate account"})
+	}
+	if result.RowsAffected == 0 {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Account is not deactivated"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Account reactivated"})
+}
+
+// anonymizeUser removes everything that identifies the person but keeps the
+// row, so IDs referenced by other services never point at a different person.
+func anonymizeUser(tx *gorm.DB, user *User) error {
+	if err := scrubAuthEvents(tx, user.ID, user.PhoneNumber); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if err := tx.Model(user).Updates(map[string]interface{}{
+		"phone_number":       fmt.Sprintf("deleted-%d", user.ID),
+		"password_hash":      "",
+		"status":             UserStatusDeleted,
+		"phone_verified_at":  nil,
+		"mfa_enabled":        false,
+		"mfa_secret":         "",
+		"mfa_last_used_step": 0,
+		"pin_hash":           "",
+		"pin_required":       false,
+		"pin_set_at":         nil,
+		"deleted_at":         now,
+	}).Error; err != nil {
+		return err
+	}
+
+	deleteKYCDocuments(tx, user.ID)
+	for _, model := range []interface{}{&KYCDocument{}, &RefreshToken{}, &VerificationCode{}, &MFARecoveryCode{}, &UserRole{}, &APIKey{}, &OAuthConsent{}, &OAuthAuthorizationCode{}, &TrustedDevice{}} {
+		if err := tx.Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteAccount(c echo.Context) error {
+	type DeleteRequest struct {
+		Password string `json:"password"`
+	}
+	var req DeleteRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if err := confirmPassword(c, user, req.Password); err != nil {
+		return confirmPasswordResponse(c, err)
+	}
+
+	allowed, reason, err := deletionCheck(user.ID)
+	if err != nil {
+		log.Printf("Deletion check for user %d failed: %v", user.ID, err)
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Account deletion is temporarily unavailable"})
+	}
+	if !allowed {
+		return c.JSON(http.StatusConflict, map[string]string{"error": reason, "code": "deletion_blocked"})
+	}
+
+	// Sessions are revoked first so their access tokens stop working even
+	// though the refresh token rows are about to disappear.
+	if err := revokeAllSessions(user.ID); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke sessions"})
+	}
+	if err := revokeUserAPIKeys(db, user.ID); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke API keys"})
+	}
+
+	phone := user.PhoneNumber
+	if err := db.Transaction(func(tx *gorm.DB) error { return anonymizeUser(tx, user) }); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete account"})
+	}
+
+	// Downstream services get the old number once so they can purge it too
+	publishEvent(subjectUserDeleted, map[string]interface{}{
+		"user_id":      user.ID,
+		"phone_number": phone,
+		"deleted_at":   time.Now(),
+	})
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Account deleted"})
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elkin/system-design-final/shared/authz"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// API keys let integrations call the API without a login session. A key looks
+// like pk_<prefix>_<secret>: the prefix finds the row, only a hash of the
+// whole key is stored. A key acts as its owner, limited to its scopes.
+
+const (
+	apiKeyPrefix        = "pk_"
+	APIKeyDefaultTTL    = 90 * 24 * time.Hour
+	APIKeyMaxTTL        = 365 * 24 * time.Hour
+	maxAPIKeysPerUser   = 20
+	apiKeyTouchEvery    = time.Minute
+	apiKeyRevokedJTI    = "apikey:"
+	maxAPIKeyNameLength = 100
+)
+
+var (
+	errAPIKeyInvalid  = errors.New("invalid API key")
+	errAPIKeyExpired  = errors.New("API key has expired")
+	errAPIKeyIPDenied = errors.New("API key is not allowed from this address")
+)
+
+type APIKey struct {
+	ID         uint   `gorm:"primaryKey"`
+	UserID     uint   `gorm:"not null;index"`
+	Name       string `gorm:"not null"`
+	Prefix     string `gorm:"not null;uniqueIndex"`
+	KeyHash    string `gorm:"not null"`
+	Scopes     string `gorm:"not null"`
+	AllowedIPs string
+	ExpiresAt  time.Time
+	LastUsedAt *time.Time
+	LastUsedIP string
+	RevokedAt  *time.Time
+	CreatedAt  time.Time
+}
+
+func (key *APIKey) scopeList() []string {
+	return strings.Fields(key.Scopes)
+}
+
+// allowsIP checks ip against the allowlist of addresses and CIDR ranges. An
+// empty allowlist allows every address.
+func (key *APIKey) allowsIP(ip string) bool {
+	entries := strings.Fields(key.AllowedIPs)
+	if len(entries) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, entry := range entries {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+		} else if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// revocationID is what revocation events carry so services caching the key
+// drop it, the same way they drop access tokens by jti.
+func (key *APIKey) revocationID() string {
+	return apiKeyRevokedJTI + strconv.FormatUint(uint64(key.ID), 10)
+}
+
+func generateAPIKey() (prefix, key string, err error) {
+	prefix, err = newTokenID()
+	if err != nil {
+		return "", "", err
+	}
+	prefix = prefix[:12]
+	secret, err := newTokenID()
+	if err != nil {
+		return "", "", err
+	}
+	return prefix, apiKeyPrefix + prefix + "_" + secret, nil
+}
+
+// authenticateAPIKey returns the key and its active owner. Errors other than
+// the errAPIKey* ones mean the key could not be checked.
+func authenticateAPIKey(rawKey, ip string) (*APIKey, *User, error) {
+	parts := strings.Split(strings.TrimPrefix(rawKey, apiKeyPrefix), "_")
+	if !strings.HasPrefix(rawKey, apiKeyPrefix) || len(parts) != 2 {
+		return nil, nil, errAPIKeyInvalid
+	}
+
+	var key APIKey
+	if err := db.Where("prefix = ? AND revoked_at IS NULL", parts[0]).First(&key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, errAPIKeyInvalid
+		}
+		return nil, nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(rawKey)), []byte(key.KeyHash)) != 1 {
+		return nil, nil, errAPIKeyInvalid
+	}
+	if time.Now().After(key.ExpiresAt) {
+		return nil, nil, errAPIKeyExpired
+	}
+	if !key.allowsIP(ip) {
+		return nil, nil, errAPIKeyIPDenied
+	}
+
+	var user User
+	if err := db.First(&user, key.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, errAPIKeyInvalid
+		}
+		return nil, nil, err
+	}
+	if user.Status != UserStatusActive {
+		return nil, nil, errAPIKeyInvalid
+	}
+
+	touchAPIKey(&key, ip)
+	return &key, &user, nil
+}
+
+// touchAPIKey records when and where a key was used, at most once a minute so
+// busy integrations don't write on every request.
+func touchAPIKey(key *APIKey, ip string) {
+	now := time.Now()
+	if key.LastUsedAt != nil && now.Sub(*key.LastUsedAt) < apiKeyTouchEvery && key.LastUsedIP == ip {
+		return
+	}
+	if err := db.Model(key).Updates(map[string]interface{}{"last_used_at": now, "last_used_ip": ip}).Error; err != nil {
+		log.Printf("Failed to record use of API key %d: %v", key.ID, err)
+	}
+}
+
+func isAPIKeyRejected(err error) bool {
+	return errors.Is(err, errAPIKeyInvalid) || errors.Is(err, errAPIKeyExpired) || errors.Is(err, errAPIKeyIPDenied)
+}
+
+// apiKeyPrincipal authenticates rawKey and loads the current roles of its
+// owner; a key never outlives a role its owner loses.
+func apiKeyPrincipal(c echo.Context, rawKey string) (*APIKey, *User, []string, error) {
+	key, user, err := authenticateAPIKey(rawKey, c.RealIP())
+	if err != nil {
+		if isAPIKeyRejected(err) {
+			return nil, nil, nil, c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid API key: " + err.Error()})
+		}
+		return nil, nil, nil, c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Failed to check API key"})
+	}
+	roles, err := userRoles(user.ID)
+	if err != nil {
+		return nil, nil, nil, c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Failed to check API key"})
+	}
+	return key, user, roles, nil
+}
+
+func apiKeyAuth(next echo.HandlerFunc, c echo.Context, rawKey string) error {
+	key, user, roles, err := apiKeyPrincipal(c, rawKey)
+	if key == nil {
+		return err
+	}
+
+	// Same types as the decoded JWT claims so handlers can't tell the difference.
+	c.Set("phone_number", user.PhoneNumber)
+	c.Set("user_id", float64(user.ID))
+	c.Set("api_key_id", key.ID)
+	c.Set(authz.ContextRolesKey, roles)
+	c.Set(authz.ContextScopesKey, key.scopeList())
+	return next(c)
+}
+
+// checkAPIKey answers /check for API keys. Callers forward the address of
+// their client in X-Forwarded-For so the allowlist applies to it.
+func checkAPIKey(c echo.Context, rawKey string) error {
+	key, user, roles, err := apiKeyPrincipal(c, rawKey)
+	if key == nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"valid":        true,
+		"user_id":      user.ID,
+		"phone_number": user.PhoneNumber,
+		"roles":        roles,
+		"scopes":       key.scopeList(),
+	})
+}
+
+func apiKeyResponse(key APIKey) map[string]interface{} {
+	return map[string]interface{}{
+		"id":           key.ID,
+		"name":         key.Name,
+		"prefix":       apiKeyPrefix + key.Prefix,
+		"scopes":       key.scopeList(),
+		"allowed_ips":  strings.Fields(key.AllowedIPs),
+		"expires_at":   key.ExpiresAt,
+		"last_used_at": key.LastUsedAt,
+		"last_used_ip": key.LastUsedIP,
+		"created_at":   key.CreatedAt,
+	}
+}
+
+func createAPIKey(c echo.Context) error {
+	type CreateAPIKeyRequest struct {
+		Name       string     `json:"name"`
+		Scopes     []string   `json:"scopes"`
+		AllowedIPs []string   `json:"allowed_ips"`
+		ExpiresAt  *time.Time `json:"expires_at"`
+	}
+	var req CreateAPIKeyRequest
+	if err := c.Bind(&req); err != nil || req.Name == "" || len(req.Name) > maxAPIKeyNameLength {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if len(req.Scopes) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "At least one scope is required"})
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	roles, err := userRoles(user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	for _, scope := range req.Scopes {
+		if !authz.ValidPermission(scope) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unknown scope " + scope})
+		}
+		if !authz.HasPermission(roles, scope) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "You do not have the permission " + scope})
+		}
+	}
+	for _, entry := range req.AllowedIPs {
+		if _, _, err := net.ParseCIDR(entry); err != nil && net.ParseIP(entry) == nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid IP address or range " + entry})
+		}
+	}
+
+	expiresAt := time.Now().Add(APIKeyDefaultTTL)
+	if req.ExpiresAt != nil {
+		expiresAt = *req.ExpiresAt
+	}
+	if !expiresAt.After(time.Now()) || expiresAt.After(time.Now().Add(APIKeyMaxTTL)) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("expires_at must be within %d days", int(APIKeyMaxTTL.Hours()/24))})
+	}
+
+	var count int64
+	if err := db.Model(&APIKey{}).Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", user.ID, time.Now()).Count(&count).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	if count >= maxAPIKeysPerUser {
+		return c.JSON(http.StatusConflict, map[string]string{"error": fmt.Sprintf("At most %d API keys are allowed", maxAPIKeysPerUser)})
+	}
+
+	prefix, rawKey, err := generateAPIKey()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate API key"})
+	}
+	key := APIKey{
+		UserID:     user.ID,
+		Name:       req.Name,
+		Prefix:     prefix,
+		KeyHash:    hashToken(rawKey),
+		Scopes:     strings.Join(req.Scopes, " "),
+		AllowedIPs: strings.Join(req.AllowedIPs, " "),
+		ExpiresAt:  expiresAt,
+	}
+	if err := db.Create(&key).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create API key"})
+	}
+
+	publishSecurityEvent("api_key_created", user.ID, map[string]interface{}{
+		"phone_number": user.PhoneNumber,
+		"api_key_id":   key.ID,
+		"name":         key.Name,
+		"scopes":       key.scopeList(),
+	})
+
+	response := apiKeyResponse(key)
+	response["key"] = rawKey
+	return c.JSON(http.StatusCreated, response)
+}
+
+func listAPIKeys(c echo.Context) error {
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	var keys []APIKey
+	if err := db.Where("user_id = ? AND revoked_at IS NULL", user.ID).Order("created_at").Find(&keys).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	result := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, apiKeyResponse(key))
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// revokeUserAPIKeys revokes every key of a user who can no longer use them.
+func revokeUserAPIKeys(tx *gorm.DB, userID uint) error {
+	var keys []APIKey
+	if err := tx.Where("user_id = ? AND revoked_at IS NULL", userID).Find(&keys).Error; err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := tx.Model(&APIKey{}).Where("user_id = ? AND revoked_at IS NULL", userID).Update("revoked_at", time.Now()).Error; err != nil {
+		return err
+	}
+	for _, key := range keys {
+		publishTokenRevoked(key.revocationID(), userID, key.ExpiresAt)
+	}
+	return nil
+}
+
+func revokeAPIKey(c echo.Context) error {
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	var key APIKey
+	if err := db.Where("id = ? AND user_id = ? AND revoked_at IS NULL", c.Param("id"), user.ID).First(&key).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "API key not found"})
+	}
+	if err := db.Model(&key).Update("revoked_at", time.Now()).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke API key"})
+	}
+
+	publishTokenRevoked(key.revocationID(), user.ID, key.ExpiresAt)
+	return c.JSON(http.StatusOK, map[string]string{"message": "API key revoked"})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const subjectAuthEvents = "auth.events"
+
+const (
+	AuthEventLogin              = "login"
+	AuthEventLoginMFA           = "login_mfa"
+	AuthEventRefresh            = "refresh"
+	AuthEventLogout             = "logout"
+	AuthEventPasswordChange     = "password_change"
+	AuthEventPasswordReset      = "password_reset"
+	AuthEventSessionRevoked     = "session_revoked"
+	AuthEventStepUp             = "step_up"
+	AuthEventDeviceVerification = "device_verification"
+	AuthEventImpersonation      = "impersonation"
+	AuthEventTransactionPIN     = "transaction_pin"
+)
+
+const (
+	AuthOutcomeSuccess   = "success"
+	AuthOutcomeFailure   = "failure"
+	AuthOutcomeChallenge = "challenge"
+)
+
+const (
+	authEventsDefaultLimit = 50
+	authEventsMaxLimit     = 200
+)
+
+var authEventRetention = getEnvDuration("AUTH_EVENT_RETENTION", 180*24*time.Hour)
+
+// AuthEvent is one entry of the audit trail. Failed logins for numbers that
+// are not registered have no user, only the phone number that was tried.
+type AuthEvent struct {
+	ID          uint   `gorm:"primaryKey"`
+	UserID      *uint  `gorm:"index"`
+	PhoneNumber string `gorm:"index"`
+	Type        string `gorm:"not null;index"`
+	Outcome     string `gorm:"not null"`
+	Reason      string
+	SessionID   string
+	IPAddress   string
+	UserAgent   string
+	CreatedAt   time.Time `gorm:"index"`
+}
+
+func (e AuthEvent) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"id":           e.ID,
+		"user_id":      e.UserID,
+		"phone_number": e.PhoneNumber,
+		"type":         e.Type,
+		"outcome":      e.Outcome,
+		"reason":       e.Reason,
+		"session_id":   e.SessionID,
+		"ip_address":   e.IPAddress,
+		"user_agent":   e.UserAgent,
+		"created_at":   e.CreatedAt,
+	}
+}
+
+// recordAuthEvent fills in the client of the request, stores the event and
+// publishes it. Failures are only logged so auditing never blocks a login.
+func recordAuthEvent(c echo.Context, event AuthEvent) {
+	event.IPAddress = c.RealIP()
+	event.UserAgent = truncate(c.Request().UserAgent(), maxUserAgentLength)
+	event.CreatedAt = time.Now()
+	if err := db.Create(&event).Error; err != nil {
+		log.Printf("Failed to record %s event: %v", event.Type, err)
+	}
+	publishEvent(subjectAuthEvents, event.toMap())
+}
+
+func recordAuthSuccess(c echo.Context, eventType string, user User, sessionID string) {
+	recordAuthEvent(c, AuthEvent{
+		UserID:      &user.ID,
+		PhoneNumber: user.PhoneNumber,
+		Type:        eventType,
+		Outcome:     AuthOutcomeSuccess,
+		SessionID:   sessionID,
+	})
+}
+
+// recordAuthFailure records a rejected attempt. user is nil when the request
+// could not be tied to an account.
+func recordAuthFailure(c echo.Context, eventType string, user *User, phone, reason string) {
+	event := AuthEvent{PhoneNumber: phone, Type: eventType, Outcome: AuthOutcomeFailure, Reason: reason}
+	if user != nil {
+		event.UserID = &user.ID
+		event.PhoneNumber = user.PhoneNumber
+	}
+	recordAuthEvent(c, event)
+}
+
+// recordRefreshFailure attributes a rejected refresh token to its owner.
+// Tokens that were never issued cannot be attributed and are not recorded.
+func recordRefreshFailure(c echo.Context, refreshToken RefreshToken, err error) {
+	var user User
+	if db.First(&user, refreshToken.UserID).Error != nil {
+		return
+	}
+	reason := "refresh_token_invalid"
+	switch err {
+	case errRefreshTokenRevoked:
+		reason = "refresh_token_revoked"
+	case errRefreshTokenReused:
+		reason = "refresh_token_reused"
+	case errRefreshTokenExpired:
+		reason = "refresh_token_expired"
+	}
+	recordAuthFailure(c, AuthEventRefresh, &user, "", reason)
+}
+
+func sessionIDOf(tokenResponse map[string]interface{}) string {
+	id, _ := tokenResponse["session_id"].(string)
+	return id
+}
+
+// queryAuthEvents applies the filters shared by the user and admin endpoints
+// and pages backwards from the before cursor, newest first.
+func queryAuthEvents(c echo.Context, query *gorm.DB) error {
+	limit := authEventsDefaultLimit
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid limit"})
+		}
+		if n > authEventsMaxLimit {
+			n = authEventsMaxLimit
+		}
+		limit = n
+	}
+	if v := c.QueryParam("before"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid cursor"})
+		}
+		query = query.Where("id < ?", id)
+	}
+	if v := c.QueryParam("type"); v != "" {
+		query = query.Where("type = ?", v)
+	}
+	if v := c.QueryParam("outcome"); v != "" {
+		query = query.Where("outcome = ?", v)
+	}
+	for param, cond := range map[string]string{"since": "created_at >= ?", "until": "created_at < ?"} {
+		v := c.QueryParam(param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid " + param + ", use RFC 3339"})
+		}
+		query = query.Where(cond, t)
+	}
+
+	var events []AuthEvent
+	if err := query.Order("id desc").Limit(limit).Find(&events).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	result := make([]map[string]interface{}, 0, len(events))
+	for _, event := range events {
+		result = append(result, event.toMap())
+	}
+	response := map[string]interface{}{"events": result}
+	if len(events) == limit {
+		response["next_cursor"] = strconv.FormatUint(uint64(events[len(events)-1].ID), 10)
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+func getActivity(c echo.Context) error {
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	return queryAuthEvents(c, db.Model(&AuthEvent{}).Where("user_id = ?", user.ID))
+}
+
+func getUserEvents(c echo.Context) error {
+	user, err := findUserParam(c)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+	return queryAuthEvents(c, db.Model(&AuthEvent{}).Where("user_id = ?", user.ID))
+}
+
+// getAuthEvents lets support search across accounts, for example every
+// attempt from one IP address or against a number that is not registered.
+func getAuthEvents(c echo.Context) error {
+	query := db.Model(&AuthEvent{})
+	if v := c.QueryParam("phone_number"); v != "" {
+		query = query.Where("phone_number = ?", v)
+	}
+	if v := c.QueryParam("ip_address"); v != "" {
+		query = query.Where("ip_address = ?", v)
+	}
+	return queryAuthEvents(c, query)
+}
+
+// scrubAuthEvents keeps the history of a deleted account but drops the
+// details that identify the person.
+func scrubAuthEvents(tx *gorm.DB, userID uint, phone string) error {
+	return tx.Model(&AuthEvent{}).
+		Where("user_id = ? OR phone_number = ?", userID, phone).
+		Updates(map[string]interface{}{"phone_number": "", "ip_address": "", "user_agent": ""}).Error
+}
+
+func cleanupAuthEvents() {
+	if authEventRetention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := db.Where("created_at < ?", time.Now().Add(-authEventRetention)).Delete(&AuthEvent{}).Error; err != nil {
+			log.Printf("Failed to clean up auth events: %v", err)
+		}
+	}
+}
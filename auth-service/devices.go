@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// Clients send a stable device_id with /login. It is stored hashed, so the
+// list of trusted devices cannot be used to impersonate them. Logging in from
+// a device that is not on the list needs an SMS code first.
+
+const (
+	TokenTypeDeviceChallenge = "device_challenge"
+	minDeviceIDLength        = 8
+	maxDeviceIDLength        = 128
+)
+
+var maxTrustedDevicesPerUser = getEnvInt("MAX_TRUSTED_DEVICES_PER_USER", 20)
+
+type TrustedDevice struct {
+	ID         uint   `gorm:"primaryKey"`
+	UserID     uint   `gorm:"not null;uniqueIndex:idx_trusted_devices_user_device"`
+	DeviceHash string `gorm:"not null;uniqueIndex:idx_trusted_devices_user_device"`
+	Name       string
+	UserAgent  string
+	IPAddress  string
+	LastUsedAt time.Time
+	CreatedAt  time.Time
+}
+
+func validDeviceID(deviceID string) bool {
+	return deviceID == "" || (len(deviceID) >= minDeviceIDLength && len(deviceID) <= maxDeviceIDLength)
+}
+
+func deviceHash(deviceID string) string {
+	if deviceID == "" {
+		return ""
+	}
+	return hashToken(deviceID)
+}
+
+// trustDevice adds the device to the user's list, or refreshes it if it is
+// already there, and drops the least recently used devices over the limit.
+func trustDevice(c echo.Context, userID uint, hash, name string) error {
+	now := time.Now()
+	device := TrustedDevice{UserID: userID, DeviceHash: hash}
+	err := db.Where(device).Assign(TrustedDevice{
+		Name:       truncate(name, maxDeviceNameLength),
+		UserAgent:  truncate(c.Request().UserAgent(), maxUserAgentLength),
+		IPAddress:  c.RealIP(),
+		LastUsedAt: now,
+	}).FirstOrCreate(&device).Error
+	if err != nil {
+		return err
+	}
+
+	if maxTrustedDevicesPerUser > 0 {
+		var stale []TrustedDevice
+		db.Where("user_id = ?", userID).Order("last_used_at desc").Offset(int(maxTrustedDevicesPerUser)).Find(&stale)
+		for _, d := range stale {
+			db.Delete(&d)
+		}
+	}
+	return nil
+}
+
+// recognizeDevice reports whether user may log in from the device with the
+// given hash without an extra step. An account without trusted devices
+// trusts the first one it logs in from, so existing users are not all
+// challenged at once.
+func recognizeDevice(c echo.Context, user *User, hash, deviceName string) (bool, error) {
+	if hash != "" {
+		var device TrustedDevice
+		err := db.Where("user_id = ? AND device_hash = ?", user.ID, hash).First(&device).Error
+		if err == nil {
+			db.Model(&device).Updates(map[string]interface{}{
+				"last_used_at": time.Now(),
+				"ip_address":   c.RealIP(),
+				"user_agent":   truncate(c.Request().UserAgent(), maxUserAgentLength),
+			})
+			return true, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, err
+		}
+	}
+
+	var count int64
+	if err := db.Model(&TrustedDevice{}).Where("user_id = ?", user.ID).Count(&count).Error; err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+	if hash != "" {
+		if err := trustDevice(c, user.ID, hash, deviceName); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// createDeviceChallenge sends an SMS code to the account's number and returns
+// the token to exchange together with the code at /login/device.
+func createDeviceChallenge(user User, deviceID, deviceName string) (map[string]interface{}, error) {
+	// A code sent a moment ago is still the one to enter
+	if err := issueVerificationCode(user.ID, PurposeNewDevice, user.PhoneNumber); err != nil && err != errOTPResendTooSoon {
+		return nil, err
+	}
+
+	jti, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := signClaims(jwt.MapClaims{
+		"jti":         jti,
+		"typ":         TokenTypeDeviceChallenge,
+		"user_id":     user.ID,
+		"device":      deviceHash(deviceID),
+		"device_name": deviceName,
+		"exp":         time.Now().Add(OTPCodeExpiry).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"device_verification_required": true,
+		"device_token":                 challenge,
+		"expires_in":                   OTPCodeExpiry.Seconds(),
+	}, nil
+}
+
+// notifyNewDevice tells the owner that their account was signed in from a
+// device it had not seen before.
+func notifyNewDevice(c echo.Context, user User, deviceName string) {
+	publishSecurityEvent("new_device_login", user.ID, map[string]interface{}{
+		"phone_number": user.PhoneNumber,
+		"device_name":  deviceName,
+		"ip_address":   c.RealIP(),
+		"user_agent":   truncate(c.Request().UserAgent(), maxUserAgentLength),
+	})
+}
+
+func loginDevice(c echo.Context) error {
+	type DeviceLoginRequest struct {
+		DeviceToken string `json:"device_token"`
+		Code        string `json:"code"`
+		Trust       *bool  `json:"trust"`
+	}
+	var req DeviceLoginRequest
+	if err := c.Bind(&req); err != nil || req.DeviceToken == "" || req.Code == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	claims, err := validateTokenOfType(req.DeviceToken, TokenTypeDeviceChallenge)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired device token"})
+	}
+
+	var user User
+	if err := db.First(&user, claimUserID(claims)).Error; err != nil || user.Status != UserStatusActive {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired device token"})
+	}
+
+	if _, err := verifyVerificationCode(user.ID, PurposeNewDevice, req.Code); err != nil {
+		recordAuthFailure(c, AuthEventDeviceVerification, &user, "", "invalid_code")
+		return otpErrorResponse(c, err)
+	}
+	if err := markTokenUsed(claims); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to complete login"})
+	}
+
+	hash, _ := claims["device"].(string)
+	deviceName, _ := claims["device_name"].(string)
+	if hash != "" && (req.Trust == nil || *req.Trust) {
+		if err := trustDevice(c, user.ID, hash, deviceName); err != nil {
+			log.Printf("Failed to trust device for user %d: %v", user.ID, err)
+		}
+	}
+	notifyNewDevice(c, user, deviceName)
+
+	session := newSession(c, deviceName)
+	session.DeviceHash = hash
+	tokenResponse, err := createTokenPair(user, session)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate tokens"})
+	}
+	recordAuthSuccess(c, AuthEventDeviceVerification, user, sessionIDOf(tokenResponse))
+
+	return c.JSON(http.StatusOK, tokenResponse)
+}
+
+func listDevices(c echo.Context) error {
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	var devices []TrustedDevice
+	if err := db.Where("user_id = ?", user.ID).Order("last_used_at desc").Find(&devices).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	var current RefreshToken
+	if sessionID, _ := c.Get("session_id").(string); sessionID != "" {
+		db.Where("family_id = ?", sessionID).First(&current)
+	}
+
+	result := make([]map[string]interface{}, 0, len(devices))
+	for _, d := range devices {
+		result = append(result, map[string]interface{}{
+			"id":           d.ID,
+			"name":         d.Name,
+			"user_agent":   d.UserAgent,
+			"ip_address":   d.IPAddress,
+			"last_used_at": d.LastUsedAt,
+			"created_at":   d.CreatedAt,
+			"current":      current.DeviceHash != "" && d.DeviceHash == current.DeviceHash,
+		})
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+// removeDevice forgets a trusted device and ends the sessions opened from
+// it, so a lost phone is logged out and has to verify again.
+func removeDevice(c echo.Context) error {
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	deviceID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Device not found"})
+	}
+	var device TrustedDevice
+	if err := db.Where("id = ? AND user_id = ?", deviceID, user.ID).First(&device).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Device not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	if err := db.Delete(&device).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to remove device"})
+	}
+
+	sessions, err := activeSessions(user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	revoked := 0
+	for _, s := range sessions {
+		if s.DeviceHash != device.DeviceHash {
+			continue
+		}
+		if err := revokeSession(user.ID, s.FamilyID); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke sessions"})
+		}
+		revoked++
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Device removed", "sessions_revoked": revoked})
+}
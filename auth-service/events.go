@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+var natsConn *nats.Conn
+
+const (
+	subjectTokenRevoked   = "auth.token.revoked"
+	subjectSecurityEvents = "auth.security"
+	subjectSMS            = "notification.sms"
+)
+
+func initNATS() {
+	var err error
+	natsConn, err = nats.Connect(getEnv("NATS_URL", "nats://localhost:4222"), nats.MaxReconnects(10))
+	if err != nil {
+		log.Fatal("Failed to connect to NATS: ", err)
+	}
+	log.Println("Connected to NATS")
+
+	if _, err := natsConn.QueueSubscribe(subjectImpersonationRequests, "auth-service", handleImpersonatedRequest); err != nil {
+		log.Fatal("Failed to subscribe to impersonated requests: ", err)
+	}
+}
+
+func publishEvent(subject string, event map[string]interface{}) {
+	if natsConn == nil {
+		log.Println("NATS not initialized")
+		return
+	}
+
+	jsonData, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal %s event: %v", subject, err)
+		return
+	}
+
+	if err := natsConn.Publish(subject, jsonData); err != nil {
+		log.Printf("Failed to publish %s event: %v", subject, err)
+	}
+}
+
+func publishTokenRevoked(jti string, userID uint, expiresAt time.Time) {
+	publishEvent(subjectTokenRevoked, map[string]interface{}{
+		"jti":        jti,
+		"user_id":    userID,
+		"expires_at": expiresAt,
+		"revoked_at": time.Now(),
+	})
+}
+
+func publishSessionRevoked(sid string, userID uint) {
+	publishEvent(subjectTokenRevoked, map[string]interface{}{
+		"sid":        sid,
+		"user_id":    userID,
+		"expires_at": time.Now().Add(AccessTokenExpiry),
+		"revoked_at": time.Now(),
+	})
+}
+
+func publishSecurityEvent(eventType string, userID uint, details map[string]interface{}) {
+	event := map[string]interface{}{
+		"type":      eventType,
+		"user_id":   userID,
+		"timestamp": time.Now(),
+	}
+	for k, v := range details {
+		event[k] = v
+	}
+	publishEvent(subjectSecurityEvents, event)
+}
+
+func publishSMS(phone, message, messageType string) {
+	publishEvent(subjectSMS, map[string]interface{}{
+		"phone":     phone,
+		"message":   message,
+		"type":      messageType,
+		"sensitive": true,
+	})
+}
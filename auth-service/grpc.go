@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net"
+
+	"github.com/elkin/system-design-final/shared/authpb"
+	"github.com/elkin/system-design-final/shared/authz"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+)
+
+type authServer struct {
+	authpb.UnimplementedAuthServiceServer
+}
+
+// IntrospectToken reports invalid, expired and revoked tokens as inactive
+// rather than as errors; errors mean the answer is unknown.
+func (s *authServer) IntrospectToken(ctx context.Context, req *authpb.IntrospectTokenRequest) (*authpb.IntrospectTokenResponse, error) {
+	_, claims, err := validateAccessToken(req.Token)
+	if err != nil {
+		if errors.Is(err, errRevocationCheckFailed) {
+			return nil, status.Errorf(codes.Unavailable, "failed to check token revocation")
+		}
+		return &authpb.IntrospectTokenResponse{Active: false}, nil
+	}
+	// OAuth client tokens carry no scopes for the internal APIs.
+	if clientID, _ := claims["client_id"].(string); clientID != "" {
+		return &authpb.IntrospectTokenResponse{Active: false}, nil
+	}
+
+	jti, _ := claims["jti"].(string)
+	sid, _ := claims["sid"].(string)
+	phone, _ := claims["phone_number"].(string)
+	tier, _ := claims["kyc_tier"].(string)
+	actorID, _ := claimActor(claims)
+	return &authpb.IntrospectTokenResponse{
+		Active:      true,
+		UserId:      uint64(claimUserID(claims)),
+		PhoneNumber: phone,
+		Roles:       authz.RolesFromClaim(claims["roles"]),
+		Jti:         jti,
+		SessionId:   sid,
+		ExpiresAt:   claimExpiry(claims).Unix(),
+		KycTier:     tier,
+		ActorId:     uint64(actorID),
+		ReadOnly:    claimReadOnly(claims),
+	}, nil
+}
+
+// IntrospectAPIKey checks an API key used from ip_address. The key's
+// revocation ID is returned as jti so callers can evict it on revocation.
+func (s *authServer) IntrospectAPIKey(ctx context.Context, req *authpb.IntrospectAPIKeyRequest) (*authpb.IntrospectTokenResponse, error) {
+	key, user, err := authenticateAPIKey(req.Key, req.IpAddress)
+	if err != nil {
+		if isAPIKeyRejected(err) {
+			return &authpb.IntrospectTokenResponse{Active: false}, nil
+		}
+		return nil, status.Errorf(codes.Unavailable, "failed to check API key")
+	}
+	roles, err := userRoles(user.ID)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to load roles")
+	}
+
+	return &authpb.IntrospectTokenResponse{
+		Active:      true,
+		UserId:      uint64(user.ID),
+		PhoneNumber: user.PhoneNumber,
+		Roles:       roles,
+		Jti:         key.revocationID(),
+		ExpiresAt:   key.ExpiresAt.Unix(),
+		Scopes:      key.scopeList(),
+		KycTier:     user.kycTier(),
+	}, nil
+}
+
+// ConsumeStepUpToken marks a valid token used. An invalid or missing token is
+// not an error: the response says why and how the user can get one.
+func (s *authServer) ConsumeStepUpToken(ctx context.Context, req *authpb.ConsumeStepUpTokenRequest) (*authpb.ConsumeStepUpTokenResponse, error) {
+	err := consumeStepUpToken(req.Token, uint(req.UserId), req.SessionId, req.Operation)
+	if err == nil {
+		return &authpb.ConsumeStepUpTokenResponse{Valid: true}, nil
+	}
+	reason, rejected := stepUpReasons[err]
+	if !rejected {
+		return nil, status.Errorf(codes.Unavailable, "failed to check step-up token")
+	}
+
+	var user User
+	if err := db.First(&user, req.UserId).Error; err != nil {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	return &authpb.ConsumeStepUpTokenResponse{Reason: reason, Methods: stepUpMethods(&user)}, nil
+}
+
+// VerifyTransactionPIN checks the PIN of a user who confirms transfers with
+// one. A wrong, missing or locked PIN is not an error: the response says why.
+func (s *authServer) VerifyTransactionPIN(ctx context.Context, req *authpb.VerifyTransactionPINRequest) (*authpb.VerifyTransactionPINResponse, error) {
+	var user User
+	if err := db.First(&user, req.UserId).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, status.Errorf(codes.NotFound, "user not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to load user")
+	}
+	if !user.pinRequired() {
+		return &authpb.VerifyTransactionPINResponse{Required: false}, nil
+	}
+
+	err := verifyPIN(&user, req.Pin)
+	if err == nil {
+		return &authpb.VerifyTransactionPINResponse{Required: true, Valid: true}, nil
+	}
+	var locked *pinLockedError
+	if errors.As(err, &locked) {
+		return &authpb.VerifyTransactionPINResponse{
+			Required:   true,
+			Reason:     "locked",
+			RetryAfter: int64(math.Ceil(locked.retryAfter.Seconds())),
+		}, nil
+	}
+	reason, rejected := pinReasons[err]
+	if !rejected {
+		return nil, status.Errorf(codes.Unavailable, "failed to check transaction PIN")
+	}
+	return &authpb.VerifyTransactionPINResponse{
+		Required:     true,
+		Reason:       reason,
+		AttemptsLeft: int32(pinAttemptsLeft(user.ID)),
+	}, nil
+}
+
+func (s *authServer) GetUser(ctx context.Context, req *authpb.GetUserRequest) (*authpb.GetUserResponse, error) {
+	var user User
+	if err := db.First(&user, req.UserId).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, status.Errorf(codes.NotFound, "user not found")
+		}
+		return nil, status.Errorf(codes.Internal, "failed to load user")
+	}
+
+	roles, err := userRoles(user.ID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to load roles")
+	}
+
+	return &authpb.GetUserResponse{
+		UserId:      uint64(user.ID),
+		PhoneNumber: user.PhoneNumber,
+		Status:      user.Status,
+		Roles:       roles,
+		MfaEnabled:  user.MFAEnabled,
+		CreatedAt:   user.CreatedAt.Unix(),
+		KycTier:     user.kycTier(),
+	}, nil
+}
+
+// newGRPCServer answers only callers presenting the shared service token.
+func newGRPCServer(token string) *grpc.Server {
+	grpcServer := grpc.NewServer(grpc.UnaryInterceptor(authz.RequireServiceToken(token)))
+	authpb.RegisterAuthServiceServer(grpcServer, &authServer{})
+	return grpcServer
+}
+
+func serveGRPC() {
+	lis, err := net.Listen("tcp", ":"+getEnv("GRPC_PORT", "50052"))
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	token := getEnv("AUTH_GRPC_TOKEN", "")
+	if token == "" {
+		log.Fatal("AUTH_GRPC_TOKEN must be set")
+	}
+	grpcServer := newGRPCServer(token)
+	log.Printf("Auth gRPC server started on %s", lis.Addr())
+	if err := grpcServer.Serve(lis); err != nil {
+		log.Fatalf("Failed to serve: %v", err)
+	}
+}
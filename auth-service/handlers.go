@@ -3,28 +3,34 @@ package main
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"log"
 	"net/http"
 	"regexp"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/elkin/system-design-final/shared/authz"
 	"github.com/labstack/echo/v4"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
 var phoneRegexp = regexp.MustCompile(`^\+?\d{10,15}$`)
-var jwtSecret = []byte("secret")
-var refreshMutex sync.Mutex
 
 const (
 	AccessTokenExpiry  = time.Hour * 1
 	RefreshTokenExpiry = time.Hour * 24 * 7
 )
 
+var errRevocationCheckFailed = errors.New("failed to check token revocation")
+
+const (
+	TokenTypeAccess       = "access"
+	TokenTypeMFAChallenge = "mfa_challenge"
+)
+
 func validatePhone(phone string) bool {
 	return phoneRegexp.MatchString(phone)
 }
@@ -37,65 +43,158 @@ func generateRandomString(length int) (string, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
-func createTokenPair(user User) (map[string]interface{}, error) {
-	accessTokenClaims := jwt.MapClaims{
-		"phone_number": user.PhoneNumber,
-		"user_id":      user.ID,
-		"exp":          time.Now().Add(AccessTokenExpiry).Unix(),
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, accessTokenClaims)
-	accessTokenString, err := accessToken.SignedString(jwtSecret)
-	if err != nil {
-		return nil, err
+	return hex.EncodeToString(b), nil
+}
+
+// createTokenPair issues an access and refresh token for session. A session
+// without an ID is a new login and gets a fresh refresh token family.
+func createTokenPair(user User, session sessionInfo) (map[string]interface{}, error) {
+	isNewSession := session.ID == ""
+	if isNewSession {
+		id, err := newTokenID()
+		if err != nil {
+			return nil, err
+		}
+		session.ID = id
+		session.CreatedAt = time.Now()
 	}
 
-	refreshTokenString, err := generateRandomString(32)
+	accessTokenString, err := issueAccessToken(user, session)
 	if err != nil {
 		return nil, err
 	}
 
-	refreshToken := RefreshToken{
-		UserID:    user.ID,
-		Token:     refreshTokenString,
-		ExpiresAt: time.Now().Add(RefreshTokenExpiry),
-	}
-	if err := db.Create(&refreshToken).Error; err != nil {
+	refreshTokenString, err := issueRefreshToken(user.ID, session)
+	if err != nil {
 		return nil, err
 	}
+	if isNewSession {
+		enforceSessionLimit(user.ID)
+	}
 
 	return map[string]interface{}{
 		"access_token":  accessTokenString,
 		"refresh_token": refreshTokenString,
 		"expires_in":    AccessTokenExpiry.Seconds(),
+		"session_id":    session.ID,
 	}, nil
 }
 
-func validateAccessToken(tokenString string) (*jwt.Token, jwt.MapClaims, error) {
-	refreshMutex.Lock()
-	_, blacklisted := tokenBlacklist[tokenString]
-	refreshMutex.Unlock()
-	if blacklisted {
-		return nil, nil, errors.New("token is blacklisted")
+// issueAccessToken signs an access token for user. Tokens issued to OAuth
+// clients carry the granted scope instead of the user's roles, so third-party
+// applications never act with staff permissions.
+func issueAccessToken(user User, session sessionInfo) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
 	}
 
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-	if err != nil || !token.Valid {
+	claims := jwt.MapClaims{
+		"jti":          jti,
+		"typ":          TokenTypeAccess,
+		"phone_number": user.PhoneNumber,
+		"user_id":      user.ID,
+		"exp":          time.Now().Add(AccessTokenExpiry).Unix(),
+	}
+	if session.ID != "" {
+		claims["sid"] = session.ID
+	}
+	if session.ClientID != "" {
+		claims["client_id"] = session.ClientID
+		claims["scope"] = session.Scope
+	} else {
+		roles, err := userRoles(user.ID)
+		if err != nil {
+			return "", err
+		}
+		claims["roles"] = roles
+		claims["kyc_tier"] = user.kycTier()
+	}
+	return signClaims(claims)
+}
+
+func validateAccessToken(tokenString string) (*jwt.Token, jwt.MapClaims, error) {
+	token, claims, err := parseSignedToken(tokenString)
+	if err != nil {
 		return nil, nil, err
 	}
+	if err := checkTokenClaims(claims, TokenTypeAccess); err != nil {
+		return nil, nil, err
+	}
+	return token, claims, nil
+}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return nil, nil, errors.New("invalid claims")
+func validateTokenOfType(tokenString, tokenType string) (jwt.MapClaims, error) {
+	_, claims, err := parseSignedToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTokenClaims(claims, tokenType); err != nil {
+		return nil, err
 	}
+	return claims, nil
+}
 
-	return token, claims, nil
+func checkTokenClaims(claims jwt.MapClaims, tokenType string) error {
+	if typ, _ := claims["typ"].(string); typ != tokenType {
+		return errors.New("unexpected token type")
+	}
+
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return errors.New("token has no jti")
+	}
+	sid, _ := claims["sid"].(string)
+	revoked, err := isTokenRevoked(jti, sid)
+	if err != nil {
+		return errRevocationCheckFailed
+	}
+	if revoked {
+		return errors.New("token has been revoked")
+	}
+	return nil
 }
 
+// Credentials the authentication middleware accepts besides first-party
+// access tokens.
+const (
+	acceptAPIKeys = 1 << iota
+	acceptClientTokens
+	// acceptImpersonatedWrites lets impersonation tokens that are not
+	// read-only change things; otherwise they may only read.
+	acceptImpersonatedWrites
+)
+
+// JWTMiddleware accepts first-party access tokens and API keys.
 func JWTMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return authMiddleware(next, acceptAPIKeys|acceptImpersonatedWrites)
+}
+
+// SessionMiddleware guards account management, which needs a user who logged
+// in: API keys and OAuth client tokens are refused.
+func SessionMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return authMiddleware(next, 0)
+}
+
+// OAuthMiddleware guards the endpoints OAuth clients may call.
+func OAuthMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return authMiddleware(next, acceptClientTokens)
+}
+
+func authMiddleware(next echo.HandlerFunc, accept int) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		authHeader := c.Request().Header.Get("Authorization")
+		if strings.HasPrefix(authHeader, "ApiKey ") {
+			if accept&acceptAPIKeys == 0 {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "API keys cannot be used for this endpoint"})
+			}
+			return apiKeyAuth(next, c, strings.TrimPrefix(authHeader, "ApiKey "))
+		}
 		if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
 			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Missing or invalid Authorization header"})
 		}
@@ -105,9 +204,20 @@ func JWTMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 		if err != nil {
 			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token: " + err.Error()})
 		}
+		clientID, _ := claims["client_id"].(string)
+		if clientID != "" && accept&acceptClientTokens == 0 {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Token was issued to an OAuth client"})
+		}
 
 		c.Set("phone_number", claims["phone_number"])
 		c.Set("user_id", claims["user_id"])
+		c.Set("session_id", claims["sid"])
+		c.Set("client_id", clientID)
+		c.Set("scope", claims["scope"])
+		c.Set(authz.ContextRolesKey, authz.RolesFromClaim(claims["roles"]))
+		if _, ok := claimActor(claims); ok {
+			return impersonationGuard(c, claims, accept, next)
+		}
 		return next(c)
 	}
 }
@@ -125,39 +235,142 @@ func register(c echo.Context) error {
 	if !validatePhone(req.PhoneNumber) {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid phone format"})
 	}
-	if len(req.Password) < 6 {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Password too short (min 6)"})
+	if err := validatePassword(req.Password); err != nil {
+		return weakPasswordResponse(c, err)
 	}
 
-	var exists int64
-	db.Model(&User{}).Where("phone_number = ?", req.PhoneNumber).Count(&exists)
-	if exists > 0 {
+	var user User
+	err := db.Where("phone_number = ?", req.PhoneNumber).First(&user).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	existing := err == nil
+	if existing && user.Status != UserStatusPending {
 		return c.JSON(http.StatusConflict, map[string]string{"error": "User already exists"})
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	// Anyone may register a pending phone number again, so that only sends a
+	// new code. The password is set by whoever confirms the code.
+	if !existing {
+		hashedPassword, err := hashPassword(req.Password)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to hash password"})
+		}
+		user = User{
+			PhoneNumber:  req.PhoneNumber,
+			PasswordHash: hashedPassword,
+			Status:       UserStatusPending,
+		}
+		if err := db.Create(&user).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create user"})
+		}
+	}
+
+	if err := issueVerificationCode(user.ID, PurposeRegistration, user.PhoneNumber); err != nil {
+		return otpErrorResponse(c, err)
+	}
+
+	status := http.StatusCreated
+	if existing {
+		status = http.StatusOK
+	}
+	return c.JSON(status, map[string]string{"message": "Verification code sent, confirm it at /register/verify"})
+}
+
+func findPendingUser(phoneNumber string) (*User, error) {
+	var user User
+	if err := db.Where("phone_number = ? AND status = ?", phoneNumber, UserStatusPending).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func verifyRegistration(c echo.Context) error {
+	type VerifyRequest struct {
+		PhoneNumber string `json:"phone_number"`
+		Code        string `json:"code"`
+		Password    string `json:"password"`
+		DeviceID    string `json:"device_id"`
+		DeviceName  string `json:"device_name"`
+	}
+	var req VerifyRequest
+	if err := c.Bind(&req); err != nil || req.Code == "" || !validDeviceID(req.DeviceID) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if err := validatePassword(req.Password); err != nil {
+		return weakPasswordResponse(c, err)
+	}
+
+	user, err := findPendingUser(req.PhoneNumber)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "No pending registration for this phone number"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	hashedPassword, err := hashPassword(req.Password)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to hash password"})
 	}
+	if _, err := verifyVerificationCode(user.ID, PurposeRegistration, req.Code); err != nil {
+		return otpErrorResponse(c, err)
+	}
 
-	user := User{
-		PhoneNumber:  req.PhoneNumber,
-		PasswordHash: string(hashedPassword),
+	// The password comes from the person holding the phone, not from
+	// whoever registered the number first
+	now := time.Now()
+	if err := db.Model(user).Updates(map[string]interface{}{
+		"status":            UserStatusActive,
+		"phone_verified_at": now,
+		"password_hash":     hashedPassword,
+	}).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to activate user"})
 	}
-	if err := db.Create(&user).Error; err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create user"})
+
+	// The device that proved the phone number needs no second code at login
+	if req.DeviceID != "" {
+		if err := trustDevice(c, user.ID, deviceHash(req.DeviceID), req.DeviceName); err != nil {
+			log.Printf("Failed to trust device for user %d: %v", user.ID, err)
+		}
 	}
 
-	return c.JSON(http.StatusCreated, map[string]string{"message": "User registered successfully"})
+	return c.JSON(http.StatusOK, map[string]string{"message": "Phone number verified, account activated"})
+}
+
+func resendRegistrationCode(c echo.Context) error {
+	type ResendRequest struct {
+		PhoneNumber string `json:"phone_number"`
+	}
+	var req ResendRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	user, err := findPendingUser(req.PhoneNumber)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "No pending registration for this phone number"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	if err := issueVerificationCode(user.ID, PurposeRegistration, user.PhoneNumber); err != nil {
+		return otpErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Verification code sent"})
 }
 
 func login(c echo.Context) error {
 	type LoginRequest struct {
 		PhoneNumber string `json:"phone_number"`
 		Password    string `json:"password"`
+		DeviceID    string `json:"device_id"`
+		DeviceName  string `json:"device_name"`
 	}
 	var req LoginRequest
-	if err := c.Bind(&req); err != nil {
+	if err := c.Bind(&req); err != nil || !validDeviceID(req.DeviceID) {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 	}
 
@@ -165,19 +378,71 @@ func login(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid credentials format"})
 	}
 
+	ip := c.RealIP()
+	if err := checkLoginAllowed(req.PhoneNumber, ip); err != nil {
+		recordAuthFailure(c, AuthEventLogin, nil, req.PhoneNumber, "throttled")
+		return loginThrottledResponse(c, err)
+	}
+
 	var user User
 	if err := db.Where("phone_number = ?", req.PhoneNumber).First(&user).Error; err != nil {
+		// Spend the time of a password check so unknown numbers can't be timed
+		hashPassword(req.Password)
+		recordLoginFailure(nil, req.PhoneNumber, ip)
+		recordAuthFailure(c, AuthEventLogin, nil, req.PhoneNumber, "unknown_phone")
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid credentials"})
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+	if !checkPassword(&user, req.Password) {
+		recordLoginFailure(&user, req.PhoneNumber, ip)
+		recordAuthFailure(c, AuthEventLogin, &user, req.PhoneNumber, "invalid_password")
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid credentials"})
 	}
 
-	tokenResponse, err := createTokenPair(user)
+	if err := phoneLoginLimit.reset(req.PhoneNumber); err != nil {
+		log.Printf("Failed to reset login failures for %s: %v", req.PhoneNumber, err)
+	}
+
+	switch user.Status {
+	case UserStatusActive:
+	case UserStatusDeactivated:
+		recordAuthFailure(c, AuthEventLogin, &user, req.PhoneNumber, "account_deactivated")
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Account is deactivated", "code": "account_deactivated"})
+	default:
+		recordAuthFailure(c, AuthEventLogin, &user, req.PhoneNumber, "phone_not_verified")
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Phone number not verified", "code": "phone_not_verified"})
+	}
+
+	if user.MFAEnabled {
+		challenge, err := createMFAChallenge(user, req.DeviceID, req.DeviceName)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create MFA challenge"})
+		}
+		recordAuthEvent(c, AuthEvent{UserID: &user.ID, PhoneNumber: user.PhoneNumber, Type: AuthEventLogin, Outcome: AuthOutcomeChallenge, Reason: "mfa_required"})
+		return c.JSON(http.StatusOK, challenge)
+	}
+
+	// Without MFA, the SMS code is what proves a new device belongs to the owner
+	known, err := recognizeDevice(c, &user, deviceHash(req.DeviceID), req.DeviceName)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	if !known {
+		challenge, err := createDeviceChallenge(user, req.DeviceID, req.DeviceName)
+		if err != nil {
+			return otpErrorResponse(c, err)
+		}
+		recordAuthEvent(c, AuthEvent{UserID: &user.ID, PhoneNumber: user.PhoneNumber, Type: AuthEventLogin, Outcome: AuthOutcomeChallenge, Reason: "new_device"})
+		return c.JSON(http.StatusOK, challenge)
+	}
+
+	session := newSession(c, req.DeviceName)
+	session.DeviceHash = deviceHash(req.DeviceID)
+	tokenResponse, err := createTokenPair(user, session)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate tokens"})
 	}
+	recordAuthSuccess(c, AuthEventLogin, user, sessionIDOf(tokenResponse))
 
 	return c.JSON(http.StatusOK, tokenResponse)
 }
@@ -191,11 +456,21 @@ func refreshToken(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 	}
 
-	var refreshToken RefreshToken
-	if err := db.Where("token = ? AND expires_at > ?", req.RefreshToken, time.Now()).First(&refreshToken).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired refresh token"})
-		}
+	refreshToken, err := redeemRefreshToken(req.RefreshToken, "")
+	if err != nil && refreshToken != nil {
+		recordRefreshFailure(c, *refreshToken, err)
+	}
+	switch err {
+	case nil:
+	case errRefreshTokenInvalid:
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid refresh token", "code": "refresh_token_invalid"})
+	case errRefreshTokenRevoked:
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Refresh token has been revoked", "code": "refresh_token_revoked"})
+	case errRefreshTokenReused:
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Refresh token has already been used", "code": "refresh_token_reused"})
+	case errRefreshTokenExpired:
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Refresh token has expired", "code": "refresh_token_expired"})
+	default:
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
 	}
 
@@ -204,24 +479,29 @@ func refreshToken(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "User not found"})
 	}
 
-	db.Delete(&refreshToken)
-
-	tokenResponse, err := createTokenPair(user)
+	tokenResponse, err := createTokenPair(user, continueSession(c, *refreshToken))
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate tokens"})
 	}
+	recordAuthSuccess(c, AuthEventRefresh, user, refreshToken.FamilyID)
 
 	return c.JSON(http.StatusOK, tokenResponse)
 }
 
 func logout(c echo.Context) error {
+	var userID uint
+	var sessionID string
 	authHeader := c.Request().Header.Get("Authorization")
 	if authHeader != "" && strings.HasPrefix(authHeader, "Bearer ") {
 		accessToken := strings.TrimPrefix(authHeader, "Bearer ")
 
-		refreshMutex.Lock()
-		tokenBlacklist[accessToken] = time.Now().Add(AccessTokenExpiry)
-		refreshMutex.Unlock()
+		if _, claims, err := validateAccessToken(accessToken); err == nil {
+			if err := revokeAccessToken(claims); err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke token"})
+			}
+			userID = claimUserID(claims)
+			sessionID, _ = claims["sid"].(string)
+		}
 	}
 
 	type LogoutRequest struct {
@@ -229,7 +509,18 @@ func logout(c echo.Context) error {
 	}
 	var req LogoutRequest
 	if err := c.Bind(&req); err == nil && req.RefreshToken != "" {
-		db.Where("token = ?", req.RefreshToken).Delete(&RefreshToken{})
+		var refreshToken RefreshToken
+		if err := db.Where("token_hash = ?", hashToken(req.RefreshToken)).First(&refreshToken).Error; err == nil {
+			if err := revokeSession(refreshToken.UserID, refreshToken.FamilyID); err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke refresh token"})
+			}
+			userID, sessionID = refreshToken.UserID, refreshToken.FamilyID
+		}
+	}
+
+	var user User
+	if userID != 0 && db.First(&user, userID).Error == nil {
+		recordAuthSuccess(c, AuthEventLogout, user, sessionID)
 	}
 
 	return c.JSON(http.StatusOK, map[string]string{"message": "Logged out successfully"})
@@ -237,6 +528,9 @@ func logout(c echo.Context) error {
 
 func checkToken(c echo.Context) error {
 	authHeader := c.Request().Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "ApiKey ") {
+		return checkAPIKey(c, strings.TrimPrefix(authHeader, "ApiKey "))
+	}
 	if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Missing or invalid Authorization header"})
 	}
@@ -247,11 +541,26 @@ func checkToken(c echo.Context) error {
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token: " + err.Error()})
 	}
 
-	return c.JSON(http.StatusOK, map[string]interface{}{
+	response := map[string]interface{}{
 		"valid":        true,
 		"user_id":      claims["user_id"],
 		"phone_number": claims["phone_number"],
-	})
+		"roles":        authz.RolesFromClaim(claims["roles"]),
+	}
+	// Services checking tokens here forward the request they are serving
+	if actorID, ok := claimActor(claims); ok {
+		response["actor_id"] = actorID
+		response["read_only"] = claimReadOnly(claims)
+		sid, _ := claims["sid"].(string)
+		storeImpersonationRequest(ImpersonationRequest{
+			SessionID: sid,
+			Service:   c.Request().Header.Get("X-Forwarded-Host"),
+			Method:    c.Request().Header.Get("X-Forwarded-Method"),
+			Path:      truncate(c.Request().Header.Get("X-Forwarded-Uri"), 255),
+			IPAddress: c.RealIP(),
+		})
+	}
+	return c.JSON(http.StatusOK, response)
 }
 
 func getProfileProtected(c echo.Context) error {
@@ -263,25 +572,15 @@ func getProfileProtected(c echo.Context) error {
 	if err := db.Where("phone_number = ?", phone).First(&user).Error; err != nil {
 		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
 	}
+	roles, err := userRoles(user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"id":           user.ID,
 		"phone_number": user.PhoneNumber,
+		"roles":        roles,
+		"mfa_enabled":  user.MFAEnabled,
 		"created_at":   user.CreatedAt,
 	})
 }
-
-func cleanupBlacklist() {
-	ticker := time.NewTicker(time.Hour)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		refreshMutex.Lock()
-		now := time.Now()
-		for token, expiry := range tokenBlacklist {
-			if now.After(expiry) {
-				delete(tokenBlacklist, token)
-			}
-		}
-		refreshMutex.Unlock()
-	}
-}
@@ -2,12 +2,29 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/elkin/system-design-final/shared/authpb"
+	"github.com/elkin/system-design-final/shared/authz"
+	"github.com/go-redis/redis/v8"
 	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -18,60 +35,1594 @@ func setupTestDB() {
 	if err != nil {
 		panic(err)
 	}
-	db.AutoMigrate(&User{})
+	db.AutoMigrate(&User{}, &RefreshToken{}, &SigningKey{}, &VerificationCode{}, &MFARecoveryCode{}, &UserRole{}, &OAuthClient{}, &OAuthAuthorizationCode{}, &OAuthConsent{}, &APIKey{}, &AuthEvent{}, &TrustedDevice{}, &KYCDocument{}, &KYCTierChange{}, &Impersonation{}, &ImpersonationRequest{})
+	initSigningKeys()
+}
+
+func setupTestRedis(t *testing.T) *miniredis.Miniredis {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Failed to start miniredis: %v", err)
+	}
+
+	rdb = redis.NewClient(&redis.Options{
+		Addr: mr.Addr(),
+	})
+	return mr
+}
+
+func postJSON(e *echo.Echo, handler echo.HandlerFunc, path string, body interface{}) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(payload))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	_ = handler(e.NewContext(req, rec))
+	return rec
 }
 
 func TestRegisterAndLogin(t *testing.T) {
 	e := echo.New()
 	setupTestDB()
-	e.POST("/register", register)
-	e.POST("/login", login)
+	mr := setupTestRedis(t)
+	defer mr.Close()
+
+	credentials := map[string]string{"phone_number": "+77001112233", "password": "Testpass1"}
 
 	// Test registration
-	regBody := map[string]string{"phone_number": "+77001112233", "password": "testpass"}
-	regJSON, _ := json.Marshal(regBody)
-	req := httptest.NewRequest(http.MethodPost, "/register", bytes.NewReader(regJSON))
-	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
-	rec := httptest.NewRecorder()
-	c := e.NewContext(req, rec)
-	if err := register(c); err != nil {
-		t.Fatalf("register error: %v", err)
-	}
+	rec := postJSON(e, register, "/register", credentials)
 	if rec.Code != http.StatusCreated {
 		t.Errorf("expected 201, got %d", rec.Code)
 	}
 
+	// Test login before the phone number is verified
+	recP := postJSON(e, login, "/login", credentials)
+	if recP.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for unverified user, got %d", recP.Code)
+	}
+
+	// Test verification with a wrong code, then the issued one
+	db.Model(&VerificationCode{}).Where("purpose = ?", PurposeRegistration).Update("code_hash", hashToken("123456"))
+	recW := postJSON(e, verifyRegistration, "/register/verify", map[string]string{"phone_number": "+77001112233", "code": "000000", "password": "Testpass1"})
+	if recW.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for wrong code, got %d", recW.Code)
+	}
+	recV := postJSON(e, verifyRegistration, "/register/verify", map[string]string{"phone_number": "+77001112233", "code": "123456", "password": "Testpass1"})
+	if recV.Code != http.StatusOK {
+		t.Errorf("expected 200 for verification, got %d", recV.Code)
+	}
+
 	// Test duplicate registration
-	rec2 := httptest.NewRecorder()
-	c2 := e.NewContext(req, rec2)
-	_ = register(c2)
+	rec2 := postJSON(e, register, "/register", credentials)
 	if rec2.Code != http.StatusConflict {
 		t.Errorf("expected 409 for duplicate, got %d", rec2.Code)
 	}
 
 	// Test login
-	loginBody := map[string]string{"phone_number": "+77001112233", "password": "testpass"}
-	loginJSON, _ := json.Marshal(loginBody)
-	reqL := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(loginJSON))
-	reqL.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
-	recL := httptest.NewRecorder()
-	cL := e.NewContext(reqL, recL)
-	if err := login(cL); err != nil {
-		t.Fatalf("login error: %v", err)
-	}
+	recL := postJSON(e, login, "/login", credentials)
 	if recL.Code != http.StatusOK {
 		t.Errorf("expected 200, got %d", recL.Code)
 	}
 
 	// Test login with wrong password
-	loginBodyBad := map[string]string{"phone_number": "+77001112233", "password": "wrongpass"}
-	loginJSONBad, _ := json.Marshal(loginBodyBad)
-	reqLB := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(loginJSONBad))
-	reqLB.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
-	recLB := httptest.NewRecorder()
-	cLB := e.NewContext(reqLB, recLB)
-	_ = login(cLB)
+	recLB := postJSON(e, login, "/login", map[string]string{"phone_number": "+77001112233", "password": "wrongpass"})
 	if recLB.Code != http.StatusUnauthorized {
 		t.Errorf("expected 401 for wrong password, got %d", recLB.Code)
 	}
 }
+
+func TestRegistrationCodeLimits(t *testing.T) {
+	e := echo.New()
+	setupTestDB()
+
+	rec := postJSON(e, register, "/register", map[string]string{"phone_number": "+77001119999", "password": "Testpass1"})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rec.Code)
+	}
+
+	recR := postJSON(e, resendRegistrationCode, "/register/resend", map[string]string{"phone_number": "+77001119999"})
+	if recR.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 for immediate resend, got %d", recR.Code)
+	}
+
+	for i := 0; i < OTPMaxAttempts; i++ {
+		postJSON(e, verifyRegistration, "/register/verify", map[string]string{"phone_number": "+77001119999", "code": "bad", "password": "Testpass1"})
+	}
+	recV := postJSON(e, verifyRegistration, "/register/verify", map[string]string{"phone_number": "+77001119999", "code": "bad", "password": "Testpass1"})
+	if recV.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 after too many attempts, got %d", recV.Code)
+	}
+}
+
+func TestReregisteringPendingPhoneKeepsOwnerPassword(t *testing.T) {
+	e := echo.New()
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+
+	owner := map[string]string{"phone_number": "+77001118888", "password": "Ownerpass1"}
+	if rec := postJSON(e, register, "/register", owner); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rec.Code)
+	}
+	// Someone else registers the same pending number with their own password
+	db.Model(&VerificationCode{}).Where("purpose = ?", PurposeRegistration).Update("created_at", time.Now().Add(-OTPResendInterval))
+	attacker := map[string]string{"phone_number": "+77001118888", "password": "Attacker1x"}
+	if rec := postJSON(e, register, "/register", attacker); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for a pending number, got %d", rec.Code)
+	}
+
+	db.Model(&VerificationCode{}).Where("purpose = ? AND consumed_at IS NULL", PurposeRegistration).Update("code_hash", hashToken("123456"))
+	recV := postJSON(e, verifyRegistration, "/register/verify", map[string]string{"phone_number": "+77001118888", "code": "123456", "password": "Ownerpass1"})
+	if recV.Code != http.StatusOK {
+		t.Fatalf("expected 200 for verification, got %d", recV.Code)
+	}
+
+	if rec := postJSON(e, login, "/login", attacker); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for the other registrant's password, got %d", rec.Code)
+	}
+	if rec := postJSON(e, login, "/login", owner); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 for the password set at verification, got %d", rec.Code)
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+	e := echo.New()
+
+	user := User{PhoneNumber: "+77001112244", PasswordHash: "x"}
+	db.Create(&user)
+
+	tokens, err := createTokenPair(user, sessionInfo{})
+	if err != nil {
+		t.Fatalf("createTokenPair error: %v", err)
+	}
+	oldToken := tokens["access_token"].(string)
+
+	oldKey := keyring.signingKey()
+	if err := rotateSigningKey(time.Now().Add(keyPublishLead)); err != nil {
+		t.Fatalf("rotateSigningKey error: %v", err)
+	}
+	if err := rotateSigningKey(time.Now().Add(keyPublishLead)); err != nil {
+		t.Fatalf("rotateSigningKey error: %v", err)
+	}
+	var keys int64
+	db.Model(&SigningKey{}).Count(&keys)
+	if keys != 2 {
+		t.Errorf("expected a single pending key to be added, got %d keys", keys)
+	}
+	if keyring.signingKey().id != oldKey.id {
+		t.Errorf("a pending key must not sign before verifiers could have fetched it")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	rec := httptest.NewRecorder()
+	if err := getJWKS(e.NewContext(req, rec)); err != nil {
+		t.Fatalf("getJWKS error: %v", err)
+	}
+
+	var jwks struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &jwks); err != nil {
+		t.Fatalf("failed to parse JWKS: %v", err)
+	}
+	if len(jwks.Keys) != 2 {
+		t.Errorf("expected 2 published keys, got %d", len(jwks.Keys))
+	}
+	for _, key := range jwks.Keys {
+		if key["kid"] == "" || key["alg"] != "RS256" || key["kty"] != "RSA" {
+			t.Errorf("unexpected JWK: %v", key)
+		}
+	}
+
+	// Once the lead time has passed the new key takes over
+	db.Model(&SigningKey{}).Where("id <> ?", oldKey.id).Update("activates_at", time.Now())
+	if err := loadSigningKeys(); err != nil {
+		t.Fatalf("loadSigningKeys error: %v", err)
+	}
+	if err := retireReplacedKeys(); err != nil {
+		t.Fatalf("retireReplacedKeys error: %v", err)
+	}
+	if keyring.signingKey() == nil || keyring.signingKey().id == oldKey.id {
+		t.Errorf("expected the new key to sign once it is active")
+	}
+	var old SigningKey
+	db.First(&old, "id = ?", oldKey.id)
+	if old.RetiredAt == nil {
+		t.Errorf("expected the replaced key to be retired")
+	}
+	if _, _, err := validateAccessToken(oldToken); err != nil {
+		t.Errorf("token signed with retired key should still validate: %v", err)
+	}
+}
+
+func TestLogoutRevokesAccessToken(t *testing.T) {
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+	e := echo.New()
+
+	user := User{PhoneNumber: "+77001112255", PasswordHash: "x"}
+	db.Create(&user)
+
+	tokens, err := createTokenPair(user, sessionInfo{})
+	if err != nil {
+		t.Fatalf("createTokenPair error: %v", err)
+	}
+	accessToken := tokens["access_token"].(string)
+
+	_, claims, err := validateAccessToken(accessToken)
+	if err != nil {
+		t.Fatalf("fresh token should be valid: %v", err)
+	}
+	if claims["jti"] == "" {
+		t.Errorf("expected access token to carry a jti")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	rec := httptest.NewRecorder()
+	if err := logout(e.NewContext(req, rec)); err != nil {
+		t.Fatalf("logout error: %v", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", rec.Code)
+	}
+
+	if _, _, err := validateAccessToken(accessToken); err == nil {
+		t.Errorf("expected revoked token to be rejected")
+	}
+	if ttl := mr.TTL(revokedTokenPrefix + claims["jti"].(string)); ttl <= 0 || ttl > AccessTokenExpiry {
+		t.Errorf("expected revocation TTL within token lifetime, got %v", ttl)
+	}
+}
+
+func postRefresh(e *echo.Echo, token string) *httptest.ResponseRecorder {
+	return postJSON(e, refreshToken, "/refresh", map[string]string{"refresh_token": token})
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+	e := echo.New()
+
+	user := User{PhoneNumber: "+77001112266", PasswordHash: "x"}
+	db.Create(&user)
+
+	tokens, err := createTokenPair(user, sessionInfo{})
+	if err != nil {
+		t.Fatalf("createTokenPair error: %v", err)
+	}
+	original := tokens["refresh_token"].(string)
+
+	var stored RefreshToken
+	if err := db.Where("token_hash = ?", hashToken(original)).First(&stored).Error; err != nil {
+		t.Fatalf("refresh token should be stored hashed: %v", err)
+	}
+
+	rec := postRefresh(e, original)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 on first refresh, got %d", rec.Code)
+	}
+	var rotated map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &rotated)
+	next := rotated["refresh_token"].(string)
+
+	rec = postRefresh(e, original)
+	if rec.Code != http.StatusUnauthorized || !bytes.Contains(rec.Body.Bytes(), []byte("refresh_token_reused")) {
+		t.Fatalf("expected refresh_token_reused, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = postRefresh(e, next)
+	if rec.Code != http.StatusUnauthorized || !bytes.Contains(rec.Body.Bytes(), []byte("refresh_token_revoked")) {
+		t.Errorf("expected rotated successor to be revoked, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	var active int64
+	db.Model(&RefreshToken{}).Where("family_id = ? AND revoked_at IS NULL", stored.FamilyID).Count(&active)
+	if active != 0 {
+		t.Errorf("expected whole family revoked, %d tokens still active", active)
+	}
+
+	rec = postRefresh(e, "unknown")
+	if !bytes.Contains(rec.Body.Bytes(), []byte("refresh_token_invalid")) {
+		t.Errorf("expected refresh_token_invalid, got %s", rec.Body.String())
+	}
+}
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA1, truncated to six digits
+	secret := []byte("12345678901234567890")
+	if code := totpCode(secret, 59/TOTPPeriod); code != "287082" {
+		t.Errorf("expected 287082, got %s", code)
+	}
+	if code := totpCode(secret, 1111111109/TOTPPeriod); code != "081804" {
+		t.Errorf("expected 081804, got %s", code)
+	}
+}
+
+func TestMFALogin(t *testing.T) {
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+	e := echo.New()
+
+	secret, _ := generateTOTPSecret()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.MinCost)
+	user := User{PhoneNumber: "+77001112277", PasswordHash: string(hash), MFAEnabled: true, MFASecret: secret}
+	db.Create(&user)
+	codes, err := generateRecoveryCodes(user.ID)
+	if err != nil {
+		t.Fatalf("generateRecoveryCodes error: %v", err)
+	}
+
+	credentials := map[string]string{"phone_number": user.PhoneNumber, "password": "testpass"}
+	rec := postJSON(e, login, "/login", credentials)
+	var challenge map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &challenge)
+	if challenge["mfa_required"] != true || challenge["access_token"] != nil {
+		t.Fatalf("expected MFA challenge instead of tokens, got %s", rec.Body.String())
+	}
+	mfaToken := challenge["mfa_token"].(string)
+
+	if _, _, err := validateAccessToken(mfaToken); err == nil {
+		t.Errorf("MFA challenge must not be accepted as an access token")
+	}
+
+	rec = postJSON(e, loginMFA, "/login/mfa", map[string]string{"mfa_token": mfaToken, "code": "000000"})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for wrong code, got %d", rec.Code)
+	}
+
+	key, _ := totpEncoding.DecodeString(secret)
+	code := totpCode(key, time.Now().Unix()/TOTPPeriod)
+	rec = postJSON(e, loginMFA, "/login/mfa", map[string]string{"mfa_token": mfaToken, "code": code})
+	if rec.Code != http.StatusOK || !bytes.Contains(rec.Body.Bytes(), []byte("access_token")) {
+		t.Fatalf("expected tokens after valid code, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = postJSON(e, loginMFA, "/login/mfa", map[string]string{"mfa_token": mfaToken, "code": code})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected used challenge to be rejected, got %d", rec.Code)
+	}
+
+	// A fresh challenge cannot replay the same TOTP code but accepts a recovery code once
+	rec = postJSON(e, login, "/login", credentials)
+	json.Unmarshal(rec.Body.Bytes(), &challenge)
+	mfaToken = challenge["mfa_token"].(string)
+	rec = postJSON(e, loginMFA, "/login/mfa", map[string]string{"mfa_token": mfaToken, "code": code})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected replayed TOTP code to be rejected, got %d", rec.Code)
+	}
+	rec = postJSON(e, loginMFA, "/login/mfa", map[string]string{"mfa_token": mfaToken, "recovery_code": codes[0]})
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected recovery code to be accepted, got %d %s", rec.Code, rec.Body.String())
+	}
+	if useRecoveryCode(user.ID, codes[0]) {
+		t.Errorf("recovery code must be single-use")
+	}
+}
+
+func TestPasswordResetRevokesRefreshTokens(t *testing.T) {
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+	e := echo.New()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.MinCost)
+	user := User{PhoneNumber: "+77001112288", PasswordHash: string(hash)}
+	db.Create(&user)
+	tokens, _ := createTokenPair(user, sessionInfo{})
+
+	rec := postJSON(e, requestPasswordReset, "/password/reset/request", map[string]string{"phone_number": user.PhoneNumber})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	recU := postJSON(e, requestPasswordReset, "/password/reset/request", map[string]string{"phone_number": "+77009999999"})
+	if recU.Code != http.StatusOK || recU.Body.String() != rec.Body.String() {
+		t.Errorf("unknown numbers should get the same response, got %d %s", recU.Code, recU.Body.String())
+	}
+
+	db.Model(&VerificationCode{}).Where("purpose = ?", PurposePasswordReset).Update("code_hash", hashToken("654321"))
+	confirm := map[string]string{"phone_number": user.PhoneNumber, "code": "654321", "new_password": "Newpass12"}
+	rec = postJSON(e, confirmPasswordReset, "/password/reset/confirm", confirm)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for reset, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = postJSON(e, confirmPasswordReset, "/password/reset/confirm", confirm)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected used code to be rejected, got %d", rec.Code)
+	}
+
+	rec = postRefresh(e, tokens["refresh_token"].(string))
+	if !bytes.Contains(rec.Body.Bytes(), []byte("refresh_token_revoked")) {
+		t.Errorf("expected refresh token revoked after reset, got %s", rec.Body.String())
+	}
+
+	recL := postJSON(e, login, "/login", map[string]string{"phone_number": user.PhoneNumber, "password": "Newpass12"})
+	if recL.Code != http.StatusOK {
+		t.Errorf("expected login with new password, got %d", recL.Code)
+	}
+
+	// Change password requires the current one
+	change := func(current string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"current_password": current, "new_password": "Other1234"})
+		req := httptest.NewRequest(http.MethodPost, "/password/change", bytes.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("user_id", float64(user.ID))
+		changePassword(c)
+		return rec
+	}
+	if rec := change("wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for wrong current password, got %d", rec.Code)
+	}
+
+	// A session cannot be used to guess the password past the login limits
+	for i := 1; i < StepUpMaxFailures; i++ {
+		change("wrong")
+	}
+	if rec := change("Newpass12"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected password changes to be throttled after repeated failures, got %d", rec.Code)
+	}
+	recL = postJSON(e, login, "/login", map[string]string{"phone_number": user.PhoneNumber, "password": "Newpass12"})
+	if recL.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the wrong passwords to count towards the login lockout, got %d", recL.Code)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+	e := echo.New()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.MinCost)
+	user := User{PhoneNumber: "+77001112299", PasswordHash: string(hash)}
+	db.Create(&user)
+	wrong := map[string]string{"phone_number": user.PhoneNumber, "password": "wrongpass"}
+
+	for i := int64(0); i < phoneLoginLimit.delayAfter; i++ {
+		if rec := postJSON(e, login, "/login", wrong); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i+1, rec.Code)
+		}
+	}
+
+	rec := postJSON(e, login, "/login", wrong)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected progressive delay, got %d", rec.Code)
+	}
+
+	for i := phoneLoginLimit.delayAfter; i < phoneLoginLimit.lockAfter; i++ {
+		mr.FastForward(LoginMaxDelay)
+		postJSON(e, login, "/login", wrong)
+	}
+	mr.FastForward(LoginMaxDelay)
+
+	rec = postJSON(e, login, "/login", map[string]string{"phone_number": user.PhoneNumber, "password": "testpass"})
+	if rec.Code != http.StatusTooManyRequests || !bytes.Contains(rec.Body.Bytes(), []byte("login_locked")) {
+		t.Fatalf("expected account locked even with the right password, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/users/1/unlock", nil)
+	recU := httptest.NewRecorder()
+	c := e.NewContext(req, recU)
+	c.SetParamNames("id")
+	c.SetParamValues(fmt.Sprint(user.ID))
+	c.Set(authz.ContextRolesKey, []string{authz.RoleAdmin})
+	authz.RequirePermission(authz.PermUsersManage)(unlockUser)(c)
+	if recU.Code != http.StatusOK {
+		t.Fatalf("expected unlock to succeed, got %d", recU.Code)
+	}
+
+	rec = postJSON(e, login, "/login", map[string]string{"phone_number": user.PhoneNumber, "password": "testpass"})
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected login after unlock, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestLoginIPLimitIgnoresSpoofedForwardedFor(t *testing.T) {
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+	e := echo.New()
+	extractor, err := authz.ClientIPExtractor("10.0.0.2")
+	if err != nil {
+		t.Fatalf("ClientIPExtractor error: %v", err)
+	}
+	e.IPExtractor = extractor
+
+	// A different number every time, as in credential stuffing
+	attempts := 0
+	attempt := func(remoteAddr, forwardedFor string) {
+		attempts++
+		payload, _ := json.Marshal(map[string]string{"phone_number": fmt.Sprintf("+770011100%02d", attempts), "password": "wrongpass"})
+		req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(payload))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderXForwardedFor, forwardedFor)
+		req.RemoteAddr = remoteAddr
+		login(e.NewContext(req, httptest.NewRecorder()))
+	}
+
+	// Straight to the service: the header is not believed at all
+	attempt("203.0.113.7:5000", "198.51.100.1")
+	attempt("203.0.113.7:5000", "198.51.100.2")
+	// Through nginx, which appends the address it saw
+	attempt("10.0.0.2:5000", "198.51.100.3, 203.0.113.8")
+	attempt("10.0.0.2:5000", "198.51.100.4, 203.0.113.8")
+
+	for _, ip := range []string{"203.0.113.7", "203.0.113.8"} {
+		if failures, _ := mr.Get(ipLoginLimit.key("fail", ip)); failures != "2" {
+			t.Errorf("expected 2 failures counted for %s, got %q", ip, failures)
+		}
+	}
+	for i := 1; i <= 4; i++ {
+		if ip := fmt.Sprintf("198.51.100.%d", i); mr.Exists(ipLoginLimit.key("fail", ip)) {
+			t.Errorf("failure counted for spoofed address %s", ip)
+		}
+	}
+}
+
+func TestSessionManagement(t *testing.T) {
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+	e := echo.New()
+
+	maxSessionsPerUser = 3
+	defer func() { maxSessionsPerUser = 10 }()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.MinCost)
+	user := User{PhoneNumber: "+77001112300", PasswordHash: string(hash)}
+	db.Create(&user)
+
+	var accessTokens []string
+	for _, device := range []string{"laptop", "phone", "tablet", "tv"} {
+		rec := postJSON(e, login, "/login", map[string]string{"phone_number": user.PhoneNumber, "password": "testpass", "device_name": device})
+		var tokens map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &tokens)
+		accessTokens = append(accessTokens, tokens["access_token"].(string))
+	}
+
+	sessions, _ := activeSessions(user.ID)
+	if len(sessions) != 3 || sessions[0].DeviceName != "phone" {
+		t.Fatalf("expected the oldest session to be evicted, got %d sessions", len(sessions))
+	}
+	if _, _, err := validateAccessToken(accessTokens[0]); err == nil {
+		t.Errorf("expected access token of the evicted session to be rejected")
+	}
+
+	authed := func(method, path string, handler echo.HandlerFunc, token string, params ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		if len(params) == 2 {
+			c.SetParamNames(params[0])
+			c.SetParamValues(params[1])
+		}
+		JWTMiddleware(handler)(c)
+		return rec
+	}
+
+	current := accessTokens[3]
+	rec := authed(http.MethodGet, "/sessions", listSessions, current)
+	var listed []map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &listed)
+	if len(listed) != 3 || listed[2]["current"] != true || listed[2]["device_name"] != "tv" {
+		t.Fatalf("unexpected session list: %s", rec.Body.String())
+	}
+
+	rec = authed(http.MethodDelete, "/sessions/x", deleteSession, current, "id", listed[0]["id"].(string))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 deleting a session, got %d", rec.Code)
+	}
+	if _, _, err := validateAccessToken(accessTokens[1]); err == nil {
+		t.Errorf("expected access token of the deleted session to be rejected")
+	}
+
+	rec = authed(http.MethodPost, "/sessions/revoke-others", revokeOtherSessions, current)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 revoking other sessions, got %d", rec.Code)
+	}
+	sessions, _ = activeSessions(user.ID)
+	if len(sessions) != 1 || sessions[0].DeviceName != "tv" {
+		t.Errorf("expected only the current session to remain, got %d", len(sessions))
+	}
+	if _, _, err := validateAccessToken(current); err != nil {
+		t.Errorf("current session should stay valid: %v", err)
+	}
+}
+
+func TestRoleAssignment(t *testing.T) {
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+	e := echo.New()
+
+	admin := User{PhoneNumber: "+77001112311", PasswordHash: "x"}
+	member := User{PhoneNumber: "+77001112322", PasswordHash: "x"}
+	db.Create(&admin)
+	db.Create(&member)
+	grantRole(admin.ID, authz.RoleAdmin, nil)
+
+	adminTokens, _ := createTokenPair(admin, sessionInfo{})
+	memberTokens, _ := createTokenPair(member, sessionInfo{})
+
+	call := func(method string, handler echo.HandlerFunc, permission, token string, body interface{}, params ...string) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, "/admin/users", bytes.NewReader(payload))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames(params[0 : len(params)/2]...)
+		c.SetParamValues(params[len(params)/2:]...)
+		JWTMiddleware(authz.RequirePermission(permission)(handler))(c)
+		return rec
+	}
+	memberID := fmt.Sprint(member.ID)
+
+	rec := call(http.MethodPost, assignRole, authz.PermRolesManage, memberTokens["access_token"].(string), map[string]string{"role": "admin"}, "id", memberID)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a regular user, got %d", rec.Code)
+	}
+
+	rec = call(http.MethodPost, assignRole, authz.PermRolesManage, adminTokens["access_token"].(string), map[string]string{"role": "superuser"}, "id", memberID)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown role, got %d", rec.Code)
+	}
+
+	rec = call(http.MethodPost, assignRole, authz.PermRolesManage, adminTokens["access_token"].(string), map[string]string{"role": authz.RoleSupport}, "id", memberID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 assigning a role, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	tokens, _ := createTokenPair(member, sessionInfo{})
+	_, claims, _ := validateAccessToken(tokens["access_token"].(string))
+	roles := authz.RolesFromClaim(claims["roles"])
+	if !authz.HasPermission(roles, authz.PermBalanceReadAny) || authz.HasPermission(roles, authz.PermFraudRulesWrite) {
+		t.Errorf("unexpected permissions for roles %v", roles)
+	}
+
+	rec = call(http.MethodDelete, removeRole, authz.PermRolesManage, adminTokens["access_token"].(string), nil, "id", "role", memberID, authz.RoleSupport)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 removing a role, got %d", rec.Code)
+	}
+	if _, _, err := validateAccessToken(tokens["access_token"].(string)); err == nil {
+		t.Errorf("expected tokens carrying the removed role to be revoked")
+	}
+}
+
+func TestIntrospectToken(t *testing.T) {
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+	server := &authServer{}
+
+	user := User{PhoneNumber: "+77001112333", PasswordHash: "x", Status: UserStatusActive}
+	db.Create(&user)
+	grantRole(user.ID, authz.RoleSupport, nil)
+	tokens, _ := createTokenPair(user, sessionInfo{})
+	accessToken := tokens["access_token"].(string)
+
+	resp, err := server.IntrospectToken(context.Background(), &authpb.IntrospectTokenRequest{Token: accessToken})
+	if err != nil || !resp.Active {
+		t.Fatalf("expected active token, got %v %v", resp, err)
+	}
+	if resp.UserId != uint64(user.ID) || resp.SessionId == "" || len(resp.Roles) != 2 {
+		t.Errorf("unexpected introspection result: %v", resp)
+	}
+
+	_, claims, _ := validateAccessToken(accessToken)
+	revokeAccessToken(claims)
+	resp, err = server.IntrospectToken(context.Background(), &authpb.IntrospectTokenRequest{Token: accessToken})
+	if err != nil || resp.Active {
+		t.Errorf("expected revoked token to be inactive, got %v %v", resp, err)
+	}
+
+	mr.Close()
+	tokens, _ = createTokenPair(user, sessionInfo{})
+	if _, err := server.IntrospectToken(context.Background(), &authpb.IntrospectTokenRequest{Token: tokens["access_token"].(string)}); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable when revocations cannot be checked, got %v", err)
+	}
+
+	userResp, err := server.GetUser(context.Background(), &authpb.GetUserRequest{UserId: uint64(user.ID)})
+	if err != nil || userResp.PhoneNumber != user.PhoneNumber || userResp.Status != UserStatusActive {
+		t.Errorf("unexpected GetUser result: %v %v", userResp, err)
+	}
+	if _, err := server.GetUser(context.Background(), &authpb.GetUserRequest{UserId: 9999}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound, got %v", err)
+	}
+}
+
+func postForm(e *echo.Echo, handler echo.HandlerFunc, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+	handler(e.NewContext(req, rec))
+	return rec
+}
+
+func TestOAuthAuthorizationCodeWithPKCE(t *testing.T) {
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+	e := echo.New()
+
+	client := OAuthClient{
+		ID:           "spa",
+		Name:         "Budget app",
+		RedirectURIs: "https://app.example.com/callback",
+		Scopes:       "openid phone offline_access",
+		GrantTypes:   "authorization_code refresh_token",
+	}
+	db.Create(&client)
+	user := User{PhoneNumber: "+77001112344", PasswordHash: "x", Status: UserStatusActive}
+	db.Create(&user)
+	tokens, _ := createTokenPair(user, sessionInfo{})
+	userToken := tokens["access_token"].(string)
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	authorizeWith := func(approve *bool) *httptest.ResponseRecorder {
+		body := map[string]interface{}{
+			"client_id":             client.ID,
+			"redirect_uri":          "https://app.example.com/callback",
+			"response_type":         "code",
+			"scope":                 "openid phone offline_access",
+			"state":                 "xyz",
+			"nonce":                 "n-0S6",
+			"code_challenge":        pkceChallenge(verifier),
+			"code_challenge_method": "S256",
+		}
+		if approve != nil {
+			body["approve"] = *approve
+		}
+		jsonBytes, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/oauth/authorize", bytes.NewReader(jsonBytes))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("Authorization", "Bearer "+userToken)
+		rec := httptest.NewRecorder()
+		JWTMiddleware(authorize)(e.NewContext(req, rec))
+		return rec
+	}
+
+	if rec := authorizeWith(nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected consent to be required, got %d", rec.Code)
+	}
+	approve := true
+	rec := authorizeWith(&approve)
+	var redirect map[string]string
+	json.Unmarshal(rec.Body.Bytes(), &redirect)
+	location, _ := url.Parse(redirect["redirect_to"])
+	code := location.Query().Get("code")
+	if code == "" || location.Query().Get("state") != "xyz" {
+		t.Fatalf("unexpected authorize response: %s", rec.Body.String())
+	}
+
+	exchange := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {client.ID},
+		"code":          {code},
+		"redirect_uri":  {"https://app.example.com/callback"},
+		"code_verifier": {"wrong-verifier"},
+	}
+	if rec := postForm(e, oauthToken, exchange); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a wrong PKCE verifier to be rejected, got %d", rec.Code)
+	}
+
+	exchange.Set("code_verifier", verifier)
+	rec = postForm(e, oauthToken, exchange)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected code exchange to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var oauthTokens map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &oauthTokens)
+	_, idClaims, err := parseSignedToken(oauthTokens["id_token"].(string))
+	if err != nil || idClaims["aud"] != client.ID || idClaims["nonce"] != "n-0S6" || idClaims["phone_number"] != user.PhoneNumber {
+		t.Errorf("unexpected ID token claims: %v %v", idClaims, err)
+	}
+
+	if rec := postForm(e, oauthToken, exchange); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected the code to be single use, got %d", rec.Code)
+	}
+
+	clientToken := oauthTokens["access_token"].(string)
+	req := httptest.NewRequest(http.MethodGet, "/profile", nil)
+	req.Header.Set("Authorization", "Bearer "+clientToken)
+	rec = httptest.NewRecorder()
+	JWTMiddleware(getProfileProtected)(e.NewContext(req, rec))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected client tokens to be kept off first-party endpoints, got %d", rec.Code)
+	}
+
+	if rec := authorizeWith(nil); rec.Code != http.StatusOK {
+		t.Errorf("expected stored consent to be reused, got %d", rec.Code)
+	}
+
+	refresh := url.Values{"grant_type": {"refresh_token"}, "client_id": {client.ID}, "refresh_token": {oauthTokens["refresh_token"].(string)}}
+	if rec := postRefresh(e, oauthTokens["refresh_token"].(string)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected client refresh tokens to be rejected by /refresh, got %d", rec.Code)
+	}
+	if rec := postForm(e, oauthToken, refresh); rec.Code != http.StatusOK {
+		t.Errorf("expected refresh grant to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+	e := echo.New()
+
+	user := User{PhoneNumber: "+77001112355", PasswordHash: "x", Status: UserStatusActive}
+	db.Create(&user)
+	tokens, _ := createTokenPair(user, sessionInfo{})
+	userToken := tokens["access_token"].(string)
+
+	call := func(middleware echo.MiddlewareFunc, handler echo.HandlerFunc, authorization, ip string, body interface{}) *httptest.ResponseRecorder {
+		jsonBytes, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBytes))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("Authorization", authorization)
+		req.Header.Set(echo.HeaderXRealIP, ip)
+		rec := httptest.NewRecorder()
+		middleware(handler)(e.NewContext(req, rec))
+		return rec
+	}
+
+	rec := call(SessionMiddleware, createAPIKey, "Bearer "+userToken, "10.0.0.1", map[string]interface{}{"name": "shop", "scopes": []string{authz.PermUsersRead}})
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected scopes beyond the user's permissions to be refused, got %d", rec.Code)
+	}
+
+	rec = call(SessionMiddleware, createAPIKey, "Bearer "+userToken, "10.0.0.1", map[string]interface{}{
+		"name":        "shop",
+		"scopes":      []string{authz.PermTransactionsCreate},
+		"allowed_ips": []string{"192.168.1.0/24"},
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected API key to be created, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var created map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &created)
+	apiKey := "ApiKey " + created["key"].(string)
+
+	if rec := call(JWTMiddleware, getProfileProtected, apiKey, "192.168.1.20", nil); rec.Code != http.StatusOK {
+		t.Errorf("expected API key to authenticate, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := call(JWTMiddleware, getProfileProtected, apiKey, "10.0.0.1", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected API key to be refused outside its allowlist, got %d", rec.Code)
+	}
+	if rec := call(SessionMiddleware, listAPIKeys, apiKey, "192.168.1.20", nil); rec.Code != http.StatusForbidden {
+		t.Errorf("expected API keys to be refused for account management, got %d", rec.Code)
+	}
+
+	// Behind nginx only the address it saw counts, not one the client claims
+	proxied := echo.New()
+	proxied.IPExtractor, _ = authz.ClientIPExtractor("10.0.0.2")
+	for _, spoofed := range []struct{ remoteAddr, forwardedFor string }{
+		{"203.0.113.7:5000", "192.168.1.20"},
+		{"10.0.0.2:5000", "192.168.1.20, 203.0.113.7"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", apiKey)
+		req.Header.Set(echo.HeaderXForwardedFor, spoofed.forwardedFor)
+		req.RemoteAddr = spoofed.remoteAddr
+		rec := httptest.NewRecorder()
+		JWTMiddleware(getProfileProtected)(proxied.NewContext(req, rec))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("expected spoofed X-Forwarded-For %q to be refused, got %d", spoofed.forwardedFor, rec.Code)
+		}
+	}
+
+	var key APIKey
+	db.First(&key, created["id"])
+	if key.LastUsedAt == nil || key.LastUsedIP != "192.168.1.20" || key.KeyHash == created["key"] {
+		t.Errorf("expected a hashed key with its last use recorded, got %+v", key)
+	}
+
+	resp, err := (&authServer{}).IntrospectAPIKey(context.Background(), &authpb.IntrospectAPIKeyRequest{Key: created["key"].(string), IpAddress: "192.168.1.20"})
+	if err != nil || !resp.Active || len(resp.Scopes) != 1 || resp.Jti != key.revocationID() {
+		t.Errorf("unexpected API key introspection: %v %v", resp, err)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+userToken)
+	rec = httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(fmt.Sprint(key.ID))
+	SessionMiddleware(revokeAPIKey)(c)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected API key to be revoked, got %d", rec.Code)
+	}
+	if rec := call(JWTMiddleware, getProfileProtected, apiKey, "192.168.1.20", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected revoked API key to be refused, got %d", rec.Code)
+	}
+}
+
+func TestAccountLifecycle(t *testing.T) {
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+	e := echo.New()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.MinCost)
+	user := User{PhoneNumber: "+77001112366", PasswordHash: string(hash)}
+	db.Create(&user)
+	db.Create(&User{PhoneNumber: "+77001112367", PasswordHash: string(hash)})
+
+	asUser := func(handler echo.HandlerFunc, body interface{}) *httptest.ResponseRecorder {
+		jsonBytes, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBytes))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("user_id", float64(user.ID))
+		handler(c)
+		return rec
+	}
+
+	if rec := asUser(requestPhoneChange, map[string]string{"new_phone_number": "+77001112367", "password": "testpass"}); rec.Code != http.StatusConflict {
+		t.Errorf("expected a number in use to be refused, got %d", rec.Code)
+	}
+	if rec := asUser(requestPhoneChange, map[string]string{"new_phone_number": "+77001112368", "password": "testpass"}); rec.Code != http.StatusOK {
+		t.Fatalf("expected phone change code to be sent, got %d: %s", rec.Code, rec.Body.String())
+	}
+	db.Model(&VerificationCode{}).Where("purpose = ?", PurposePhoneChange).Update("code_hash", hashToken("123456"))
+	if rec := asUser(confirmPhoneChange, map[string]string{"code": "123456"}); rec.Code != http.StatusOK {
+		t.Fatalf("expected phone change to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	db.First(&user, user.ID)
+	if user.PhoneNumber != "+77001112368" {
+		t.Errorf("expected the new phone number, got %s", user.PhoneNumber)
+	}
+
+	if rec := asUser(deactivateAccount, map[string]string{"password": "testpass"}); rec.Code != http.StatusOK {
+		t.Fatalf("expected deactivation to succeed, got %d", rec.Code)
+	}
+	rec := postJSON(e, login, "/login", map[string]string{"phone_number": user.PhoneNumber, "password": "testpass"})
+	if !bytes.Contains(rec.Body.Bytes(), []byte("account_deactivated")) {
+		t.Errorf("expected login to be blocked for a deactivated account, got %s", rec.Body.String())
+	}
+	db.Model(&user).Update("status", UserStatusActive)
+
+	deletionCheck = func(userID uint) (bool, string, error) { return false, "Balance must be zero", nil }
+	defer func() { deletionCheck = requestDeletionCheck }()
+	if rec := asUser(deleteAccount, map[string]string{"password": "testpass"}); rec.Code != http.StatusConflict {
+		t.Errorf("expected deletion to be refused by the check, got %d", rec.Code)
+	}
+
+	deletionCheck = func(userID uint) (bool, string, error) { return true, "", nil }
+	if rec := asUser(deleteAccount, map[string]string{"password": "wrongpass"}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected deletion with a wrong password to be refused, got %d", rec.Code)
+	}
+	if db.First(&user, user.ID); user.Status == UserStatusDeleted {
+		t.Fatalf("expected the account to survive a wrong password")
+	}
+	if rec := asUser(deleteAccount, map[string]string{"password": "testpass"}); rec.Code != http.StatusOK {
+		t.Fatalf("expected deletion to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	db.First(&user, user.ID)
+	var refreshTokens int64
+	db.Model(&RefreshToken{}).Where("user_id = ?", user.ID).Count(&refreshTokens)
+	if user.Status != UserStatusDeleted || user.PhoneNumber == "+77001112368" || user.PasswordHash != "" || refreshTokens != 0 {
+		t.Errorf("expected the account to be anonymized, got %+v with %d refresh tokens", user, refreshTokens)
+	}
+}
+
+func TestPasswordRehashAndPolicy(t *testing.T) {
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+	e := echo.New()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("Testpass1"), bcrypt.MinCost)
+	user := User{PhoneNumber: "+77001112377", PasswordHash: string(hash)}
+	db.Create(&user)
+
+	credentials := map[string]string{"phone_number": user.PhoneNumber, "password": "Testpass1"}
+	if rec := postJSON(e, login, "/login", credentials); rec.Code != http.StatusOK {
+		t.Fatalf("expected login with a bcrypt hash, got %d", rec.Code)
+	}
+	db.First(&user, user.ID)
+	if !strings.HasPrefix(user.PasswordHash, "$argon2id$v=19$m=") {
+		t.Fatalf("expected the hash to be upgraded to argon2id, got %s", user.PasswordHash)
+	}
+	if rec := postJSON(e, login, "/login", credentials); rec.Code != http.StatusOK {
+		t.Errorf("expected login with the upgraded hash, got %d", rec.Code)
+	}
+	if ok, _, _ := verifyPassword(user.PasswordHash, "testpass1"); ok {
+		t.Errorf("expected a wrong password to fail against the argon2id hash")
+	}
+
+	rec := postJSON(e, register, "/register", map[string]string{"phone_number": "+77001112378", "password": "abc"})
+	var resp map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusBadRequest || resp["code"] != "weak_password" || len(resp["violations"].([]interface{})) != 3 {
+		t.Errorf("expected every violated rule to be listed, got %d %s", rec.Code, rec.Body.String())
+	}
+	if violations := passwordPolicy.Violations("Password123"); len(violations) != 1 {
+		t.Errorf("expected a breached password to be refused, got %v", violations)
+	}
+}
+
+func TestAuthEventAuditTrail(t *testing.T) {
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+	e := echo.New()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.MinCost)
+	user := User{PhoneNumber: "+77001112388", PasswordHash: string(hash)}
+	db.Create(&user)
+
+	postJSON(e, login, "/login", map[string]string{"phone_number": "+77001112399", "password": "testpass"})
+	postJSON(e, login, "/login", map[string]string{"phone_number": user.PhoneNumber, "password": "wrongpass"})
+	rec := postJSON(e, login, "/login", map[string]string{"phone_number": user.PhoneNumber, "password": "testpass"})
+	var tokens map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &tokens)
+	postRefresh(e, tokens["refresh_token"].(string))
+	postRefresh(e, tokens["refresh_token"].(string))
+
+	activity := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/profile/activity?"+query, nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("user_id", float64(user.ID))
+		getActivity(c)
+		return rec
+	}
+
+	rec = activity("limit=3")
+	var page struct {
+		Events     []AuthEvent `json:"events"`
+		NextCursor string      `json:"next_cursor"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &page)
+	if len(page.Events) != 3 || page.NextCursor == "" {
+		t.Fatalf("expected a full first page with a cursor, got %s", rec.Body.String())
+	}
+	var kinds []string
+	for _, event := range page.Events {
+		kinds = append(kinds, event.Type+"/"+event.Outcome)
+	}
+	if strings.Join(kinds, ",") != "refresh/failure,refresh/success,login/success" {
+		t.Errorf("unexpected newest events: %v", kinds)
+	}
+
+	rec = activity("before=" + page.NextCursor)
+	page.Events, page.NextCursor = nil, ""
+	json.Unmarshal(rec.Body.Bytes(), &page)
+	if len(page.Events) != 1 || page.Events[0].Reason != "invalid_password" || page.NextCursor != "" {
+		t.Errorf("expected only the failed login on the last page, got %s", rec.Body.String())
+	}
+
+	// The unknown number is not the user's, only an admin search finds it
+	req := httptest.NewRequest(http.MethodGet, "/admin/events?phone_number=%2B77001112399", nil)
+	rec = httptest.NewRecorder()
+	getAuthEvents(e.NewContext(req, rec))
+	if !strings.Contains(rec.Body.String(), "unknown_phone") {
+		t.Errorf("expected the failed login for an unknown number, got %s", rec.Body.String())
+	}
+
+	db.Transaction(func(tx *gorm.DB) error { return anonymizeUser(tx, &user) })
+	var identifying int64
+	db.Model(&AuthEvent{}).Where("user_id = ? AND (phone_number <> '' OR ip_address <> '')", user.ID).Count(&identifying)
+	if identifying != 0 {
+		t.Errorf("expected events of a deleted user to be scrubbed, %d still identify them", identifying)
+	}
+}
+
+func TestStepUpToken(t *testing.T) {
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+	e := echo.New()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.MinCost)
+	user := User{PhoneNumber: "+77001112390", PasswordHash: string(hash)}
+	db.Create(&user)
+
+	stepUpWith := func(body map[string]string) *httptest.ResponseRecorder {
+		jsonBytes, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/step-up", bytes.NewReader(jsonBytes))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("user_id", float64(user.ID))
+		c.Set("session_id", "sid-1")
+		stepUp(c)
+		return rec
+	}
+
+	if rec := stepUpWith(map[string]string{"operation": "transfer", "method": "password", "password": "wrongpass"}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected a wrong password to be refused, got %d", rec.Code)
+	}
+	rec := stepUpWith(map[string]string{"operation": "transfer", "method": "password", "password": "testpass"})
+	var resp map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	token, _ := resp["step_up_token"].(string)
+	if rec.Code != http.StatusOK || token == "" {
+		t.Fatalf("expected a step-up token, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	server := &authServer{}
+	consume := func(token string, userID uint, operation string) *authpb.ConsumeStepUpTokenResponse {
+		resp, err := server.ConsumeStepUpToken(context.Background(), &authpb.ConsumeStepUpTokenRequest{Token: token, UserId: uint64(userID), Operation: operation, SessionId: "sid-1"})
+		if err != nil {
+			t.Fatalf("ConsumeStepUpToken failed: %v", err)
+		}
+		return resp
+	}
+	if resp := consume("", user.ID, "transfer"); resp.Valid || resp.Reason != "missing" || len(resp.Methods) != 2 {
+		t.Errorf("expected a missing token to list the step-up methods, got %+v", resp)
+	}
+	if resp := consume(token, user.ID, "withdrawal"); resp.Valid || resp.Reason != "wrong_operation" {
+		t.Errorf("expected a token for another operation to be refused, got %+v", resp)
+	}
+	otherSession, err := server.ConsumeStepUpToken(context.Background(), &authpb.ConsumeStepUpTokenRequest{Token: token, UserId: uint64(user.ID), Operation: "transfer", SessionId: "sid-2"})
+	if err != nil || otherSession.Valid || otherSession.Reason != "wrong_session" {
+		t.Errorf("expected a token from another session to be refused, got %+v %v", otherSession, err)
+	}
+	if resp := consume(token, user.ID, "transfer"); !resp.Valid {
+		t.Errorf("expected the step-up token to be accepted, got %+v", resp)
+	}
+	if resp := consume(token, user.ID, "transfer"); resp.Valid || resp.Reason != "invalid" {
+		t.Errorf("expected a step-up token to work only once, got %+v", resp)
+	}
+
+	// Users with a transaction PIN may step up with it
+	if rec := stepUpWith(map[string]string{"operation": "transfer", "method": "pin", "pin": "2580"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected the PIN method to need a PIN, got %d", rec.Code)
+	}
+	pinHash, _ := hashPassword("2580")
+	db.Model(&user).Update("pin_hash", pinHash)
+	db.First(&user, user.ID)
+	if methods := stepUpMethods(&user); len(methods) != 3 || methods[2] != StepUpMethodPIN {
+		t.Errorf("expected the PIN to be offered, got %v", methods)
+	}
+	if rec := stepUpWith(map[string]string{"operation": "transfer", "method": "pin", "pin": "0000"}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected a wrong PIN to be refused, got %d", rec.Code)
+	}
+	if rec := stepUpWith(map[string]string{"operation": "transfer", "method": "pin", "pin": "2580"}); rec.Code != http.StatusOK {
+		t.Errorf("expected a step-up token for the PIN, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Guesses sent together are counted before any is checked. Every
+	// connection to :memory: opens a new, empty database
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(1)
+	var wg sync.WaitGroup
+	codes := make(chan int, 4*StepUpMaxFailures)
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- stepUpWith(map[string]string{"operation": "transfer", "method": "password", "password": "wrongpass"}).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	checked := 0
+	for code := range codes {
+		if code == http.StatusUnauthorized {
+			checked++
+		}
+	}
+	if checked > StepUpMaxFailures {
+		t.Errorf("expected at most %d passwords to be checked, got %d", StepUpMaxFailures, checked)
+	}
+	if rec := stepUpWith(map[string]string{"operation": "transfer", "method": "password", "password": "testpass"}); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected step-up to be locked after repeated failures, got %d", rec.Code)
+	}
+}
+
+func TestTrustedDevices(t *testing.T) {
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+	e := echo.New()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.MinCost)
+	user := User{PhoneNumber: "+77001112391", PasswordHash: string(hash)}
+	db.Create(&user)
+
+	loginFrom := func(deviceID string) map[string]interface{} {
+		rec := postJSON(e, login, "/login", map[string]string{"phone_number": user.PhoneNumber, "password": "testpass", "device_id": deviceID, "device_name": deviceID})
+		var resp map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return resp
+	}
+
+	// The first device of an account is trusted without a code
+	if resp := loginFrom("laptop-0001"); resp["access_token"] == nil {
+		t.Fatalf("expected the first device to log in directly, got %v", resp)
+	}
+	if resp := loginFrom("laptop-0001"); resp["access_token"] == nil {
+		t.Fatalf("expected a trusted device to log in directly, got %v", resp)
+	}
+
+	challenge := loginFrom("phone-0002")
+	deviceToken, _ := challenge["device_token"].(string)
+	if challenge["device_verification_required"] != true || deviceToken == "" {
+		t.Fatalf("expected a new device to be challenged, got %v", challenge)
+	}
+	db.Model(&VerificationCode{}).Where("purpose = ?", PurposeNewDevice).Update("code_hash", hashToken("123456"))
+	if rec := postJSON(e, loginDevice, "/login/device", map[string]string{"device_token": deviceToken, "code": "000000"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a wrong code to be refused, got %d", rec.Code)
+	}
+	rec := postJSON(e, loginDevice, "/login/device", map[string]string{"device_token": deviceToken, "code": "123456"})
+	var tokens map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &tokens)
+	if rec.Code != http.StatusOK || tokens["access_token"] == nil {
+		t.Fatalf("expected the verified device to log in, got %d %s", rec.Code, rec.Body.String())
+	}
+	if resp := loginFrom("phone-0002"); resp["access_token"] == nil {
+		t.Errorf("expected the verified device to be trusted afterwards, got %v", resp)
+	}
+
+	asUser := func(handler echo.HandlerFunc, params ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/devices", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("user_id", float64(user.ID))
+		c.Set("session_id", tokens["session_id"])
+		if len(params) == 2 {
+			c.SetParamNames(params[0])
+			c.SetParamValues(params[1])
+		}
+		handler(c)
+		return rec
+	}
+	var devices []map[string]interface{}
+	json.Unmarshal(asUser(listDevices).Body.Bytes(), &devices)
+	if len(devices) != 2 || devices[0]["name"] != "phone-0002" || devices[0]["current"] != true {
+		t.Fatalf("unexpected device list: %v", devices)
+	}
+
+	rec = asUser(removeDevice, "id", fmt.Sprint(devices[0]["id"]))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 removing a device, got %d", rec.Code)
+	}
+	if _, _, err := validateAccessToken(tokens["access_token"].(string)); err == nil {
+		t.Errorf("expected sessions of the removed device to be revoked")
+	}
+	if resp := loginFrom("phone-0002"); resp["device_verification_required"] != true {
+		t.Errorf("expected a removed device to be challenged again, got %v", resp)
+	}
+}
+
+func uploadDocument(e *echo.Echo, userID uint, docType, contentType string, content []byte) *httptest.ResponseRecorder {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	w.WriteField("type", docType)
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", `form-data; name="file"; filename="doc"`)
+	h.Set("Content-Type", contentType)
+	part, _ := w.CreatePart(h)
+	part.Write(content)
+	w.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/kyc/documents", body)
+	req.Header.Set(echo.HeaderContentType, w.FormDataContentType())
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("user_id", float64(userID))
+	uploadKYCDocument(c)
+	return rec
+}
+
+func TestKYCTiers(t *testing.T) {
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+	documentStore = localDocumentStore{dir: t.TempDir()}
+	e := echo.New()
+
+	user := User{PhoneNumber: "+77001112392", PasswordHash: "x", Status: UserStatusActive}
+	db.Create(&user)
+	admin := User{PhoneNumber: "+77001112393", PasswordHash: "x", Status: UserStatusActive}
+	db.Create(&admin)
+
+	if rec := uploadDocument(e, user.ID, "passport", "text/html", []byte("<html>")); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415 for an HTML upload, got %d", rec.Code)
+	}
+	rec := uploadDocument(e, user.ID, "passport", "image/png", []byte("png-bytes"))
+	var doc map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &doc)
+	if rec.Code != http.StatusCreated || doc["status"] != KYCDocumentPending {
+		t.Fatalf("expected the document to be stored, got %d %s", rec.Code, rec.Body.String())
+	}
+	docID := fmt.Sprint(doc["id"])
+
+	asAdmin := func(handler echo.HandlerFunc, body interface{}, params ...string) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/admin", bytes.NewReader(payload))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set(authz.ContextUserIDKey, admin.ID)
+		c.SetParamNames(params[0])
+		c.SetParamValues(params[1])
+		handler(c)
+		return rec
+	}
+
+	rec = asAdmin(downloadKYCDocument, nil, "id", docID)
+	if rec.Code != http.StatusOK || rec.Body.String() != "png-bytes" {
+		t.Errorf("expected the reviewer to download the file, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := asAdmin(reviewKYCDocument, map[string]string{"status": "approved"}, "id", docID); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 approving a document, got %d", rec.Code)
+	}
+
+	if rec := asAdmin(setKYCTier, map[string]string{"tier": "gold"}, "id", fmt.Sprint(user.ID)); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown tier to be refused, got %d", rec.Code)
+	}
+	if rec := asAdmin(setKYCTier, map[string]string{"tier": authz.KYCTierFull}, "id", fmt.Sprint(user.ID)); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 upgrading the tier, got %d %s", rec.Code, rec.Body.String())
+	}
+	db.First(&user, user.ID)
+	tokens, _ := createTokenPair(user, sessionInfo{})
+	_, claims, err := validateAccessToken(tokens["access_token"].(string))
+	if err != nil || claims["kyc_tier"] != authz.KYCTierFull {
+		t.Errorf("expected the tier in the access token, got %v %v", claims["kyc_tier"], err)
+	}
+
+	if rec := asAdmin(setKYCTier, map[string]string{"tier": authz.KYCTierBasic}, "id", fmt.Sprint(user.ID)); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 downgrading the tier, got %d", rec.Code)
+	}
+	if _, _, err := validateAccessToken(tokens["access_token"].(string)); err == nil {
+		t.Errorf("expected a downgrade to revoke the user's sessions")
+	}
+	var changes int64
+	db.Model(&KYCTierChange{}).Where("user_id = ? AND changed_by = ?", user.ID, admin.ID).Count(&changes)
+	if changes != 2 {
+		t.Errorf("expected 2 recorded tier changes, got %d", changes)
+	}
+}
+
+func TestImpersonation(t *testing.T) {
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+	e := echo.New()
+
+	admin := User{PhoneNumber: "+77001112394", PasswordHash: "x", Status: UserStatusActive}
+	db.Create(&admin)
+	grantRole(admin.ID, authz.RoleAdmin, nil)
+	customer := User{PhoneNumber: "+77001112395", PasswordHash: "x", Status: UserStatusActive}
+	db.Create(&customer)
+	agent := User{PhoneNumber: "+77001112396", PasswordHash: "x", Status: UserStatusActive}
+	db.Create(&agent)
+	grantRole(agent.ID, authz.RoleSupport, nil)
+
+	impersonate := func(userID uint, body map[string]interface{}) (*httptest.ResponseRecorder, map[string]interface{}) {
+		payload, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/admin/users/x/impersonate", bytes.NewReader(payload))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("user_id", float64(admin.ID))
+		c.SetParamNames("id")
+		c.SetParamValues(fmt.Sprint(userID))
+		impersonateUser(c)
+		var resp map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec, resp
+	}
+	withToken := func(middleware echo.MiddlewareFunc, method, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/profile", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		middleware(getProfileProtected)(e.NewContext(req, rec))
+		return rec
+	}
+
+	if rec, _ := impersonate(customer.ID, map[string]interface{}{}); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected a reason to be required, got %d", rec.Code)
+	}
+	if rec, _ := impersonate(admin.ID, map[string]interface{}{"reason": "test"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected self-impersonation to be refused, got %d", rec.Code)
+	}
+	if rec, _ := impersonate(agent.ID, map[string]interface{}{"reason": "test"}); rec.Code != http.StatusForbidden {
+		t.Errorf("expected staff impersonation to be refused, got %d", rec.Code)
+	}
+
+	rec, resp := impersonate(customer.ID, map[string]interface{}{"reason": "Customer cannot see their history"})
+	token, _ := resp["access_token"].(string)
+	if rec.Code != http.StatusCreated || token == "" {
+		t.Fatalf("expected an impersonation token, got %d %s", rec.Code, rec.Body.String())
+	}
+	_, claims, err := validateAccessToken(token)
+	if err != nil || claimUserID(claims) != customer.ID || !claimReadOnly(claims) {
+		t.Fatalf("unexpected impersonation claims: %v %v", claims, err)
+	}
+	if actor, ok := claimActor(claims); !ok || actor != admin.ID {
+		t.Errorf("expected the act claim to name the agent, got %v", claims["act"])
+	}
+	if time.Until(claimExpiry(claims)) > impersonationTTL {
+		t.Errorf("expected the token to expire within %v", impersonationTTL)
+	}
+
+	if rec := withToken(JWTMiddleware, http.MethodGet, token); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), customer.PhoneNumber) {
+		t.Errorf("expected the agent to see the customer's profile, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := withToken(JWTMiddleware, http.MethodPost, token); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "impersonation_read_only") {
+		t.Errorf("expected a read-only token to be refused for writes, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	introspection, err := (&authServer{}).IntrospectToken(context.Background(), &authpb.IntrospectTokenRequest{Token: token})
+	if err != nil || introspection.ActorId != uint64(admin.ID) || !introspection.ReadOnly {
+		t.Errorf("expected introspection to report the agent, got %v %v", introspection, err)
+	}
+
+	var requests []ImpersonationRequest
+	db.Where("session_id = ?", claims["sid"]).Order("id").Find(&requests)
+	if len(requests) != 2 || requests[0].Method != http.MethodGet || requests[1].Status != http.StatusForbidden {
+		t.Errorf("expected both requests in the audit trail, got %+v", requests)
+	}
+
+	// Even a writable token cannot manage the customer's account
+	_, resp = impersonate(customer.ID, map[string]interface{}{"reason": "test", "read_only": false})
+	writable, _ := resp["access_token"].(string)
+	if rec := withToken(SessionMiddleware, http.MethodPost, writable); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "impersonation_forbidden") {
+		t.Errorf("expected account management to be refused, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	var impersonation Impersonation
+	db.Where("session_id = ?", claims["sid"]).First(&impersonation)
+	req := httptest.NewRequest(http.MethodDelete, "/", nil)
+	rec = httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(fmt.Sprint(impersonation.ID))
+	if endImpersonation(c); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 ending the impersonation, got %d", rec.Code)
+	}
+	if _, _, err := validateAccessToken(token); err == nil {
+		t.Errorf("expected the impersonation token to be revoked")
+	}
+}
+
+func TestTransactionPIN(t *testing.T) {
+	setupTestDB()
+	mr := setupTestRedis(t)
+	defer mr.Close()
+	e := echo.New()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.MinCost)
+	user := User{PhoneNumber: "+77001112397", PasswordHash: string(hash), Status: UserStatusActive}
+	db.Create(&user)
+
+	setPINWith := func(body map[string]interface{}) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPut, "/pin", bytes.NewReader(payload))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("user_id", float64(user.ID))
+		setPIN(c)
+		return rec
+	}
+	server := &authServer{}
+	verify := func(pin string) *authpb.VerifyTransactionPINResponse {
+		resp, err := server.VerifyTransactionPIN(context.Background(), &authpb.VerifyTransactionPINRequest{UserId: uint64(user.ID), Pin: pin})
+		if err != nil {
+			t.Fatalf("VerifyTransactionPIN failed: %v", err)
+		}
+		return resp
+	}
+
+	if resp := verify(""); resp.Required {
+		t.Errorf("expected no PIN to be required before one is set, got %+v", resp)
+	}
+	if rec := setPINWith(map[string]interface{}{"password": "wrongpass", "pin": "2580"}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected the password to be required, got %d", rec.Code)
+	}
+	for _, pin := range []string{"123", "1234567", "12a4", "1111", "4321"} {
+		if rec := setPINWith(map[string]interface{}{"password": "testpass", "pin": pin}); rec.Code != http.StatusBadRequest {
+			t.Errorf("expected PIN %q to be refused, got %d", pin, rec.Code)
+		}
+	}
+	if rec := setPINWith(map[string]interface{}{"password": "testpass", "pin": "2580"}); rec.Code != http.StatusOK {
+		t.Fatalf("expected the PIN to be set, got %d %s", rec.Code, rec.Body.String())
+	}
+	db.First(&user, user.ID)
+	if user.PINHash == "" || user.PINHash == "2580" || !user.PINRequired {
+		t.Errorf("expected a hashed PIN required for transfers, got %+v", user)
+	}
+
+	if resp := verify(""); !resp.Required || resp.Valid || resp.Reason != "missing" {
+		t.Errorf("expected a missing PIN to be refused, got %+v", resp)
+	}
+	if resp := verify("2580"); !resp.Valid {
+		t.Errorf("expected the PIN to be accepted, got %+v", resp)
+	}
+	if resp := verify("0000"); resp.Valid || resp.Reason != "invalid" || resp.AttemptsLeft != int32(PINMaxFailures-1) {
+		t.Errorf("expected a wrong PIN to be refused with attempts left, got %+v", resp)
+	}
+	for i := int64(1); i < PINMaxFailures; i++ {
+		verify("0000")
+	}
+	if resp := verify("2580"); resp.Valid || resp.Reason != "locked" || resp.RetryAfter <= 0 {
+		t.Errorf("expected the PIN to be locked after repeated failures, got %+v", resp)
+	}
+
+	// Setting a new PIN with the password lifts the lock
+	if rec := setPINWith(map[string]interface{}{"password": "testpass", "pin": "9713", "required_for_transfers": false}); rec.Code != http.StatusOK {
+		t.Fatalf("expected the PIN to be replaced, got %d", rec.Code)
+	}
+	if resp := verify(""); resp.Required {
+		t.Errorf("expected no PIN to be required after opting out, got %+v", resp)
+	}
+	db.First(&user, user.ID)
+	if err := verifyPIN(&user, "9713"); err != nil {
+		t.Errorf("expected the new PIN to verify after the lock was lifted, got %v", err)
+	}
+
+	// Guesses sent together are counted before any is compared
+	var wg sync.WaitGroup
+	results := make(chan error, 4*PINMaxFailures)
+	for i := 0; i < cap(results); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- verifyPIN(&user, "0000")
+		}()
+	}
+	wg.Wait()
+	close(results)
+	// The last attempt allowed locks the PIN instead of reporting it wrong
+	var wrong int64
+	for err := range results {
+		if err == errPINInvalid {
+			wrong++
+		}
+	}
+	if wrong != PINMaxFailures-1 {
+		t.Errorf("expected %d wrong PINs before the lock, got %d", PINMaxFailures-1, wrong)
+	}
+	if err := verifyPIN(&user, "9713"); err == nil {
+		t.Error("expected the PIN to be locked after parallel guesses")
+	}
+}
+
+func TestGRPCRequiresServiceToken(t *testing.T) {
+	setupTestDB()
+	user := User{PhoneNumber: "+77001113344", PasswordHash: "x", Status: UserStatusActive}
+	db.Create(&user)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := newGRPCServer("internal-token")
+	go server.Serve(lis)
+	defer server.Stop()
+
+	call := func(options ...grpc.DialOption) error {
+		conn, err := grpc.Dial(lis.Addr().String(), append(options, grpc.WithInsecure())...)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		_, err = authpb.NewAuthServiceClient(conn).GetUser(context.Background(), &authpb.GetUserRequest{UserId: uint64(user.ID)})
+		return err
+	}
+
+	if err := call(); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected a call without a token to be refused, got %v", err)
+	}
+	if err := call(grpc.WithPerRPCCredentials(authz.ServiceToken("wrong"))); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected a wrong token to be refused, got %v", err)
+	}
+	if err := call(grpc.WithPerRPCCredentials(authz.ServiceToken("internal-token"))); err != nil {
+		t.Errorf("expected the service token to be accepted, got %v", err)
+	}
+}
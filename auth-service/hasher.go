@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher creates and checks one kind of password hash. New hashes
+// always come from the configured hasher; the others only verify hashes that
+// were stored before it changed.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(hash, password string) (bool, error)
+	// Recognizes reports whether hash was produced by this kind of hasher.
+	Recognizes(hash string) bool
+	// Outdated reports whether a recognized hash uses weaker parameters than
+	// the hasher is configured with.
+	Outdated(hash string) bool
+}
+
+var errUnknownHashFormat = errors.New("unknown password hash format")
+
+var (
+	passwordHasher  = newPasswordHasher(getEnv("PASSWORD_HASHER", "argon2id"))
+	passwordHashers = []PasswordHasher{
+		newArgon2idHasher(),
+		bcryptHasher{cost: bcrypt.DefaultCost},
+	}
+)
+
+func newPasswordHasher(name string) PasswordHasher {
+	switch name {
+	case "argon2id":
+		return newArgon2idHasher()
+	case "bcrypt":
+		return bcryptHasher{cost: bcrypt.DefaultCost}
+	default:
+		log.Fatalf("Unsupported PASSWORD_HASHER %q", name)
+		return nil
+	}
+}
+
+func hashPassword(password string) (string, error) {
+	return passwordHasher.Hash(password)
+}
+
+// verifyPassword checks password against hash, which may come from any known
+// hasher. needsRehash is set when the hash should be replaced with one from
+// the configured hasher.
+func verifyPassword(hash, password string) (ok, needsRehash bool, err error) {
+	for _, hasher := range passwordHashers {
+		if !hasher.Recognizes(hash) {
+			continue
+		}
+		ok, err = hasher.Verify(hash, password)
+		if err != nil || !ok {
+			return false, false, err
+		}
+		needsRehash = !passwordHasher.Recognizes(hash) || passwordHasher.Outdated(hash)
+		return true, needsRehash, nil
+	}
+	return false, false, errUnknownHashFormat
+}
+
+// checkPassword verifies the password of user and upgrades an outdated hash
+// while the plain password is at hand.
+func checkPassword(user *User, password string) bool {
+	ok, needsRehash, err := verifyPassword(user.PasswordHash, password)
+	if err != nil && !errors.Is(err, errUnknownHashFormat) {
+		log.Printf("Failed to verify password of user %d: %v", user.ID, err)
+	}
+	if !ok {
+		return false
+	}
+	if needsRehash {
+		rehashPassword(user, password)
+	}
+	return true
+}
+
+func rehashPassword(user *User, password string) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Printf("Failed to rehash password of user %d: %v", user.ID, err)
+		return
+	}
+	// Only replace the hash that was verified, not one set concurrently
+	result := db.Model(&User{}).
+		Where("id = ? AND password_hash = ?", user.ID, user.PasswordHash).
+		Update("password_hash", hash)
+	if result.Error != nil {
+		log.Printf("Failed to store rehashed password of user %d: %v", user.ID, result.Error)
+		return
+	}
+	user.PasswordHash = hash
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (h bcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (h bcryptHasher) Verify(hash, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h bcryptHasher) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (h bcryptHasher) Outdated(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < h.cost
+}
+
+// argon2idHasher produces PHC strings:
+// $argon2id$v=19$m=<KiB>,t=<iterations>,p=<parallelism>$<salt>$<hash>
+type argon2idHasher struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	saltLength  int
+	keyLength   uint32
+}
+
+func newArgon2idHasher() argon2idHasher {
+	return argon2idHasher{
+		memory:      uint32(getEnvInt("ARGON2_MEMORY_KB", 64*1024)),
+		iterations:  uint32(getEnvInt("ARGON2_ITERATIONS", 3)),
+		parallelism: uint8(getEnvInt("ARGON2_PARALLELISM", 2)),
+		saltLength:  16,
+		keyLength:   32,
+	}
+}
+
+func (h argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.iterations, h.memory, h.parallelism, h.keyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.memory, h.iterations, h.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+type argon2idParams struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func parseArgon2idHash(hash string) (*argon2idParams, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, errUnknownHashFormat
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+
+	var p argon2idParams
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism); err != nil {
+		return nil, fmt.Errorf("invalid argon2 parameters: %w", err)
+	}
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, fmt.Errorf("invalid argon2 hash: %w", err)
+	}
+	return &p, nil
+}
+
+func (h argon2idHasher) Verify(hash, password string) (bool, error) {
+	p, err := parseArgon2idHash(hash)
+	if err != nil {
+		return false, err
+	}
+	key := argon2.IDKey([]byte(password), p.salt, p.iterations, p.memory, p.parallelism, uint32(len(p.key)))
+	return subtle.ConstantTimeCompare(key, p.key) == 1, nil
+}
+
+func (h argon2idHasher) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+func (h argon2idHasher) Outdated(hash string) bool {
+	p, err := parseArgon2idHash(hash)
+	return err != nil || p.memory < h.memory || p.iterations < h.iterations || p.parallelism < h.parallelism
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/elkin/system-design-final/shared/authz"
+	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
+	"gorm.io/gorm"
+)
+
+// Support agents see an account exactly as its owner does through an
+// impersonation token: an access token for the customer with an act claim
+// naming the agent. It cannot be refreshed, is read-only unless asked
+// otherwise, and every request made with it is logged, including those to
+// other services, which report them on auth.impersonation.requests.
+
+const subjectImpersonationRequests = "auth.impersonation.requests"
+
+const maxImpersonationReasonLength = 500
+
+var impersonationTTL = getEnvDuration("IMPERSONATION_TTL", 15*time.Minute)
+
+type Impersonation struct {
+	ID        uint      `gorm:"primaryKey"`
+	SessionID string    `gorm:"not null;uniqueIndex"`
+	AgentID   uint      `gorm:"not null;index"`
+	UserID    uint      `gorm:"not null;index"`
+	Reason    string    `gorm:"not null"`
+	ReadOnly  bool      `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	EndedAt   *time.Time
+	CreatedAt time.Time
+}
+
+// ImpersonationRequest is one request made with an impersonation token.
+type ImpersonationRequest struct {
+	ID        uint   `gorm:"primaryKey"`
+	SessionID string `gorm:"not null;index"`
+	Service   string `gorm:"not null"`
+	Method    string `gorm:"not null"`
+	Path      string `gorm:"not null"`
+	Status    int
+	IPAddress string
+	CreatedAt time.Time
+}
+
+func (i Impersonation) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"id":         i.ID,
+		"session_id": i.SessionID,
+		"agent_id":   i.AgentID,
+		"user_id":    i.UserID,
+		"reason":     i.Reason,
+		"read_only":  i.ReadOnly,
+		"expires_at": i.ExpiresAt,
+		"ended_at":   i.EndedAt,
+		"created_at": i.CreatedAt,
+	}
+}
+
+// claimActor returns the agent named by the act claim of an impersonation token.
+func claimActor(claims jwt.MapClaims) (uint, bool) {
+	act, ok := claims["act"].(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	id, _ := act["user_id"].(float64)
+	return uint(id), id > 0
+}
+
+func claimReadOnly(claims jwt.MapClaims) bool {
+	readOnly, _ := claims["read_only"].(bool)
+	return readOnly
+}
+
+func storeImpersonationRequest(request ImpersonationRequest) {
+	request.CreatedAt = time.Now()
+	if err := db.Create(&request).Error; err != nil {
+		log.Printf("Failed to log impersonated request in session %s: %v", request.SessionID, err)
+	}
+}
+
+// impersonationGuard enforces the limits of an impersonation token and logs
+// the request once it has been handled. Account management is never open to
+// an agent, whatever the token allows elsewhere.
+func impersonationGuard(c echo.Context, claims jwt.MapClaims, accept int, next echo.HandlerFunc) error {
+	actorID, _ := claimActor(claims)
+	c.Set(authz.ContextActorIDKey, actorID)
+	c.Set(authz.ContextReadOnlyKey, claimReadOnly(claims))
+
+	var err error
+	switch {
+	case authz.ReadOnlyViolation(c):
+		err = authz.ReadOnlyResponse(c)
+	case accept&acceptImpersonatedWrites == 0 && !authz.SafeMethod(c.Request().Method):
+		err = c.JSON(http.StatusForbidden, map[string]string{"error": "Account management is not available while impersonating", "code": "impersonation_forbidden"})
+	default:
+		err = next(c)
+	}
+
+	sid, _ := claims["sid"].(string)
+	storeImpersonationRequest(ImpersonationRequest{
+		SessionID: sid,
+		Service:   "auth-service",
+		Method:    c.Request().Method,
+		Path:      truncate(c.Request().URL.RequestURI(), 255),
+		Status:    c.Response().Status,
+		IPAddress: c.RealIP(),
+	})
+	return err
+}
+
+// handleImpersonatedRequest stores the requests other services report.
+func handleImpersonatedRequest(msg *nats.Msg) {
+	var event struct {
+		SessionID string `json:"session_id"`
+		Service   string `json:"service"`
+		Method    string `json:"method"`
+		Path      string `json:"path"`
+		Status    int    `json:"status"`
+		IPAddress string `json:"ip_address"`
+	}
+	if err := json.Unmarshal(msg.Data, &event); err != nil || event.SessionID == "" {
+		log.Printf("Invalid impersonated request event: %s", msg.Data)
+		return
+	}
+	storeImpersonationRequest(ImpersonationRequest{
+		SessionID: event.SessionID,
+		Service:   event.Service,
+		Method:    event.Method,
+		Path:      truncate(event.Path, 255),
+		Status:    event.Status,
+		IPAddress: event.IPAddress,
+	})
+}
+
+func impersonateUser(c echo.Context) error {
+	type ImpersonateRequest struct {
+		Reason   string `json:"reason"`
+		ReadOnly *bool  `json:"read_only"`
+	}
+	var req ImpersonateRequest
+	if err := c.Bind(&req); err != nil || req.Reason == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "A reason is required"})
+	}
+	readOnly := req.ReadOnly == nil || *req.ReadOnly
+
+	// Only an agent who logged in may impersonate, and never through another
+	// impersonation token
+	agentID, ok := authz.UserID(c)
+	if !ok || c.Get("api_key_id") != nil || authz.Impersonated(c) {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Impersonation requires a login session"})
+	}
+	var agent User
+	if err := db.First(&agent, agentID).Error; err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	user, err := findUserParam(c)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+	if user.ID == agent.ID {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "You cannot impersonate yourself"})
+	}
+	if user.Status != UserStatusActive {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "User is not active"})
+	}
+	roles, err := userRoles(user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	for _, role := range roles {
+		if role != authz.RoleUser {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Staff accounts cannot be impersonated"})
+		}
+	}
+
+	jti, err := newTokenID()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to start impersonation"})
+	}
+	sessionID, err := newTokenID()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to start impersonation"})
+	}
+	ttl := impersonationTTL
+	if ttl <= 0 || ttl > AccessTokenExpiry {
+		ttl = AccessTokenExpiry
+	}
+	expiresAt := time.Now().Add(ttl)
+
+	token, err := signClaims(jwt.MapClaims{
+		"jti":          jti,
+		"typ":          TokenTypeAccess,
+		"phone_number": user.PhoneNumber,
+		"user_id":      user.ID,
+		"sid":          sessionID,
+		"roles":        roles,
+		"kyc_tier":     user.kycTier(),
+		"act": map[string]interface{}{
+			"user_id":      agent.ID,
+			"phone_number": agent.PhoneNumber,
+		},
+		"read_only": readOnly,
+		"exp":       expiresAt.Unix(),
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to start impersonation"})
+	}
+
+	impersonation := Impersonation{
+		SessionID: sessionID,
+		AgentID:   agent.ID,
+		UserID:    user.ID,
+		Reason:    truncate(req.Reason, maxImpersonationReasonLength),
+		ReadOnly:  readOnly,
+		ExpiresAt: expiresAt,
+	}
+	if err := db.Create(&impersonation).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to start impersonation"})
+	}
+
+	recordAuthEvent(c, AuthEvent{
+		UserID:      &user.ID,
+		PhoneNumber: user.PhoneNumber,
+		Type:        AuthEventImpersonation,
+		Outcome:     AuthOutcomeSuccess,
+		Reason:      "agent " + strconv.FormatUint(uint64(agent.ID), 10),
+		SessionID:   sessionID,
+	})
+	publishSecurityEvent("impersonation_started", user.ID, map[string]interface{}{
+		"phone_number": user.PhoneNumber,
+		"agent_id":     agent.ID,
+		"read_only":    readOnly,
+		"expires_at":   expiresAt,
+	})
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"access_token":  token,
+		"token_type":    "Bearer",
+		"expires_in":    ttl.Seconds(),
+		"impersonation": impersonation.toMap(),
+	})
+}
+
+func findImpersonationParam(c echo.Context) (*Impersonation, error) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	var impersonation Impersonation
+	if err := db.First(&impersonation, uint(id)).Error; err != nil {
+		return nil, err
+	}
+	return &impersonation, nil
+}
+
+func listImpersonations(c echo.Context) error {
+	query := db.Model(&Impersonation{})
+	for _, param := range []string{"user_id", "agent_id"} {
+		if v := c.QueryParam(param); v != "" {
+			id, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid " + param})
+			}
+			query = query.Where(param+" = ?", id)
+		}
+	}
+
+	var impersonations []Impersonation
+	if err := query.Order("id desc").Limit(100).Find(&impersonations).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	result := make([]map[string]interface{}, 0, len(impersonations))
+	for _, i := range impersonations {
+		result = append(result, i.toMap())
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+func getImpersonationRequests(c echo.Context) error {
+	impersonation, err := findImpersonationParam(c)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Impersonation not found"})
+	}
+
+	var requests []ImpersonationRequest
+	if err := db.Where("session_id = ?", impersonation.SessionID).Order("id").Find(&requests).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	result := make([]map[string]interface{}, 0, len(requests))
+	for _, r := range requests {
+		result = append(result, map[string]interface{}{
+			"service":    r.Service,
+			"method":     r.Method,
+			"path":       r.Path,
+			"status":     r.Status,
+			"ip_address": r.IPAddress,
+			"created_at": r.CreatedAt,
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"impersonation": impersonation.toMap(),
+		"requests":      result,
+	})
+}
+
+// endImpersonation revokes the token before it expires.
+func endImpersonation(c echo.Context) error {
+	impersonation, err := findImpersonationParam(c)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Impersonation not found"})
+	}
+	if impersonation.EndedAt != nil || time.Now().After(impersonation.ExpiresAt) {
+		return c.JSON(http.StatusOK, impersonation.toMap())
+	}
+
+	if err := revokeSession(impersonation.UserID, impersonation.SessionID); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to end impersonation"})
+	}
+	now := time.Now()
+	if err := db.Model(impersonation).Update("ended_at", now).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to end impersonation"})
+	}
+	impersonation.EndedAt = &now
+
+	return c.JSON(http.StatusOK, impersonation.toMap())
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+type SigningKey struct {
+	ID         string `gorm:"primaryKey"`
+	Algorithm  string `gorm:"not null"`
+	PrivateKey string `gorm:"type:text;not null"`
+	// A key is published in JWKS as soon as it is created but only signs
+	// tokens from ActivatesAt on.
+	ActivatesAt time.Time
+	RetiredAt   *time.Time
+	CreatedAt   time.Time
+}
+
+type loadedKey struct {
+	id          string
+	method      jwt.SigningMethod
+	private     crypto.Signer
+	activatesAt time.Time
+	createdAt   time.Time
+}
+
+type signingKeyring struct {
+	mu      sync.RWMutex
+	keys    map[string]*loadedKey
+	current *loadedKey
+}
+
+var keyring = &signingKeyring{keys: make(map[string]*loadedKey)}
+
+var (
+	signingAlgorithm    = getEnv("JWT_SIGNING_ALG", "RS256")
+	keyRotationInterval = getEnvDuration("JWT_KEY_ROTATION_INTERVAL", 24*time.Hour)
+)
+
+const (
+	// Retired keys stay published until every token they signed has expired.
+	retiredKeyGracePeriod = AccessTokenExpiry
+	// How long verifiers may cache the JWKS response.
+	jwksMaxAge = 5 * time.Minute
+	// A new key is published this long before it signs anything, so every
+	// verifier has refetched the JWKS by the time tokens with its kid arrive.
+	keyPublishLead = 2 * jwksMaxAge
+	// Replicas rotate keys under this Postgres advisory lock.
+	signingKeyLockID = 0x6a776b73
+)
+
+func initSigningKeys() {
+	if err := loadSigningKeys(); err != nil {
+		log.Fatal("Failed to load signing keys: ", err)
+	}
+	if keyring.signingKey() == nil {
+		// Nothing can be signed yet, so there is no one to wait for
+		if err := rotateSigningKey(time.Now()); err != nil {
+			log.Fatal("Failed to create signing key: ", err)
+		}
+		if err := retireReplacedKeys(); err != nil {
+			log.Fatal("Failed to retire replaced signing keys: ", err)
+		}
+	}
+	fmt.Println("Signing keys loaded")
+}
+
+func generateSigningKey(algorithm string) (*SigningKey, error) {
+	var private crypto.Signer
+	var err error
+	switch algorithm {
+	case "RS256":
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	kid := make([]byte, 8)
+	if _, err := rand.Read(kid); err != nil {
+		return nil, err
+	}
+
+	return &SigningKey{
+		ID:         hex.EncodeToString(kid),
+		Algorithm:  algorithm,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	}, nil
+}
+
+func parseSigningKey(key SigningKey) (*loadedKey, error) {
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, errors.New("invalid PEM data")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	var method jwt.SigningMethod
+	switch key.Algorithm {
+	case "RS256":
+		if _, ok := parsed.(*rsa.PrivateKey); !ok {
+			return nil, errors.New("RS256 key is not an RSA key")
+		}
+		method = jwt.SigningMethodRS256
+	case "ES256":
+		if _, ok := parsed.(*ecdsa.PrivateKey); !ok {
+			return nil, errors.New("ES256 key is not an ECDSA key")
+		}
+		method = jwt.SigningMethodES256
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", key.Algorithm)
+	}
+
+	return &loadedKey{
+		id:          key.ID,
+		method:      method,
+		private:     parsed.(crypto.Signer),
+		activatesAt: key.ActivatesAt,
+		createdAt:   key.CreatedAt,
+	}, nil
+}
+
+func loadSigningKeys() error {
+	var rows []SigningKey
+	cutoff := time.Now().Add(-retiredKeyGracePeriod)
+	if err := db.Where("retired_at IS NULL OR retired_at > ?", cutoff).Order("created_at").Find(&rows).Error; err != nil {
+		return err
+	}
+
+	now := time.Now()
+	keys := make(map[string]*loadedKey, len(rows))
+	var current *loadedKey
+	for _, row := range rows {
+		key, err := parseSigningKey(row)
+		if err != nil {
+			log.Printf("Skipping signing key %s: %v", row.ID, err)
+			continue
+		}
+		keys[key.id] = key
+		if row.RetiredAt == nil && row.Algorithm == signingAlgorithm && !row.ActivatesAt.After(now) {
+			current = key
+		}
+	}
+
+	keyring.mu.Lock()
+	keyring.keys = keys
+	keyring.current = current
+	keyring.mu.Unlock()
+	return nil
+}
+
+// rotateSigningKey adds a key that starts signing at activatesAt. Replicas
+// rotate under a lock, and one that finds a key another replica has already
+// added for the same purpose leaves it at that.
+func rotateSigningKey(activatesAt time.Time) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := lockSigningKeys(tx); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		query := tx.Model(&SigningKey{}).Where("retired_at IS NULL AND algorithm = ?", signingAlgorithm)
+		if activatesAt.After(now) {
+			query = query.Where("activates_at > ?", now)
+		} else {
+			query = query.Where("activates_at <= ?", now)
+		}
+		var existing int64
+		if err := query.Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			return nil
+		}
+
+		key, err := generateSigningKey(signingAlgorithm)
+		if err != nil {
+			return err
+		}
+		key.ActivatesAt = activatesAt
+		if err := tx.Create(key).Error; err != nil {
+			return err
+		}
+		log.Printf("Rotated signing key, new kid=%s alg=%s activates at %s", key.ID, key.Algorithm, activatesAt.Format(time.RFC3339))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return loadSigningKeys()
+}
+
+// retireReplacedKeys retires the keys that signed before the current one.
+func retireReplacedKeys() error {
+	current := keyring.signingKey()
+	if current == nil {
+		return nil
+	}
+	return db.Model(&SigningKey{}).
+		Where("id <> ? AND retired_at IS NULL AND created_at < ?", current.id, current.createdAt).
+		Update("retired_at", time.Now()).Error
+}
+
+func lockSigningKeys(tx *gorm.DB) error {
+	if tx.Dialector.Name() != "postgres" {
+		return nil
+	}
+	return tx.Exec("SELECT pg_advisory_xact_lock(?)", signingKeyLockID).Error
+}
+
+func manageSigningKeys() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := loadSigningKeys(); err != nil {
+			log.Printf("Failed to reload signing keys: %v", err)
+			continue
+		}
+
+		current := keyring.signingKey()
+		if current == nil {
+			if err := rotateSigningKey(time.Now()); err != nil {
+				log.Printf("Failed to create signing key: %v", err)
+			}
+		} else if time.Since(current.activatesAt) >= keyRotationInterval-keyPublishLead {
+			// The next key is published now and takes over once the old
+			// one has been in use for keyRotationInterval
+			if err := rotateSigningKey(time.Now().Add(keyPublishLead)); err != nil {
+				log.Printf("Failed to rotate signing key: %v", err)
+			}
+		}
+		if err := retireReplacedKeys(); err != nil {
+			log.Printf("Failed to retire replaced signing keys: %v", err)
+		}
+
+		cutoff := time.Now().Add(-retiredKeyGracePeriod)
+		if err := db.Where("retired_at IS NOT NULL AND retired_at <= ?", cutoff).Delete(&SigningKey{}).Error; err != nil {
+			log.Printf("Failed to prune retired signing keys: %v", err)
+		}
+	}
+}
+
+func (k *signingKeyring) signingKey() *loadedKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+func (k *signingKeyring) verificationKey(kid string) (*loadedKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+func (k *signingKeyring) publicKeys() []*loadedKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := make([]*loadedKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func signClaims(claims jwt.MapClaims) (string, error) {
+	key := keyring.signingKey()
+	if key == nil {
+		return "", errors.New("no active signing key")
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+	return token.SignedString(key.private)
+}
+
+func parseSignedToken(tokenString string) (*jwt.Token, jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := keyring.verificationKey(kid)
+		if !ok {
+			return nil, errors.New("unknown signing key")
+		}
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, errors.New("unexpected signing method")
+		}
+		return key.private.Public(), nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if !token.Valid {
+		return nil, nil, errors.New("invalid token")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, nil, errors.New("invalid claims")
+	}
+	return token, claims, nil
+}
+
+func encodeJWK(key *loadedKey) map[string]string {
+	jwk := map[string]string{
+		"kid": key.id,
+		"alg": key.method.Alg(),
+		"use": "sig",
+	}
+	switch public := key.private.Public().(type) {
+	case *rsa.PublicKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		jwk["kty"] = "EC"
+		jwk["crv"] = public.Curve.Params().Name
+		jwk["x"] = base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, size)))
+		jwk["y"] = base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, size)))
+	}
+	return jwk
+}
+
+func getJWKS(c echo.Context) error {
+	keys := keyring.publicKeys()
+	jwks := make([]map[string]string, 0, len(keys))
+	for _, key := range keys {
+		jwks = append(jwks, encodeJWK(key))
+	}
+
+	c.Response().Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(jwksMaxAge.Seconds())))
+	return c.JSON(http.StatusOK, map[string]interface{}{"keys": jwks})
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/elkin/system-design-final/shared/authz"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	KYCDocumentPending  = "pending"
+	KYCDocumentApproved = "approved"
+	KYCDocumentRejected = "rejected"
+)
+
+const maxKYCDocumentSize = 10 << 20
+
+var kycDocumentTypes = map[string]bool{
+	"passport":         true,
+	"id_card":          true,
+	"driver_license":   true,
+	"proof_of_address": true,
+	"selfie":           true,
+}
+
+var kycContentTypes = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"application/pdf": ".pdf",
+}
+
+// KYCDocument is an identity document uploaded by a user for review. The
+// file itself lives in the document store under StoragePath.
+type KYCDocument struct {
+	ID          uint   `gorm:"primaryKey"`
+	UserID      uint   `gorm:"not null;index"`
+	Type        string `gorm:"not null"`
+	FileName    string
+	ContentType string `gorm:"not null"`
+	Size        int64  `gorm:"not null"`
+	SHA256      string `gorm:"not null"`
+	StoragePath string `gorm:"not null"`
+	Status      string `gorm:"not null;default:pending;index"`
+	ReviewedBy  *uint
+	ReviewNote  string
+	ReviewedAt  *time.Time
+	CreatedAt   time.Time
+}
+
+// KYCTierChange records who moved a user between tiers and why.
+type KYCTierChange struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"not null;index"`
+	FromTier  string `gorm:"not null"`
+	ToTier    string `gorm:"not null"`
+	ChangedBy *uint
+	Note      string
+	CreatedAt time.Time
+}
+
+// DocumentStore keeps the files of KYC documents. Development uses the local
+// filesystem; a deployment can plug in object storage.
+type DocumentStore interface {
+	Save(name string, r io.Reader) error
+	Open(name string) (io.ReadCloser, error)
+	Delete(name string) error
+}
+
+var documentStore = newDocumentStore(getEnv("KYC_STORAGE", "local"))
+
+func newDocumentStore(kind string) DocumentStore {
+	switch kind {
+	case "local":
+		return localDocumentStore{dir: getEnv("KYC_STORAGE_DIR", "data/kyc")}
+	default:
+		log.Fatalf("Unsupported KYC_STORAGE %q", kind)
+		return nil
+	}
+}
+
+type localDocumentStore struct {
+	dir string
+}
+
+func (s localDocumentStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+func (s localDocumentStore) Save(name string, r io.Reader) error {
+	path := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+func (s localDocumentStore) Open(name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+func (s localDocumentStore) Delete(name string) error {
+	err := os.Remove(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func kycDocumentResponse(doc KYCDocument) map[string]interface{} {
+	return map[string]interface{}{
+		"id":           doc.ID,
+		"user_id":      doc.UserID,
+		"type":         doc.Type,
+		"file_name":    doc.FileName,
+		"content_type": doc.ContentType,
+		"size":         doc.Size,
+		"status":       doc.Status,
+		"review_note":  doc.ReviewNote,
+		"reviewed_at":  doc.ReviewedAt,
+		"created_at":   doc.CreatedAt,
+	}
+}
+
+func uploadKYCDocument(c echo.Context) error {
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	docType := c.FormValue("type")
+	if !kycDocumentTypes[docType] {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unknown document type"})
+	}
+	file, err := c.FormFile("file")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Missing file"})
+	}
+	if file.Size > maxKYCDocumentSize {
+		return c.JSON(http.StatusRequestEntityTooLarge, map[string]string{"error": "File is larger than 10 MB"})
+	}
+	contentType := file.Header.Get("Content-Type")
+	ext, ok := kycContentTypes[contentType]
+	if !ok {
+		return c.JSON(http.StatusUnsupportedMediaType, map[string]string{"error": "Only JPEG, PNG and PDF files are accepted"})
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Failed to read file"})
+	}
+	defer src.Close()
+
+	id, err := newTokenID()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store document"})
+	}
+	// The stored name never contains anything the client chose
+	storagePath := fmt.Sprintf("%d/%s%s", user.ID, id, ext)
+	hash := sha256.New()
+	if err := documentStore.Save(storagePath, io.TeeReader(io.LimitReader(src, maxKYCDocumentSize), hash)); err != nil {
+		log.Printf("Failed to store KYC document for user %d: %v", user.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to store document"})
+	}
+
+	doc := KYCDocument{
+		UserID:      user.ID,
+		Type:        docType,
+		FileName:    truncate(filepath.Base(file.Filename), 255),
+		ContentType: contentType,
+		Size:        file.Size,
+		SHA256:      hex.EncodeToString(hash.Sum(nil)),
+		StoragePath: storagePath,
+		Status:      KYCDocumentPending,
+	}
+	if err := db.Create(&doc).Error; err != nil {
+		documentStore.Delete(storagePath)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save document"})
+	}
+
+	return c.JSON(http.StatusCreated, kycDocumentResponse(doc))
+}
+
+func getKYCStatus(c echo.Context) error {
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	return kycStatusResponse(c, user)
+}
+
+func kycStatusResponse(c echo.Context, user *User) error {
+	var docs []KYCDocument
+	if err := db.Where("user_id = ?", user.ID).Order("created_at desc").Find(&docs).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	documents := make([]map[string]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		documents = append(documents, kycDocumentResponse(doc))
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"user_id":   user.ID,
+		"kyc_tier":  user.kycTier(),
+		"documents": documents,
+	})
+}
+
+func getUserKYC(c echo.Context) error {
+	user, err := findUserParam(c)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+	return kycStatusResponse(c, user)
+}
+
+func listKYCDocuments(c echo.Context) error {
+	status := c.QueryParam("status")
+	if status == "" {
+		status = KYCDocumentPending
+	}
+	var docs []KYCDocument
+	if err := db.Where("status = ?", status).Order("created_at").Limit(100).Find(&docs).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	result := make([]map[string]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		result = append(result, kycDocumentResponse(doc))
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+func findKYCDocumentParam(c echo.Context) (*KYCDocument, error) {
+	docID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	var doc KYCDocument
+	if err := db.First(&doc, uint(docID)).Error; err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+func downloadKYCDocument(c echo.Context) error {
+	doc, err := findKYCDocumentParam(c)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Document not found"})
+	}
+	f, err := documentStore.Open(doc.StoragePath)
+	if err != nil {
+		log.Printf("Failed to open KYC document %d: %v", doc.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to read document"})
+	}
+	defer f.Close()
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+	c.Response().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", doc.FileName))
+	return c.Stream(http.StatusOK, doc.ContentType, f)
+}
+
+func reviewKYCDocument(c echo.Context) error {
+	type ReviewRequest struct {
+		Status string `json:"status"`
+		Note   string `json:"note"`
+	}
+	var req ReviewRequest
+	if err := c.Bind(&req); err != nil || (req.Status != KYCDocumentApproved && req.Status != KYCDocumentRejected) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Status must be approved or rejected"})
+	}
+
+	doc, err := findKYCDocumentParam(c)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Document not found"})
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{"status": req.Status, "review_note": req.Note, "reviewed_at": now}
+	if reviewerID, ok := authz.UserID(c); ok {
+		updates["reviewed_by"] = reviewerID
+	}
+	if err := db.Model(doc).Updates(updates).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to review document"})
+	}
+
+	return c.JSON(http.StatusOK, kycDocumentResponse(*doc))
+}
+
+// setKYCTier moves a user between tiers. A downgrade ends the user's sessions
+// so the lower limits apply at once; after an upgrade the next token refresh
+// carries the new tier.
+func setKYCTier(c echo.Context) error {
+	type TierRequest struct {
+		Tier string `json:"tier"`
+		Note string `json:"note"`
+	}
+	var req TierRequest
+	if err := c.Bind(&req); err != nil || !authz.ValidKYCTier(req.Tier) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unknown KYC tier"})
+	}
+
+	user, err := findUserParam(c)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+	if user.kycTier() == req.Tier {
+		return kycStatusResponse(c, user)
+	}
+
+	change := KYCTierChange{UserID: user.ID, FromTier: user.kycTier(), ToTier: req.Tier, Note: req.Note}
+	if adminID, ok := authz.UserID(c); ok {
+		change.ChangedBy = &adminID
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("kyc_tier", req.Tier).Error; err != nil {
+			return err
+		}
+		return tx.Create(&change).Error
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to change KYC tier"})
+	}
+
+	if authz.KYCTierRank(req.Tier) < authz.KYCTierRank(change.FromTier) {
+		if err := revokeAllSessions(user.ID); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke sessions"})
+		}
+	}
+
+	publishSecurityEvent("kyc_tier_changed", user.ID, map[string]interface{}{
+		"phone_number": user.PhoneNumber,
+		"from_tier":    change.FromTier,
+		"to_tier":      req.Tier,
+		"changed_by":   change.ChangedBy,
+	})
+
+	return kycStatusResponse(c, user)
+}
+
+// deleteKYCDocuments removes the files of a user's documents. Their rows go
+// with the rest of the account data.
+func deleteKYCDocuments(tx *gorm.DB, userID uint) {
+	var docs []KYCDocument
+	tx.Where("user_id = ?", userID).Find(&docs)
+	for _, doc := range docs {
+		if err := documentStore.Delete(doc.StoragePath); err != nil {
+			log.Printf("Failed to delete KYC document %d: %v", doc.ID, err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// loginLimit describes how failed logins are throttled for one dimension
+// (phone number or client IP). After delayAfter failures every further attempt
+// has to wait an exponentially growing delay; after lockAfter failures the key
+// is locked out completely for LoginLockoutDuration.
+type loginLimit struct {
+	scope      string
+	delayAfter int64
+	lockAfter  int64
+}
+
+var (
+	phoneLoginLimit = loginLimit{scope: "phone", delayAfter: 3, lockAfter: getEnvInt("LOGIN_MAX_FAILURES_PER_PHONE", 10)}
+	ipLoginLimit    = loginLimit{scope: "ip", delayAfter: 10, lockAfter: getEnvInt("LOGIN_MAX_FAILURES_PER_IP", 50)}
+)
+
+var (
+	LoginFailureWindow   = getEnvDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute)
+	LoginLockoutDuration = getEnvDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+)
+
+const LoginMaxDelay = time.Minute
+
+type loginThrottledError struct {
+	retryAfter time.Duration
+	locked     bool
+}
+
+func (e *loginThrottledError) Error() string {
+	if e.locked {
+		return "too many failed login attempts, temporarily locked"
+	}
+	return "login attempted too soon after a failure"
+}
+
+func (l loginLimit) key(kind, id string) string {
+	return fmt.Sprintf("login:%s:%s:%s", kind, l.scope, id)
+}
+
+// check returns a *loginThrottledError if id may not attempt a login right now.
+func (l loginLimit) check(id string) error {
+	for _, kind := range []string{"lock", "delay"} {
+		ttl, err := rdb.PTTL(ctx, l.key(kind, id)).Result()
+		if err != nil {
+			return err
+		}
+		if ttl > 0 {
+			return &loginThrottledError{retryAfter: ttl, locked: kind == "lock"}
+		}
+	}
+	return nil
+}
+
+// recordFailure counts a failed attempt and reports whether it locked id out.
+func (l loginLimit) recordFailure(id string) (bool, error) {
+	failKey := l.key("fail", id)
+	failures, err := rdb.Incr(ctx, failKey).Result()
+	if err != nil {
+		return false, err
+	}
+	if failures == 1 {
+		rdb.Expire(ctx, failKey, LoginFailureWindow)
+	}
+
+	if failures >= l.lockAfter {
+		pipe := rdb.TxPipeline()
+		pipe.Set(ctx, l.key("lock", id), failures, LoginLockoutDuration)
+		pipe.Del(ctx, failKey, l.key("delay", id))
+		_, err := pipe.Exec(ctx)
+		return err == nil, err
+	}
+
+	if failures >= l.delayAfter {
+		shift := failures - l.delayAfter
+		if shift > 6 {
+			shift = 6
+		}
+		delay := time.Second << uint(shift)
+		if delay > LoginMaxDelay {
+			delay = LoginMaxDelay
+		}
+		return false, rdb.Set(ctx, l.key("delay", id), failures, delay).Err()
+	}
+	return false, nil
+}
+
+func (l loginLimit) reset(id string) error {
+	return rdb.Del(ctx, l.key("fail", id), l.key("delay", id), l.key("lock", id)).Err()
+}
+
+func checkLoginAllowed(phone, ip string) error {
+	if err := ipLoginLimit.check(ip); err != nil {
+		return err
+	}
+	return phoneLoginLimit.check(phone)
+}
+
+// recordLoginFailure counts the failure for both the phone number and the IP
+// and alerts the account owner when the phone number gets locked out.
+func recordLoginFailure(user *User, phone, ip string) {
+	if _, err := ipLoginLimit.recordFailure(ip); err != nil {
+		log.Printf("Failed to record login failure for IP %s: %v", ip, err)
+	}
+
+	locked, err := phoneLoginLimit.recordFailure(phone)
+	if err != nil {
+		log.Printf("Failed to record login failure for %s: %v", phone, err)
+		return
+	}
+	if locked && user != nil {
+		publishSecurityEvent("account_locked", user.ID, map[string]interface{}{
+			"phone_number": user.PhoneNumber,
+			"ip_address":   ip,
+			"locked_until": time.Now().Add(LoginLockoutDuration),
+		})
+	}
+}
+
+var errPasswordInvalid = errors.New("password is incorrect")
+
+// confirmPassword checks the password of a signed-in user before a sensitive
+// change. It is throttled like a login: a phone number or IP locked out of
+// login is refused, the attempt is counted on the per-user step-up counter
+// before the password is compared, and a wrong password counts as a failed
+// login. A session is then no better for guessing the password than the
+// login form.
+func confirmPassword(c echo.Context, user *User, password string) error {
+	ip := c.RealIP()
+	if err := checkLoginAllowed(user.PhoneNumber, ip); err != nil {
+		return err
+	}
+	if err := reserveStepUpAttempt(user.ID); err != nil {
+		return err
+	}
+	if !checkPassword(user, password) {
+		recordLoginFailure(user, user.PhoneNumber, ip)
+		return errPasswordInvalid
+	}
+	rdb.Del(ctx, stepUpFailureKey(user.ID))
+	return nil
+}
+
+// confirmPasswordResponse answers a request whose password confirmPassword
+// refused.
+func confirmPasswordResponse(c echo.Context, err error) error {
+	var throttled *loginThrottledError
+	switch {
+	case err == errPasswordInvalid:
+		return invalidPasswordResponse(c)
+	case errors.Is(err, errStepUpTooManyFailures):
+		return c.JSON(http.StatusTooManyRequests, map[string]string{"error": "Too many wrong passwords, try again later", "code": "password_attempts_locked"})
+	case errors.As(err, &throttled):
+		return loginThrottledResponse(c, err)
+	default:
+		log.Printf("Failed to confirm password: %v", err)
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Password check temporarily unavailable"})
+	}
+}
+
+func loginThrottledResponse(c echo.Context, err error) error {
+	var throttled *loginThrottledError
+	if !errors.As(err, &throttled) {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Login temporarily unavailable"})
+	}
+
+	seconds := int(math.Ceil(throttled.retryAfter.Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	code := "login_throttled"
+	if throttled.locked {
+		code = "login_locked"
+	}
+	return c.JSON(http.StatusTooManyRequests, map[string]interface{}{
+		"error":       "Too many failed login attempts, try again later",
+		"code":        code,
+		"retry_after": seconds,
+	})
+}
+
+func unlockUser(c echo.Context) error {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	var user User
+	if err := db.First(&user, uint(userID)).Error; err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+
+	if err := phoneLoginLimit.reset(user.PhoneNumber); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to unlock user"})
+	}
+
+	publishSecurityEvent("account_unlocked", user.ID, nil)
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "User unlocked"})
+}
@@ -1,28 +1,153 @@
 package main
 
 import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/elkin/system-design-final/shared/authz"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
 func main() {
 	initDB()
+	initRedis()
+	initNATS()
+	initSigningKeys()
+	bootstrapAdmin()
 
-	go cleanupBlacklist()
+	go manageSigningKeys()
+	go serveGRPC()
+	go cleanupRefreshTokens()
+	go cleanupAuthEvents()
 
 	e := echo.New()
+	ipExtractor, err := authz.ClientIPExtractor(getEnv("TRUSTED_PROXIES", ""))
+	if err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES: ", err)
+	}
+	e.IPExtractor = ipExtractor
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 
 	e.POST("/register", register)
+	e.POST("/register/verify", verifyRegistration)
+	e.POST("/register/resend", resendRegistrationCode)
 	e.POST("/login", login)
+	e.POST("/login/mfa", loginMFA)
+	e.POST("/login/device", loginDevice)
 	e.POST("/refresh", refreshToken)
 	e.POST("/logout", logout)
+	e.POST("/password/reset/request", requestPasswordReset)
+	e.POST("/password/reset/confirm", confirmPasswordReset)
 	e.GET("/check", checkToken)
+	e.GET("/profile", getProfileProtected, JWTMiddleware)
+	e.GET("/profile/activity", getActivity, JWTMiddleware)
+	e.GET("/.well-known/jwks.json", getJWKS)
+	e.GET("/.well-known/openid-configuration", openIDConfiguration)
+	e.POST("/oauth/token", oauthToken)
+	e.GET("/oauth/userinfo", userInfo, OAuthMiddleware)
 
 	protectedGroup := e.Group("")
-	protectedGroup.Use(JWTMiddleware)
-	protectedGroup.GET("/profile", getProfileProtected)
+	protectedGroup.Use(SessionMiddleware)
+	protectedGroup.POST("/password/change", changePassword)
+	protectedGroup.POST("/profile/phone", requestPhoneChange)
+	protectedGroup.POST("/profile/phone/confirm", confirmPhoneChange)
+	protectedGroup.POST("/account/deactivate", deactivateAccount)
+	protectedGroup.DELETE("/account", deleteAccount)
+	protectedGroup.GET("/sessions", listSessions)
+	protectedGroup.DELETE("/sessions/:id", deleteSession)
+	protectedGroup.POST("/sessions/revoke-others", revokeOtherSessions)
+	protectedGroup.POST("/mfa/enroll", enrollMFA)
+	protectedGroup.POST("/mfa/enable", enableMFA)
+	protectedGroup.POST("/mfa/disable", disableMFA)
+	protectedGroup.POST("/mfa/recovery-codes", regenerateRecoveryCodes)
+	protectedGroup.GET("/oauth/authorize", getAuthorization)
+	protectedGroup.POST("/oauth/authorize", authorize)
+	protectedGroup.GET("/kyc", getKYCStatus)
+	protectedGroup.POST("/kyc/documents", uploadKYCDocument)
+	protectedGroup.GET("/devices", listDevices)
+	protectedGroup.DELETE("/devices/:id", removeDevice)
+	protectedGroup.POST("/step-up/sms", requestStepUpCode)
+	protectedGroup.POST("/step-up", stepUp)
+	protectedGroup.GET("/pin", getPINStatus)
+	protectedGroup.PUT("/pin", setPIN)
+	protectedGroup.DELETE("/pin", removePIN)
+	protectedGroup.POST("/pin/verify", checkPIN)
+	protectedGroup.POST("/api-keys", createAPIKey)
+	protectedGroup.GET("/api-keys", listAPIKeys)
+	protectedGroup.DELETE("/api-keys/:id", revokeAPIKey)
+
+	adminGroup := e.Group("/admin")
+	adminGroup.Use(JWTMiddleware)
+	adminGroup.POST("/users/:id/unlock", unlockUser, authz.RequirePermission(authz.PermUsersManage))
+	adminGroup.POST("/users/:id/deactivate", adminDeactivateUser, authz.RequirePermission(authz.PermUsersManage))
+	adminGroup.POST("/users/:id/reactivate", adminReactivateUser, authz.RequirePermission(authz.PermUsersManage))
+	adminGroup.GET("/users/:id/roles", getUserRoles, authz.RequirePermission(authz.PermUsersRead))
+	adminGroup.GET("/users/:id/events", getUserEvents, authz.RequirePermission(authz.PermUsersRead))
+	adminGroup.GET("/events", getAuthEvents, authz.RequirePermission(authz.PermUsersRead))
+	adminGroup.POST("/users/:id/roles", assignRole, authz.RequirePermission(authz.PermRolesManage))
+	adminGroup.DELETE("/users/:id/roles/:role", removeRole, authz.RequirePermission(authz.PermRolesManage))
+	adminGroup.GET("/users/:id/kyc", getUserKYC, authz.RequirePermission(authz.PermKYCReview))
+	adminGroup.POST("/users/:id/kyc-tier", setKYCTier, authz.RequirePermission(authz.PermKYCReview))
+	adminGroup.GET("/kyc/documents", listKYCDocuments, authz.RequirePermission(authz.PermKYCReview))
+	adminGroup.GET("/kyc/documents/:id/file", downloadKYCDocument, authz.RequirePermission(authz.PermKYCReview))
+	adminGroup.POST("/kyc/documents/:id/review", reviewKYCDocument, authz.RequirePermission(authz.PermKYCReview))
+	adminGroup.POST("/users/:id/impersonate", impersonateUser, authz.RequirePermission(authz.PermUsersImpersonate))
+	adminGroup.GET("/impersonations", listImpersonations, authz.RequirePermission(authz.PermUsersRead))
+	adminGroup.GET("/impersonations/:id/requests", getImpersonationRequests, authz.RequirePermission(authz.PermUsersRead))
+	adminGroup.DELETE("/impersonations/:id", endImpersonation, authz.RequirePermission(authz.PermUsersImpersonate))
+	adminGroup.POST("/oauth/clients", createOAuthClient, authz.RequirePermission(authz.PermOAuthClientsManage))
+	adminGroup.GET("/oauth/clients", listOAuthClients, authz.RequirePermission(authz.PermOAuthClientsManage))
+	adminGroup.DELETE("/oauth/clients/:id", deleteOAuthClient, authz.RequirePermission(authz.PermOAuthClientsManage))
 
 	e.Logger.Fatal(e.Start(":8081"))
 }
+
+func getEnv(key, fallback string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration %q for %s, using %s", value, key, fallback)
+		return fallback
+	}
+	return d
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid boolean %q for %s, using %t", value, key, fallback)
+		return fallback
+	}
+	return b
+}
+
+func getEnvInt(key string, fallback int64) int64 {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Printf("Invalid integer %q for %s, using %d", value, key, fallback)
+		return fallback
+	}
+	return n
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	TOTPPeriod          = 30
+	TOTPDigits          = 6
+	TOTPSkew            = 1
+	MFAChallengeExpiry  = 5 * time.Minute
+	MFAMaxAttempts      = 5
+	RecoveryCodeCount   = 10
+	mfaIssuer           = "PaymentSystem"
+	mfaAttemptKeyPrefix = "mfa:attempts:"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type MFARecoveryCode struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"not null;index"`
+	CodeHash  string `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpCode computes the RFC 6238 code (HMAC-SHA1, RFC 4226 truncation) for a time step.
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", TOTPDigits, value%1000000)
+}
+
+// validateTOTP returns the matched time step so callers can reject replays.
+func validateTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != TOTPDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / TOTPPeriod
+	for step := current - TOTPSkew; step <= current+TOTPSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// checkTOTP validates code for user and records the step so it cannot be used twice.
+func checkTOTP(user *User, code string) bool {
+	step, ok := validateTOTP(user.MFASecret, code, time.Now())
+	if !ok || step <= user.MFALastUsedStep {
+		return false
+	}
+
+	result := db.Model(&User{}).
+		Where("id = ? AND mfa_last_used_step < ?", user.ID, step).
+		Update("mfa_last_used_step", step)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false
+	}
+	user.MFALastUsedStep = step
+	return true
+}
+
+func generateRecoveryCodes(userID uint) ([]string, error) {
+	codes := make([]string, 0, RecoveryCodeCount)
+	rows := make([]MFARecoveryCode, 0, RecoveryCodeCount)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(totpEncoding.EncodeToString(b))
+		code := raw[:4] + "-" + raw[4:]
+		codes = append(codes, code)
+		rows = append(rows, MFARecoveryCode{UserID: userID, CodeHash: hashToken(normalizeRecoveryCode(code))})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&MFARecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+func useRecoveryCode(userID uint, code string) bool {
+	result := db.Model(&MFARecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashToken(normalizeRecoveryCode(code))).
+		Update("used_at", time.Now())
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// verifySecondFactor accepts either a TOTP code or an unused recovery code.
+func verifySecondFactor(user *User, code, recoveryCode string) bool {
+	if code != "" {
+		return checkTOTP(user, code)
+	}
+	if recoveryCode != "" {
+		return useRecoveryCode(user.ID, recoveryCode)
+	}
+	return false
+}
+
+func createMFAChallenge(user User, deviceID, deviceName string) (map[string]interface{}, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := signClaims(jwt.MapClaims{
+		"jti":         jti,
+		"typ":         TokenTypeMFAChallenge,
+		"user_id":     user.ID,
+		"device":      deviceHash(deviceID),
+		"device_name": deviceName,
+		"exp":         time.Now().Add(MFAChallengeExpiry).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"mfa_required": true,
+		"mfa_token":    challenge,
+		"expires_in":   MFAChallengeExpiry.Seconds(),
+	}, nil
+}
+
+func currentUser(c echo.Context) (*User, error) {
+	userID, ok := c.Get("user_id").(float64)
+	if !ok {
+		return nil, errors.New("missing user_id")
+	}
+	var user User
+	if err := db.First(&user, uint(userID)).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func loginMFA(c echo.Context) error {
+	type MFALoginRequest struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	var req MFALoginRequest
+	if err := c.Bind(&req); err != nil || req.MFAToken == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	claims, err := validateTokenOfType(req.MFAToken, TokenTypeMFAChallenge)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired MFA token"})
+	}
+
+	jti, _ := claims["jti"].(string)
+	attempts, err := rdb.Incr(ctx, mfaAttemptKeyPrefix+jti).Result()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to record attempt"})
+	}
+	rdb.Expire(ctx, mfaAttemptKeyPrefix+jti, MFAChallengeExpiry)
+	if attempts > MFAMaxAttempts {
+		markTokenUsed(claims)
+		userID := claimUserID(claims)
+		recordAuthEvent(c, AuthEvent{UserID: &userID, Type: AuthEventLoginMFA, Outcome: AuthOutcomeFailure, Reason: "too_many_attempts"})
+		return c.JSON(http.StatusTooManyRequests, map[string]string{"error": "Too many invalid codes, log in again"})
+	}
+
+	var user User
+	if err := db.First(&user, claimUserID(claims)).Error; err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid or expired MFA token"})
+	}
+	if !user.MFAEnabled || !verifySecondFactor(&user, req.Code, req.RecoveryCode) {
+		recordAuthFailure(c, AuthEventLoginMFA, &user, "", "invalid_code")
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid authentication code"})
+	}
+
+	if err := markTokenUsed(claims); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to complete login"})
+	}
+
+	// The second factor is enough to trust a new device
+	hash, _ := claims["device"].(string)
+	deviceName, _ := claims["device_name"].(string)
+	if known, err := recognizeDevice(c, &user, hash, deviceName); err == nil && !known && hash != "" {
+		if err := trustDevice(c, user.ID, hash, deviceName); err != nil {
+			log.Printf("Failed to trust device for user %d: %v", user.ID, err)
+		}
+		notifyNewDevice(c, user, deviceName)
+	}
+
+	session := newSession(c, deviceName)
+	session.DeviceHash = hash
+	tokenResponse, err := createTokenPair(user, session)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate tokens"})
+	}
+	recordAuthSuccess(c, AuthEventLoginMFA, user, sessionIDOf(tokenResponse))
+
+	return c.JSON(http.StatusOK, tokenResponse)
+}
+
+func enrollMFA(c echo.Context) error {
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if user.MFAEnabled {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "MFA is already enabled"})
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate secret"})
+	}
+	if err := db.Model(user).Updates(map[string]interface{}{"mfa_secret": secret, "mfa_last_used_step": 0}).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save secret"})
+	}
+
+	otpauthURL := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + mfaIssuer + ":" + user.PhoneNumber,
+		RawQuery: url.Values{
+			"secret":    {secret},
+			"issuer":    {mfaIssuer},
+			"algorithm": {"SHA1"},
+			"digits":    {fmt.Sprint(TOTPDigits)},
+			"period":    {fmt.Sprint(TOTPPeriod)},
+		}.Encode(),
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"secret":      secret,
+		"otpauth_url": otpauthURL.String(),
+		"message":     "Confirm enrollment with a code at /mfa/enable",
+	})
+}
+
+func enableMFA(c echo.Context) error {
+	type EnableRequest struct {
+		Code string `json:"code"`
+	}
+	var req EnableRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if user.MFAEnabled {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "MFA is already enabled"})
+	}
+	if user.MFASecret == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Start enrollment at /mfa/enroll first"})
+	}
+	if !checkTOTP(user, req.Code) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid authentication code"})
+	}
+
+	codes, err := generateRecoveryCodes(user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate recovery codes"})
+	}
+	if err := db.Model(user).Update("mfa_enabled", true).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to enable MFA"})
+	}
+
+	publishSecurityEvent("mfa_enabled", user.ID, nil)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message":        "MFA enabled",
+		"recovery_codes": codes,
+	})
+}
+
+func disableMFA(c echo.Context) error {
+	type DisableRequest struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	var req DisableRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if !user.MFAEnabled {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "MFA is not enabled"})
+	}
+	if err := confirmPassword(c, user, req.Password); err != nil {
+		return confirmPasswordResponse(c, err)
+	}
+	if !verifySecondFactor(user, req.Code, req.RecoveryCode) {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid authentication code"})
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Updates(map[string]interface{}{"mfa_enabled": false, "mfa_secret": "", "mfa_last_used_step": 0}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&MFARecoveryCode{}).Error
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to disable MFA"})
+	}
+
+	publishSecurityEvent("mfa_disabled", user.ID, nil)
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "MFA disabled"})
+}
+
+func regenerateRecoveryCodes(c echo.Context) error {
+	type RegenerateRequest struct {
+		Code string `json:"code"`
+	}
+	var req RegenerateRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if !user.MFAEnabled {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "MFA is not enabled"})
+	}
+	if !checkTOTP(user, req.Code) {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid authentication code"})
+	}
+
+	codes, err := generateRecoveryCodes(user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate recovery codes"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"recovery_codes": codes})
+}
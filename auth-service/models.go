@@ -1,16 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"time"
 
+	"github.com/elkin/system-design-final/shared/authz"
+	"github.com/go-redis/redis/v8"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
 var db *gorm.DB
-var tokenBlacklist = make(map[string]time.Time)
+var rdb *redis.Client
+var ctx = context.Background()
 
 func initDB() {
 	dsn := "host=localhost user=postgres password=postgres dbname=payment_system port=5432 sslmode=disable TimeZone=Asia/Almaty"
@@ -21,26 +25,101 @@ func initDB() {
 	}
 	fmt.Println("Connected to PostgreSQL")
 
-	err = db.AutoMigrate(&User{}, &RefreshToken{})
+	if err := migrateRefreshTokens(); err != nil {
+		log.Fatal("Refresh token migration failed: ", err)
+	}
+
+	err = db.AutoMigrate(&User{}, &RefreshToken{}, &SigningKey{}, &VerificationCode{}, &MFARecoveryCode{}, &UserRole{}, &OAuthClient{}, &OAuthAuthorizationCode{}, &OAuthConsent{}, &APIKey{}, &AuthEvent{}, &TrustedDevice{}, &KYCDocument{}, &KYCTierChange{}, &Impersonation{}, &ImpersonationRequest{})
 	if err != nil {
 		log.Fatal("Migration failed")
 	}
 	fmt.Println("Migrations applied")
 }
 
+func initRedis() {
+	rdb = redis.NewClient(&redis.Options{
+		Addr:     getEnv("REDIS_ADDR", "localhost:6379"),
+		Password: "",
+		DB:       0,
+	})
+	_, err := rdb.Ping(ctx).Result()
+	if err != nil {
+		log.Fatal("Failed to connect to Redis: ", err)
+	}
+	fmt.Println("Connected to Redis")
+}
+
+const (
+	UserStatusPending     = "pending"
+	UserStatusActive      = "active"
+	UserStatusDeactivated = "deactivated"
+	UserStatusDeleted     = "deleted"
+)
+
 type User struct {
-	ID           uint   `gorm:"primaryKey"`
-	PhoneNumber  string `gorm:"unique;not null"`
-	PasswordHash string `gorm:"not null"`
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
+	ID              uint   `gorm:"primaryKey"`
+	PhoneNumber     string `gorm:"unique;not null"`
+	PasswordHash    string `gorm:"not null"`
+	Status          string `gorm:"not null;default:active"`
+	PhoneVerifiedAt *time.Time
+	MFAEnabled      bool   `gorm:"not null;default:false"`
+	MFASecret       string `json:"-"`
+	MFALastUsedStep int64  `gorm:"not null;default:0"`
+	KYCTier         string `gorm:"not null;default:unverified"`
+	PINHash         string `json:"-"`
+	PINRequired     bool   `gorm:"not null;default:false"`
+	PINSetAt        *time.Time
+	DeactivatedAt   *time.Time
+	DeletedAt       *time.Time
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+func (u User) kycTier() string {
+	if u.KYCTier == "" {
+		return authz.KYCTierUnverified
+	}
+	return u.KYCTier
 }
 
 type RefreshToken struct {
 	ID        uint   `gorm:"primaryKey"`
-	UserID    uint   `gorm:"not null"`
-	Token     string `gorm:"unique;not null"`
+	UserID    uint   `gorm:"not null;index"`
+	FamilyID  string `gorm:"not null;index"`
+	TokenHash string `gorm:"unique;not null"`
 	ExpiresAt time.Time
+	RotatedAt *time.Time
+	RevokedAt *time.Time
 	CreatedAt time.Time
 	UpdatedAt time.Time
+
+	ClientID         string `gorm:"not null;default:'';index"`
+	Scope            string
+	DeviceName       string
+	DeviceHash       string `gorm:"not null;default:'';index"`
+	UserAgent        string
+	IPAddress        string
+	LastUsedAt       *time.Time
+	SessionCreatedAt time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
+}
+
+// migrateRefreshTokens hashes tokens stored by older versions in the plaintext
+// token column and gives each of them its own family.
+func migrateRefreshTokens() error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(&RefreshToken{}) || !migrator.HasColumn(&RefreshToken{}, "token") {
+		return nil
+	}
+
+	statements := []string{
+		"ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS token_hash text",
+		"ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS family_id text",
+		"UPDATE refresh_tokens SET token_hash = encode(sha256(token::bytea), 'hex'), family_id = 'legacy-' || id WHERE token_hash IS NULL",
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return migrator.DropColumn(&RefreshToken{}, "token")
 }
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ScopeOpenID        = "openid"
+	ScopeProfile       = "profile"
+	ScopePhone         = "phone"
+	ScopeOfflineAccess = "offline_access"
+
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantClientCredentials = "client_credentials"
+
+	AuthorizationCodeExpiry = 5 * time.Minute
+	TokenTypeID             = "id"
+)
+
+var (
+	oidcIssuer      = getEnv("OIDC_ISSUER", "http://localhost:8081")
+	supportedScopes = []string{ScopeOpenID, ScopeProfile, ScopePhone, ScopeOfflineAccess}
+)
+
+// OAuthClient is an application registered to sign in our users. Public
+// clients (SPAs, mobile apps) have no secret and must use PKCE, which is
+// required for every authorization code anyway.
+type OAuthClient struct {
+	ID           string `gorm:"primaryKey"`
+	Name         string `gorm:"not null"`
+	SecretHash   string
+	RedirectURIs string `gorm:"type:text"`
+	Scopes       string `gorm:"not null"`
+	GrantTypes   string `gorm:"not null"`
+	CreatedAt    time.Time
+}
+
+type OAuthAuthorizationCode struct {
+	CodeHash      string `gorm:"primaryKey"`
+	ClientID      string `gorm:"not null;index"`
+	UserID        uint   `gorm:"not null"`
+	RedirectURI   string `gorm:"not null"`
+	Scope         string
+	Nonce         string
+	CodeChallenge string `gorm:"not null"`
+	ExpiresAt     time.Time
+	UsedAt        *time.Time
+	CreatedAt     time.Time
+}
+
+type OAuthConsent struct {
+	UserID    uint   `gorm:"primaryKey"`
+	ClientID  string `gorm:"primaryKey"`
+	Scope     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (client *OAuthClient) public() bool {
+	return client.SecretHash == ""
+}
+
+func (client *OAuthClient) allowsRedirect(uri string) bool {
+	for _, allowed := range strings.Fields(client.RedirectURIs) {
+		if allowed == uri {
+			return true
+		}
+	}
+	return false
+}
+
+func (client *OAuthClient) allowsGrant(grant string) bool {
+	return containsString(strings.Fields(client.GrantTypes), grant)
+}
+
+// grantableScope returns the requested scopes normalised, or false if the
+// client is not registered for one of them.
+func (client *OAuthClient) grantableScope(requested string) (string, bool) {
+	allowed := strings.Fields(client.Scopes)
+	scopes := strings.Fields(requested)
+	for _, s := range scopes {
+		if !containsString(allowed, s) {
+			return "", false
+		}
+	}
+	sort.Strings(scopes)
+	return strings.Join(scopes, " "), true
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func scopeCovers(granted, requested string) bool {
+	have := strings.Fields(granted)
+	for _, s := range strings.Fields(requested) {
+		if !containsString(have, s) {
+			return false
+		}
+	}
+	return true
+}
+
+func oauthError(c echo.Context, status int, code, description string) error {
+	return c.JSON(status, map[string]string{"error": code, "error_description": description})
+}
+
+func findOAuthClient(clientID string) (*OAuthClient, error) {
+	var client OAuthClient
+	if err := db.First(&client, "id = ?", clientID).Error; err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+// authenticateClient checks HTTP Basic or form credentials. Public clients
+// authenticate with their client_id alone.
+func authenticateClient(c echo.Context) (*OAuthClient, bool) {
+	clientID, secret, hasBasic := c.Request().BasicAuth()
+	if !hasBasic {
+		clientID = c.FormValue("client_id")
+		secret = c.FormValue("client_secret")
+	}
+	if clientID == "" {
+		return nil, false
+	}
+
+	client, err := findOAuthClient(clientID)
+	if err != nil {
+		return nil, false
+	}
+	if client.public() {
+		return client, secret == ""
+	}
+	return client, subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(client.SecretHash)) == 1
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+type authorizationRequest struct {
+	ClientID            string `json:"client_id" query:"client_id"`
+	RedirectURI         string `json:"redirect_uri" query:"redirect_uri"`
+	ResponseType        string `json:"response_type" query:"response_type"`
+	Scope               string `json:"scope" query:"scope"`
+	State               string `json:"state" query:"state"`
+	Nonce               string `json:"nonce" query:"nonce"`
+	CodeChallenge       string `json:"code_challenge" query:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method" query:"code_challenge_method"`
+	Approve             *bool  `json:"approve" query:"-"`
+}
+
+// validateAuthorizationRequest returns the client and normalised scope, or an
+// error response. Errors are never redirected because the redirect URI may be
+// the thing that is wrong.
+func validateAuthorizationRequest(c echo.Context, req authorizationRequest) (*OAuthClient, string, error) {
+	client, err := findOAuthClient(req.ClientID)
+	if err != nil {
+		return nil, "", oauthError(c, http.StatusBadRequest, "invalid_client", "Unknown client")
+	}
+	if !client.allowsRedirect(req.RedirectURI) {
+		return nil, "", oauthError(c, http.StatusBadRequest, "invalid_request", "redirect_uri is not registered for this client")
+	}
+	if req.ResponseType != "code" || !client.allowsGrant(GrantAuthorizationCode) {
+		return nil, "", oauthError(c, http.StatusBadRequest, "unsupported_response_type", "Only the authorization code flow is supported")
+	}
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		return nil, "", oauthError(c, http.StatusBadRequest, "invalid_request", "PKCE with code_challenge_method S256 is required")
+	}
+	scope, ok := client.grantableScope(req.Scope)
+	if !ok {
+		return nil, "", oauthError(c, http.StatusBadRequest, "invalid_scope", "The client may not request these scopes")
+	}
+	return client, scope, nil
+}
+
+func existingConsent(userID uint, clientID string) string {
+	var consent OAuthConsent
+	if err := db.First(&consent, "user_id = ? AND client_id = ?", userID, clientID).Error; err != nil {
+		return ""
+	}
+	return consent.Scope
+}
+
+// getAuthorization describes what the client asks for so the dashboard can
+// render a consent screen.
+func getAuthorization(c echo.Context) error {
+	var req authorizationRequest
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, &req); err != nil {
+		return oauthError(c, http.StatusBadRequest, "invalid_request", "Invalid request")
+	}
+	client, scope, err := validateAuthorizationRequest(c, req)
+	if client == nil {
+		return err
+	}
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"client_id":        client.ID,
+		"client_name":      client.Name,
+		"scope":            scope,
+		"consent_required": !scopeCovers(existingConsent(user.ID, client.ID), scope),
+	})
+}
+
+// authorize issues an authorization code for the logged-in user. Consent has
+// to be given explicitly unless the user already granted these scopes.
+func authorize(c echo.Context) error {
+	var req authorizationRequest
+	if err := c.Bind(&req); err != nil {
+		return oauthError(c, http.StatusBadRequest, "invalid_request", "Invalid request")
+	}
+	client, scope, err := validateAuthorizationRequest(c, req)
+	if client == nil {
+		return err
+	}
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	redirect, _ := url.Parse(req.RedirectURI)
+	query := redirect.Query()
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+
+	if req.Approve != nil && !*req.Approve {
+		query.Set("error", "access_denied")
+		redirect.RawQuery = query.Encode()
+		return c.JSON(http.StatusOK, map[string]string{"redirect_to": redirect.String()})
+	}
+	if req.Approve == nil && !scopeCovers(existingConsent(user.ID, client.ID), scope) {
+		return oauthError(c, http.StatusBadRequest, "consent_required", "The user has to approve the requested scopes")
+	}
+
+	if req.Approve != nil {
+		consent := OAuthConsent{UserID: user.ID, ClientID: client.ID, Scope: scope}
+		if err := db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}, {Name: "client_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"scope", "updated_at"}),
+		}).Create(&consent).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save consent"})
+		}
+	}
+
+	code, err := generateRandomString(32)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate code"})
+	}
+	if err := db.Create(&OAuthAuthorizationCode{
+		CodeHash:      hashToken(code),
+		ClientID:      client.ID,
+		UserID:        user.ID,
+		RedirectURI:   req.RedirectURI,
+		Scope:         scope,
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		ExpiresAt:     time.Now().Add(AuthorizationCodeExpiry),
+	}).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save code"})
+	}
+
+	query.Set("code", code)
+	redirect.RawQuery = query.Encode()
+	return c.JSON(http.StatusOK, map[string]string{"redirect_to": redirect.String()})
+}
+
+func oauthToken(c echo.Context) error {
+	c.Response().Header().Set("Cache-Control", "no-store")
+
+	client, ok := authenticateClient(c)
+	if !ok {
+		c.Response().Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		return oauthError(c, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+	}
+
+	grantType := c.FormValue("grant_type")
+	if !client.allowsGrant(grantType) {
+		return oauthError(c, http.StatusBadRequest, "unauthorized_client", "The client may not use this grant type")
+	}
+
+	switch grantType {
+	case GrantAuthorizationCode:
+		return exchangeAuthorizationCode(c, client)
+	case GrantRefreshToken:
+		return exchangeOAuthRefreshToken(c, client)
+	case GrantClientCredentials:
+		return issueClientCredentialsToken(c, client)
+	default:
+		return oauthError(c, http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant type")
+	}
+}
+
+func exchangeAuthorizationCode(c echo.Context, client *OAuthClient) error {
+	var code OAuthAuthorizationCode
+	err := db.First(&code, "code_hash = ? AND client_id = ?", hashToken(c.FormValue("code")), client.ID).Error
+	if err != nil || code.UsedAt != nil || time.Now().After(code.ExpiresAt) || code.RedirectURI != c.FormValue("redirect_uri") {
+		return oauthError(c, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+	}
+	if subtle.ConstantTimeCompare([]byte(pkceChallenge(c.FormValue("code_verifier"))), []byte(code.CodeChallenge)) != 1 {
+		return oauthError(c, http.StatusBadRequest, "invalid_grant", "PKCE verification failed")
+	}
+
+	result := db.Model(&OAuthAuthorizationCode{}).
+		Where("code_hash = ? AND used_at IS NULL", code.CodeHash).
+		Update("used_at", time.Now())
+	if result.Error != nil || result.RowsAffected == 0 {
+		return oauthError(c, http.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+	}
+
+	var user User
+	if err := db.First(&user, code.UserID).Error; err != nil || user.Status != UserStatusActive {
+		return oauthError(c, http.StatusBadRequest, "invalid_grant", "The user is no longer active")
+	}
+
+	session := newSession(c, client.Name)
+	session.ClientID = client.ID
+	session.Scope = code.Scope
+	return oauthTokenResponse(c, user, session, code.Nonce)
+}
+
+func exchangeOAuthRefreshToken(c echo.Context, client *OAuthClient) error {
+	refreshToken, err := redeemRefreshToken(c.FormValue("refresh_token"), client.ID)
+	if err != nil {
+		if errors.Is(err, errRefreshTokenInvalid) || errors.Is(err, errRefreshTokenRevoked) ||
+			errors.Is(err, errRefreshTokenReused) || errors.Is(err, errRefreshTokenExpired) {
+			return oauthError(c, http.StatusBadRequest, "invalid_grant", err.Error())
+		}
+		return oauthError(c, http.StatusInternalServerError, "server_error", "Database error")
+	}
+
+	var user User
+	if err := db.First(&user, refreshToken.UserID).Error; err != nil || user.Status != UserStatusActive {
+		return oauthError(c, http.StatusBadRequest, "invalid_grant", "The user is no longer active")
+	}
+
+	return oauthTokenResponse(c, user, continueSession(c, *refreshToken), "")
+}
+
+// oauthTokenResponse issues an access token, a refresh token when
+// offline_access was granted and an ID token for openid requests.
+func oauthTokenResponse(c echo.Context, user User, session sessionInfo, nonce string) error {
+	scopes := strings.Fields(session.Scope)
+	response := map[string]interface{}{
+		"token_type": "Bearer",
+		"expires_in": AccessTokenExpiry.Seconds(),
+		"scope":      session.Scope,
+	}
+
+	if containsString(scopes, ScopeOfflineAccess) {
+		tokens, err := createTokenPair(user, session)
+		if err != nil {
+			return oauthError(c, http.StatusInternalServerError, "server_error", "Failed to generate tokens")
+		}
+		response["access_token"] = tokens["access_token"]
+		response["refresh_token"] = tokens["refresh_token"]
+	} else {
+		accessToken, err := issueAccessToken(user, session)
+		if err != nil {
+			return oauthError(c, http.StatusInternalServerError, "server_error", "Failed to generate tokens")
+		}
+		response["access_token"] = accessToken
+	}
+
+	if containsString(scopes, ScopeOpenID) {
+		idToken, err := issueIDToken(user, session.ClientID, scopes, nonce)
+		if err != nil {
+			return oauthError(c, http.StatusInternalServerError, "server_error", "Failed to generate ID token")
+		}
+		response["id_token"] = idToken
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func issueIDToken(user User, clientID string, scopes []string, nonce string) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss": oidcIssuer,
+		"sub": strconv.FormatUint(uint64(user.ID), 10),
+		"aud": clientID,
+		"typ": TokenTypeID,
+		"iat": now.Unix(),
+		"exp": now.Add(AccessTokenExpiry).Unix(),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	for k, v := range userInfoClaims(user, scopes) {
+		claims[k] = v
+	}
+	return signClaims(claims)
+}
+
+func userInfoClaims(user User, scopes []string) map[string]interface{} {
+	claims := map[string]interface{}{"sub": strconv.FormatUint(uint64(user.ID), 10)}
+	if containsString(scopes, ScopePhone) {
+		claims["phone_number"] = user.PhoneNumber
+		claims["phone_number_verified"] = user.PhoneVerifiedAt != nil
+	}
+	if containsString(scopes, ScopeProfile) {
+		claims["updated_at"] = user.UpdatedAt.Unix()
+	}
+	return claims
+}
+
+func issueClientCredentialsToken(c echo.Context, client *OAuthClient) error {
+	if client.public() {
+		return oauthError(c, http.StatusBadRequest, "unauthorized_client", "Public clients cannot use client credentials")
+	}
+	scope, ok := client.grantableScope(c.FormValue("scope"))
+	// There is no user behind these tokens, so user scopes make no sense.
+	scopes := strings.Fields(scope)
+	if !ok || containsString(scopes, ScopeOpenID) || containsString(scopes, ScopeOfflineAccess) {
+		return oauthError(c, http.StatusBadRequest, "invalid_scope", "The client may not request these scopes")
+	}
+
+	jti, err := newTokenID()
+	if err != nil {
+		return oauthError(c, http.StatusInternalServerError, "server_error", "Failed to generate token")
+	}
+	accessToken, err := signClaims(jwt.MapClaims{
+		"jti":       jti,
+		"typ":       TokenTypeAccess,
+		"sub":       client.ID,
+		"client_id": client.ID,
+		"scope":     scope,
+		"exp":       time.Now().Add(AccessTokenExpiry).Unix(),
+	})
+	if err != nil {
+		return oauthError(c, http.StatusInternalServerError, "server_error", "Failed to generate token")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   AccessTokenExpiry.Seconds(),
+		"scope":        scope,
+	})
+}
+
+func userInfo(c echo.Context) error {
+	scopes := strings.Fields(stringClaim(c.Get("scope")))
+	clientID, _ := c.Get("client_id").(string)
+	if clientID != "" && !containsString(scopes, ScopeOpenID) {
+		return oauthError(c, http.StatusForbidden, "insufficient_scope", "The openid scope is required")
+	}
+	if clientID == "" {
+		scopes = supportedScopes
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	return c.JSON(http.StatusOK, userInfoClaims(*user, scopes))
+}
+
+func stringClaim(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+func openIDConfiguration(c echo.Context) error {
+	algorithms := []string{"RS256", "ES256"}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"issuer":                                oidcIssuer,
+		"authorization_endpoint":                oidcIssuer + "/oauth/authorize",
+		"token_endpoint":                        oidcIssuer + "/oauth/token",
+		"userinfo_endpoint":                     oidcIssuer + "/oauth/userinfo",
+		"jwks_uri":                              oidcIssuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{GrantAuthorizationCode, GrantRefreshToken, GrantClientCredentials},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": algorithms,
+		"scopes_supported":                      supportedScopes,
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "nonce", "phone_number", "phone_number_verified", "updated_at"},
+	})
+}
+
+func createOAuthClient(c echo.Context) error {
+	type CreateClientRequest struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		GrantTypes   []string `json:"grant_types"`
+		Public       bool     `json:"public"`
+	}
+	var req CreateClientRequest
+	if err := c.Bind(&req); err != nil || req.Name == "" || len(req.GrantTypes) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	for _, grant := range req.GrantTypes {
+		if grant != GrantAuthorizationCode && grant != GrantRefreshToken && grant != GrantClientCredentials {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unsupported grant type " + grant})
+		}
+	}
+	for _, scope := range req.Scopes {
+		if !containsString(supportedScopes, scope) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unsupported scope " + scope})
+		}
+	}
+	for _, uri := range req.RedirectURIs {
+		if parsed, err := url.Parse(uri); err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid redirect URI " + uri})
+		}
+	}
+	if containsString(req.GrantTypes, GrantAuthorizationCode) && len(req.RedirectURIs) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Authorization code clients need a redirect URI"})
+	}
+	if req.Public && containsString(req.GrantTypes, GrantClientCredentials) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Public clients cannot use client credentials"})
+	}
+
+	clientID, err := newTokenID()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate client ID"})
+	}
+	client := OAuthClient{
+		ID:           clientID,
+		Name:         req.Name,
+		RedirectURIs: strings.Join(req.RedirectURIs, " "),
+		Scopes:       strings.Join(req.Scopes, " "),
+		GrantTypes:   strings.Join(req.GrantTypes, " "),
+	}
+
+	response := map[string]interface{}{
+		"client_id":     client.ID,
+		"name":          client.Name,
+		"redirect_uris": req.RedirectURIs,
+		"scopes":        req.Scopes,
+		"grant_types":   req.GrantTypes,
+	}
+	if !req.Public {
+		secret, err := generateRandomString(32)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate client secret"})
+		}
+		client.SecretHash = hashToken(secret)
+		response["client_secret"] = secret
+	}
+
+	if err := db.Create(&client).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create client"})
+	}
+
+	return c.JSON(http.StatusCreated, response)
+}
+
+func listOAuthClients(c echo.Context) error {
+	var clients []OAuthClient
+	if err := db.Order("created_at").Find(&clients).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	result := make([]map[string]interface{}, 0, len(clients))
+	for _, client := range clients {
+		result = append(result, map[string]interface{}{
+			"client_id":     client.ID,
+			"name":          client.Name,
+			"public":        client.public(),
+			"redirect_uris": strings.Fields(client.RedirectURIs),
+			"scopes":        strings.Fields(client.Scopes),
+			"grant_types":   strings.Fields(client.GrantTypes),
+			"created_at":    client.CreatedAt,
+		})
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// deleteOAuthClient removes the client together with its codes, consents and
+// refresh tokens.
+func deleteOAuthClient(c echo.Context) error {
+	clientID := c.Param("id")
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Delete(&OAuthClient{}, "id = ?", clientID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		if err := tx.Delete(&OAuthAuthorizationCode{}, "client_id = ?", clientID).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&OAuthConsent{}, "client_id = ?", clientID).Error; err != nil {
+			return err
+		}
+		return tx.Model(&RefreshToken{}).
+			Where("client_id = ? AND revoked_at IS NULL", clientID).
+			Update("revoked_at", time.Now()).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Client not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete client"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Client deleted"})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	PurposeRegistration  = "registration"
+	PurposePasswordReset = "password_reset"
+	PurposePhoneChange   = "phone_change"
+	PurposeStepUp        = "step_up"
+	PurposeNewDevice     = "new_device"
+)
+
+const (
+	OTPCodeExpiry      = 10 * time.Minute
+	OTPMaxAttempts     = 5
+	OTPResendInterval  = time.Minute
+	OTPMaxSendsPerHour = 5
+)
+
+var (
+	errOTPNotFound         = errors.New("no pending verification code")
+	errOTPExpired          = errors.New("verification code has expired")
+	errOTPInvalid          = errors.New("invalid verification code")
+	errOTPTooManyAttempts  = errors.New("too many invalid attempts")
+	errOTPResendTooSoon    = errors.New("verification code was sent recently")
+	errOTPTooManyRequested = errors.New("too many verification codes requested")
+)
+
+type VerificationCode struct {
+	ID         uint   `gorm:"primaryKey"`
+	UserID     uint   `gorm:"not null;index"`
+	Purpose    string `gorm:"not null;index"`
+	Target     string `gorm:"not null"`
+	CodeHash   string `gorm:"not null"`
+	Attempts   int    `gorm:"not null;default:0"`
+	ExpiresAt  time.Time
+	ConsumedAt *time.Time
+	CreatedAt  time.Time
+}
+
+func generateOTPCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// issueVerificationCode sends a new one-time code for purpose to target over
+// notification-service. Older unconsumed codes for the same purpose stop working.
+func issueVerificationCode(userID uint, purpose, target string) error {
+	var last VerificationCode
+	err := db.Where("user_id = ? AND purpose = ?", userID, purpose).Order("created_at desc").First(&last).Error
+	if err == nil && time.Since(last.CreatedAt) < OTPResendInterval {
+		return errOTPResendTooSoon
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	var sentLastHour int64
+	if err := db.Model(&VerificationCode{}).
+		Where("user_id = ? AND purpose = ? AND created_at > ?", userID, purpose, time.Now().Add(-time.Hour)).
+		Count(&sentLastHour).Error; err != nil {
+		return err
+	}
+	if sentLastHour >= OTPMaxSendsPerHour {
+		return errOTPTooManyRequested
+	}
+
+	code, err := generateOTPCode()
+	if err != nil {
+		return err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&VerificationCode{}).
+			Where("user_id = ? AND purpose = ? AND consumed_at IS NULL", userID, purpose).
+			Update("consumed_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return tx.Create(&VerificationCode{
+			UserID:    userID,
+			Purpose:   purpose,
+			Target:    target,
+			CodeHash:  hashToken(code),
+			ExpiresAt: time.Now().Add(OTPCodeExpiry),
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	publishSMS(target, fmt.Sprintf("Your verification code is %s. It expires in %d minutes.", code, int(OTPCodeExpiry.Minutes())), "otp_"+purpose)
+	return nil
+}
+
+func verifyVerificationCode(userID uint, purpose, code string) (*VerificationCode, error) {
+	var verification VerificationCode
+	if err := db.Where("user_id = ? AND purpose = ? AND consumed_at IS NULL", userID, purpose).
+		Order("created_at desc").First(&verification).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errOTPNotFound
+		}
+		return nil, err
+	}
+
+	if time.Now().After(verification.ExpiresAt) {
+		return nil, errOTPExpired
+	}
+
+	// The attempt is counted before the code is compared, so parallel
+	// guesses cannot all slip in under the limit
+	attempt := db.Model(&VerificationCode{}).
+		Where("id = ? AND attempts < ?", verification.ID, OTPMaxAttempts).
+		Update("attempts", gorm.Expr("attempts + 1"))
+	if attempt.Error != nil {
+		return nil, attempt.Error
+	}
+	if attempt.RowsAffected == 0 {
+		return nil, errOTPTooManyAttempts
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashToken(code)), []byte(verification.CodeHash)) != 1 {
+		return nil, errOTPInvalid
+	}
+
+	result := db.Model(&VerificationCode{}).
+		Where("id = ? AND consumed_at IS NULL", verification.ID).
+		Update("consumed_at", time.Now())
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errOTPNotFound
+	}
+	return &verification, nil
+}
+
+func otpErrorResponse(c echo.Context, err error) error {
+	switch err {
+	case errOTPNotFound:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "No pending verification code", "code": "otp_not_found"})
+	case errOTPExpired:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Verification code has expired", "code": "otp_expired"})
+	case errOTPInvalid:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid verification code", "code": "otp_invalid"})
+	case errOTPTooManyAttempts:
+		return c.JSON(http.StatusTooManyRequests, map[string]string{"error": "Too many invalid attempts, request a new code", "code": "otp_attempts_exceeded"})
+	case errOTPResendTooSoon:
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(OTPResendInterval.Seconds())))
+		return c.JSON(http.StatusTooManyRequests, map[string]string{"error": "Verification code was sent recently, try again later", "code": "otp_resend_too_soon"})
+	case errOTPTooManyRequested:
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(time.Hour.Seconds())))
+		return c.JSON(http.StatusTooManyRequests, map[string]string{"error": "Too many verification codes requested", "code": "otp_send_limit"})
+	default:
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to process verification code"})
+	}
+}
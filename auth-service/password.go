@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+//go:embed breached_passwords.txt
+var defaultBreachedPasswords string
+
+// PasswordPolicy decides which new passwords are acceptable. Existing
+// passwords are never re-checked.
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RequireLower  bool
+	RequireUpper  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	breached      map[string]struct{}
+}
+
+var passwordPolicy = loadPasswordPolicy()
+
+// loadPasswordPolicy reads the policy from the environment. The breached list
+// ships with the service; PASSWORD_BREACHED_LIST adds a file with one
+// password per line.
+func loadPasswordPolicy() *PasswordPolicy {
+	policy := &PasswordPolicy{
+		MinLength:     int(getEnvInt("PASSWORD_MIN_LENGTH", 8)),
+		MaxLength:     int(getEnvInt("PASSWORD_MAX_LENGTH", 128)),
+		RequireLower:  getEnvBool("PASSWORD_REQUIRE_LOWER", true),
+		RequireUpper:  getEnvBool("PASSWORD_REQUIRE_UPPER", true),
+		RequireDigit:  getEnvBool("PASSWORD_REQUIRE_DIGIT", true),
+		RequireSymbol: getEnvBool("PASSWORD_REQUIRE_SYMBOL", false),
+		breached:      make(map[string]struct{}),
+	}
+	policy.addBreached(strings.NewReader(defaultBreachedPasswords))
+
+	if path := getEnv("PASSWORD_BREACHED_LIST", ""); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Failed to open breached password list: %v", err)
+		}
+		defer f.Close()
+		policy.addBreached(f)
+	}
+	return policy
+}
+
+func (p *PasswordPolicy) addBreached(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if password := strings.TrimSpace(scanner.Text()); password != "" {
+			p.breached[strings.ToLower(password)] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Failed to read breached password list: %v", err)
+	}
+}
+
+// Violations lists every rule password breaks, empty if it is acceptable.
+func (p *PasswordPolicy) Violations(password string) []string {
+	var violations []string
+	if length := utf8.RuneCountInString(password); length < p.MinLength {
+		violations = append(violations, fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	} else if p.MaxLength > 0 && length > p.MaxLength {
+		violations = append(violations, fmt.Sprintf("must be at most %d characters long", p.MaxLength))
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	if p.RequireLower && !lower {
+		violations = append(violations, "must contain a lowercase letter")
+	}
+	if p.RequireUpper && !upper {
+		violations = append(violations, "must contain an uppercase letter")
+	}
+	if p.RequireDigit && !digit {
+		violations = append(violations, "must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		violations = append(violations, "must contain a symbol")
+	}
+	if _, found := p.breached[strings.ToLower(password)]; found {
+		violations = append(violations, "must not be a commonly used or breached password")
+	}
+	return violations
+}
+
+type PasswordPolicyError struct {
+	Violations []string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return "Password " + strings.Join(e.Violations, ", ")
+}
+
+func validatePassword(password string) error {
+	if violations := passwordPolicy.Violations(password); len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+func weakPasswordResponse(c echo.Context, err error) error {
+	var policyErr *PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":      policyErr.Error(),
+			"code":       "weak_password",
+			"violations": policyErr.Violations,
+		})
+	}
+	return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+}
+
+// setPassword stores the new hash and revokes every refresh token of the user
+// so that sessions opened with the old password cannot be extended.
+func setPassword(userID uint, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&User{}).Where("id = ?", userID).Update("password_hash", hash).Error; err != nil {
+			return err
+		}
+		return revokeUserRefreshTokens(tx, userID)
+	})
+	if err != nil {
+		return err
+	}
+
+	publishSecurityEvent("password_changed", userID, nil)
+	return nil
+}
+
+func changePassword(c echo.Context) error {
+	type ChangePasswordRequest struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	var req ChangePasswordRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if err := confirmPassword(c, user, req.CurrentPassword); err != nil {
+		if err == errPasswordInvalid {
+			recordAuthFailure(c, AuthEventPasswordChange, user, "", "invalid_password")
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid current password"})
+		}
+		return confirmPasswordResponse(c, err)
+	}
+	if err := validatePassword(req.NewPassword); err != nil {
+		return weakPasswordResponse(c, err)
+	}
+	if req.NewPassword == req.CurrentPassword {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "New password must differ from the current one"})
+	}
+
+	if err := setPassword(user.ID, req.NewPassword); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to change password"})
+	}
+
+	// The caller proved the password, so this session continues with a fresh family
+	tokenResponse, err := createTokenPair(*user, newSession(c, ""))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate tokens"})
+	}
+	recordAuthSuccess(c, AuthEventPasswordChange, *user, sessionIDOf(tokenResponse))
+
+	return c.JSON(http.StatusOK, tokenResponse)
+}
+
+func requestPasswordReset(c echo.Context) error {
+	type ResetRequest struct {
+		PhoneNumber string `json:"phone_number"`
+	}
+	var req ResetRequest
+	if err := c.Bind(&req); err != nil || !validatePhone(req.PhoneNumber) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	// Unknown numbers get the same answer so the endpoint cannot be used to probe accounts
+	response := map[string]string{"message": "If the number is registered, a reset code has been sent"}
+
+	var user User
+	if err := db.Where("phone_number = ? AND status = ?", req.PhoneNumber, UserStatusActive).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.JSON(http.StatusOK, response)
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	if err := issueVerificationCode(user.ID, PurposePasswordReset, user.PhoneNumber); err != nil {
+		return otpErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func confirmPasswordReset(c echo.Context) error {
+	type ConfirmRequest struct {
+		PhoneNumber string `json:"phone_number"`
+		Code        string `json:"code"`
+		NewPassword string `json:"new_password"`
+	}
+	var req ConfirmRequest
+	if err := c.Bind(&req); err != nil || req.Code == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if err := validatePassword(req.NewPassword); err != nil {
+		return weakPasswordResponse(c, err)
+	}
+
+	var user User
+	if err := db.Where("phone_number = ? AND status = ?", req.PhoneNumber, UserStatusActive).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return otpErrorResponse(c, errOTPNotFound)
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	if _, err := verifyVerificationCode(user.ID, PurposePasswordReset, req.Code); err != nil {
+		recordAuthFailure(c, AuthEventPasswordReset, &user, "", "invalid_code")
+		return otpErrorResponse(c, err)
+	}
+
+	if err := setPassword(user.ID, req.NewPassword); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to reset password"})
+	}
+	recordAuthSuccess(c, AuthEventPasswordReset, user, "")
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Password has been reset, log in with the new password"})
+}
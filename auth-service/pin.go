@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// A transaction PIN is a short numeric code, separate from the login password,
+// that confirms payments. Apps stay logged in for days, so whoever holds the
+// phone holds a session; the PIN is what they still need to send money.
+
+const (
+	PINMinLength        = 4
+	PINMaxLength        = 6
+	pinFailureKeyPrefix = "pin:failures:"
+	pinLockKeyPrefix    = "pin:lock:"
+)
+
+var (
+	PINMaxFailures     = getEnvInt("PIN_MAX_FAILURES", 5)
+	PINFailureWindow   = getEnvDuration("PIN_FAILURE_WINDOW", 24*time.Hour)
+	PINLockoutDuration = getEnvDuration("PIN_LOCKOUT_DURATION", 30*time.Minute)
+)
+
+var (
+	errPINNotSet  = errors.New("transaction PIN is not set")
+	errPINMissing = errors.New("transaction PIN missing")
+	errPINInvalid = errors.New("transaction PIN is incorrect")
+	errPINFormat  = errors.New("PIN must be 4 to 6 digits")
+	errPINWeak    = errors.New("PIN is too easy to guess")
+)
+
+type pinLockedError struct {
+	retryAfter time.Duration
+}
+
+func (e *pinLockedError) Error() string {
+	return "too many wrong PINs, temporarily locked"
+}
+
+// pinReasons are the reason codes reported to the services checking PINs.
+var pinReasons = map[error]string{
+	errPINNotSet:  "not_set",
+	errPINMissing: "missing",
+	errPINInvalid: "invalid",
+}
+
+func pinFailureKey(userID uint) string {
+	return pinFailureKeyPrefix + strconv.FormatUint(uint64(userID), 10)
+}
+
+func pinLockKey(userID uint) string {
+	return pinLockKeyPrefix + strconv.FormatUint(uint64(userID), 10)
+}
+
+// validatePIN accepts 4 to 6 digits, except for repeated digits and runs
+// such as 1234 or 9876.
+func validatePIN(pin string) error {
+	if len(pin) < PINMinLength || len(pin) > PINMaxLength {
+		return errPINFormat
+	}
+	for _, r := range pin {
+		if r < '0' || r > '9' {
+			return errPINFormat
+		}
+	}
+
+	same, up, down := true, true, true
+	for i := 1; i < len(pin); i++ {
+		diff := int(pin[i]) - int(pin[i-1])
+		same = same && diff == 0
+		up = up && diff == 1
+		down = down && diff == -1
+	}
+	if same || up || down {
+		return errPINWeak
+	}
+	return nil
+}
+
+// pinRequired reports whether transfers of user have to be confirmed with the PIN.
+func (u User) pinRequired() bool {
+	return u.PINHash != "" && u.PINRequired
+}
+
+// pinLockRemaining returns how long the PIN of userID stays locked.
+func pinLockRemaining(userID uint) (time.Duration, error) {
+	ttl, err := rdb.PTTL(ctx, pinLockKey(userID)).Result()
+	if err != nil {
+		return 0, err
+	}
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+// pinAttemptsLeft returns how many PINs userID may still enter before the
+// PIN is locked.
+func pinAttemptsLeft(userID uint) int64 {
+	failures, _ := rdb.Get(ctx, pinFailureKey(userID)).Int64()
+	if left := PINMaxFailures - failures; left > 0 {
+		return left
+	}
+	return 0
+}
+
+// reservePINAttempt counts an attempt before the PIN is compared, so guesses
+// sent in parallel cannot all get in under PINMaxFailures, and returns its
+// number. A right PIN clears the count.
+func reservePINAttempt(userID uint) (int64, error) {
+	key := pinFailureKey(userID)
+	attempt, err := rdb.Incr(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if attempt == 1 {
+		rdb.Expire(ctx, key, PINFailureWindow)
+	}
+	return attempt, nil
+}
+
+// lockPIN locks the PIN once the last attempt it allowed was wrong. The
+// attempt count is kept until the lock ends, so guesses that were already
+// past the lock check are refused as well.
+func lockPIN(user *User) error {
+	pipe := rdb.TxPipeline()
+	pipe.Set(ctx, pinLockKey(user.ID), PINMaxFailures, PINLockoutDuration)
+	pipe.Expire(ctx, pinFailureKey(user.ID), PINLockoutDuration)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	publishSecurityEvent("transaction_pin_locked", user.ID, map[string]interface{}{
+		"phone_number": user.PhoneNumber,
+		"locked_until": time.Now().Add(PINLockoutDuration),
+	})
+	return &pinLockedError{retryAfter: PINLockoutDuration}
+}
+
+func resetPINFailures(userID uint) error {
+	return rdb.Del(ctx, pinFailureKey(userID), pinLockKey(userID)).Err()
+}
+
+// verifyPIN checks pin against the PIN of user. Attempts are counted before
+// the PIN is compared, and a locked PIN is refused without being checked.
+func verifyPIN(user *User, pin string) error {
+	if user.PINHash == "" {
+		return errPINNotSet
+	}
+	locked, err := pinLockRemaining(user.ID)
+	if err != nil {
+		return err
+	}
+	if locked > 0 {
+		return &pinLockedError{retryAfter: locked}
+	}
+	if pin == "" {
+		return errPINMissing
+	}
+	attempt, err := reservePINAttempt(user.ID)
+	if err != nil {
+		return err
+	}
+	if attempt > PINMaxFailures {
+		if locked, err := pinLockRemaining(user.ID); err == nil && locked > 0 {
+			return &pinLockedError{retryAfter: locked}
+		}
+		return &pinLockedError{retryAfter: PINLockoutDuration}
+	}
+
+	ok, _, err := verifyPassword(user.PINHash, pin)
+	if err != nil && !errors.Is(err, errUnknownHashFormat) {
+		return err
+	}
+	if !ok {
+		if attempt == PINMaxFailures {
+			return lockPIN(user)
+		}
+		return errPINInvalid
+	}
+	rdb.Del(ctx, pinFailureKey(user.ID))
+	return nil
+}
+
+func pinErrorResponse(c echo.Context, user *User, err error) error {
+	var locked *pinLockedError
+	switch {
+	case errors.As(err, &locked):
+		seconds := int(math.Ceil(locked.retryAfter.Seconds()))
+		c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+		return c.JSON(http.StatusTooManyRequests, map[string]interface{}{
+			"error":       "Too many wrong PINs, try again later",
+			"code":        "transaction_pin_locked",
+			"retry_after": seconds,
+		})
+	case err == errPINInvalid:
+		return c.JSON(http.StatusUnauthorized, map[string]interface{}{
+			"error":         "Incorrect PIN",
+			"code":          "transaction_pin_invalid",
+			"attempts_left": pinAttemptsLeft(user.ID),
+		})
+	case err == errPINMissing:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "PIN is required"})
+	case err == errPINNotSet:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Set a transaction PIN at /pin first"})
+	default:
+		log.Printf("Failed to verify PIN of user %d: %v", user.ID, err)
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "PIN verification temporarily unavailable"})
+	}
+}
+
+func getPINStatus(c echo.Context) error {
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	response := map[string]interface{}{
+		"pin_set":                user.PINHash != "",
+		"required_for_transfers": user.pinRequired(),
+		"set_at":                 user.PINSetAt,
+	}
+	if locked, err := pinLockRemaining(user.ID); err == nil && locked > 0 {
+		response["locked_until"] = time.Now().Add(locked)
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// setPIN sets or replaces the PIN. The password is required every time, so a
+// forgotten or locked PIN can be replaced but not by someone who only holds
+// the phone.
+func setPIN(c echo.Context) error {
+	type SetPINRequest struct {
+		Password             string `json:"password"`
+		PIN                  string `json:"pin"`
+		RequiredForTransfers *bool  `json:"required_for_transfers"`
+	}
+	var req SetPINRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if err := confirmPassword(c, user, req.Password); err != nil {
+		if err == errPasswordInvalid {
+			recordAuthFailure(c, AuthEventTransactionPIN, user, "", "invalid_password")
+		}
+		return confirmPasswordResponse(c, err)
+	}
+	if err := validatePIN(req.PIN); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error(), "code": "invalid_pin"})
+	}
+
+	hash, err := hashPassword(req.PIN)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to set PIN"})
+	}
+	required := true
+	if req.RequiredForTransfers != nil {
+		required = *req.RequiredForTransfers
+	}
+	changed := user.PINHash != ""
+	if err := db.Model(user).Updates(map[string]interface{}{
+		"pin_hash":     hash,
+		"pin_required": required,
+		"pin_set_at":   time.Now(),
+	}).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to set PIN"})
+	}
+	if err := resetPINFailures(user.ID); err != nil {
+		log.Printf("Failed to reset PIN failures of user %d: %v", user.ID, err)
+	}
+
+	eventType := "transaction_pin_set"
+	if changed {
+		eventType = "transaction_pin_changed"
+	}
+	publishSecurityEvent(eventType, user.ID, map[string]interface{}{"phone_number": user.PhoneNumber})
+	sessionID, _ := c.Get("session_id").(string)
+	recordAuthSuccess(c, AuthEventTransactionPIN, *user, sessionID)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message":                "Transaction PIN set",
+		"required_for_transfers": required,
+	})
+}
+
+func removePIN(c echo.Context) error {
+	type RemovePINRequest struct {
+		Password string `json:"password"`
+	}
+	var req RemovePINRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if user.PINHash == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Transaction PIN is not set"})
+	}
+	if err := confirmPassword(c, user, req.Password); err != nil {
+		if err == errPasswordInvalid {
+			recordAuthFailure(c, AuthEventTransactionPIN, user, "", "invalid_password")
+		}
+		return confirmPasswordResponse(c, err)
+	}
+
+	if err := db.Model(user).Updates(map[string]interface{}{"pin_hash": "", "pin_required": false, "pin_set_at": nil}).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to remove PIN"})
+	}
+	if err := resetPINFailures(user.ID); err != nil {
+		log.Printf("Failed to reset PIN failures of user %d: %v", user.ID, err)
+	}
+	publishSecurityEvent("transaction_pin_removed", user.ID, map[string]interface{}{"phone_number": user.PhoneNumber})
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Transaction PIN removed"})
+}
+
+// checkPIN lets the app confirm the PIN before it builds a payment. Wrong
+// PINs count towards the same lockout as those sent with transfers.
+func checkPIN(c echo.Context) error {
+	type CheckPINRequest struct {
+		PIN string `json:"pin"`
+	}
+	var req CheckPINRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if err := verifyPIN(user, req.PIN); err != nil {
+		if err == errPINInvalid {
+			recordAuthFailure(c, AuthEventTransactionPIN, user, "", "invalid_pin")
+		}
+		return pinErrorResponse(c, user, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]bool{"valid": true})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	errRefreshTokenInvalid = errors.New("invalid refresh token")
+	errRefreshTokenRevoked = errors.New("refresh token has been revoked")
+	errRefreshTokenReused  = errors.New("refresh token has already been used")
+	errRefreshTokenExpired = errors.New("refresh token has expired")
+)
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func issueRefreshToken(userID uint, session sessionInfo) (string, error) {
+	refreshTokenString, err := generateRandomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	refreshToken := RefreshToken{
+		UserID:           userID,
+		FamilyID:         session.ID,
+		TokenHash:        hashToken(refreshTokenString),
+		ExpiresAt:        now.Add(RefreshTokenExpiry),
+		ClientID:         session.ClientID,
+		Scope:            session.Scope,
+		DeviceName:       session.DeviceName,
+		DeviceHash:       session.DeviceHash,
+		UserAgent:        session.UserAgent,
+		IPAddress:        session.IPAddress,
+		LastUsedAt:       &now,
+		SessionCreatedAt: session.CreatedAt,
+	}
+	if err := db.Create(&refreshToken).Error; err != nil {
+		return "", err
+	}
+	return refreshTokenString, nil
+}
+
+// claimRefreshToken marks the token as rotated. It returns false if another
+// request already rotated or revoked it, which is treated as reuse.
+func claimRefreshToken(refreshToken RefreshToken) (bool, error) {
+	result := db.Model(&RefreshToken{}).
+		Where("id = ? AND rotated_at IS NULL AND revoked_at IS NULL", refreshToken.ID).
+		Update("rotated_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// redeemRefreshToken consumes a refresh token issued to clientID (empty for
+// first-party logins). Presenting an already rotated token revokes its family.
+// A token that exists but cannot be used is returned with the error so the
+// attempt can be attributed to its owner.
+func redeemRefreshToken(tokenString, clientID string) (*RefreshToken, error) {
+	var refreshToken RefreshToken
+	if err := db.Where("token_hash = ? AND client_id = ?", hashToken(tokenString), clientID).First(&refreshToken).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errRefreshTokenInvalid
+		}
+		return nil, err
+	}
+
+	if refreshToken.RevokedAt != nil {
+		return &refreshToken, errRefreshTokenRevoked
+	}
+	if refreshToken.RotatedAt != nil {
+		handleRefreshTokenReuse(refreshToken)
+		return &refreshToken, errRefreshTokenReused
+	}
+	if time.Now().After(refreshToken.ExpiresAt) {
+		return &refreshToken, errRefreshTokenExpired
+	}
+
+	claimed, err := claimRefreshToken(refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		handleRefreshTokenReuse(refreshToken)
+		return &refreshToken, errRefreshTokenReused
+	}
+	return &refreshToken, nil
+}
+
+func revokeTokenFamily(familyID string) error {
+	return db.Model(&RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+func revokeUserRefreshTokens(tx *gorm.DB, userID uint) error {
+	return tx.Model(&RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+func handleRefreshTokenReuse(refreshToken RefreshToken) {
+	if err := revokeSession(refreshToken.UserID, refreshToken.FamilyID); err != nil {
+		log.Printf("Failed to revoke token family %s: %v", refreshToken.FamilyID, err)
+	}
+	log.Printf("Refresh token reuse detected for user %d, family %s revoked", refreshToken.UserID, refreshToken.FamilyID)
+
+	publishSecurityEvent("refresh_token_reuse", refreshToken.UserID, map[string]interface{}{
+		"family_id": refreshToken.FamilyID,
+	})
+}
+
+func cleanupRefreshTokens() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := db.Where("expires_at < ?", time.Now()).Delete(&RefreshToken{}).Error; err != nil {
+			log.Printf("Failed to clean up refresh tokens: %v", err)
+		}
+	}
+}
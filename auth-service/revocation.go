@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const revokedTokenPrefix = "revoked:jti:"
+
+func claimUserID(claims jwt.MapClaims) uint {
+	userID, _ := claims["user_id"].(float64)
+	return uint(userID)
+}
+
+func claimExpiry(claims jwt.MapClaims) time.Time {
+	exp, _ := claims["exp"].(float64)
+	return time.Unix(int64(exp), 0)
+}
+
+func revokeAccessToken(claims jwt.MapClaims) error {
+	if err := markTokenUsed(claims); err != nil {
+		return err
+	}
+	jti, _ := claims["jti"].(string)
+	publishTokenRevoked(jti, claimUserID(claims), claimExpiry(claims))
+	return nil
+}
+
+// markTokenUsed stores the revocation without broadcasting it; single-use
+// tokens such as MFA challenges are never seen by other services.
+func markTokenUsed(claims jwt.MapClaims) error {
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return errors.New("token has no jti")
+	}
+
+	ttl := time.Until(claimExpiry(claims))
+	if ttl <= 0 {
+		return nil
+	}
+	return rdb.Set(ctx, revokedTokenPrefix+jti, claimUserID(claims), ttl).Err()
+}
+
+// isTokenRevoked reports whether the token itself or the session it belongs to
+// has been revoked. sid is empty for tokens that are not tied to a session.
+func isTokenRevoked(jti, sid string) (bool, error) {
+	keys := []string{revokedTokenPrefix + jti}
+	if sid != "" {
+		keys = append(keys, revokedSessionPrefix+sid)
+	}
+	n, err := rdb.Exists(ctx, keys...).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
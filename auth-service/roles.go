@@ -0,0 +1,155 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/elkin/system-design-final/shared/authz"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// UserRole grants a role on top of the implicit user role every account has.
+type UserRole struct {
+	UserID    uint   `gorm:"primaryKey"`
+	Role      string `gorm:"primaryKey"`
+	GrantedBy *uint
+	CreatedAt time.Time
+}
+
+func userRoles(userID uint) ([]string, error) {
+	var grants []UserRole
+	if err := db.Where("user_id = ?", userID).Find(&grants).Error; err != nil {
+		return nil, err
+	}
+	roles := []string{authz.RoleUser}
+	for _, g := range grants {
+		if g.Role != authz.RoleUser {
+			roles = append(roles, g.Role)
+		}
+	}
+	sort.Strings(roles[1:])
+	return roles, nil
+}
+
+func grantRole(userID uint, role string, grantedBy *uint) error {
+	return db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&UserRole{UserID: userID, Role: role, GrantedBy: grantedBy}).Error
+}
+
+// bootstrapAdmin makes the account with BOOTSTRAP_ADMIN_PHONE an admin so a
+// fresh installation has someone who can assign roles.
+func bootstrapAdmin() {
+	phone := getEnv("BOOTSTRAP_ADMIN_PHONE", "")
+	if phone == "" {
+		return
+	}
+	var user User
+	if err := db.Where("phone_number = ?", phone).First(&user).Error; err != nil {
+		log.Printf("Bootstrap admin %s not found, register it and restart", phone)
+		return
+	}
+	if err := grantRole(user.ID, authz.RoleAdmin, nil); err != nil {
+		log.Printf("Failed to grant admin role to %s: %v", phone, err)
+		return
+	}
+	log.Printf("Granted admin role to user %d", user.ID)
+}
+
+func findUserParam(c echo.Context) (*User, error) {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	var user User
+	if err := db.First(&user, uint(userID)).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func getUserRoles(c echo.Context) error {
+	user, err := findUserParam(c)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+	roles, err := userRoles(user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"user_id": user.ID, "roles": roles})
+}
+
+func assignRole(c echo.Context) error {
+	type AssignRoleRequest struct {
+		Role string `json:"role"`
+	}
+	var req AssignRoleRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if !authz.ValidRole(req.Role) || req.Role == authz.RoleUser {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unknown role"})
+	}
+
+	user, err := findUserParam(c)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+
+	var grantedBy *uint
+	if adminID, ok := authz.UserID(c); ok {
+		grantedBy = &adminID
+	}
+	if err := grantRole(user.ID, req.Role, grantedBy); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to assign role"})
+	}
+
+	publishSecurityEvent("role_granted", user.ID, map[string]interface{}{"role": req.Role, "granted_by": grantedBy})
+
+	return getUserRoles(c)
+}
+
+// removeRole also ends all sessions of the user so that access tokens issued
+// with the old roles stop working immediately.
+func removeRole(c echo.Context) error {
+	user, err := findUserParam(c)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+
+	role := c.Param("role")
+	result := db.Where("user_id = ? AND role = ?", user.ID, role).Delete(&UserRole{})
+	if result.Error != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to remove role"})
+	}
+	if result.RowsAffected == 0 {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User does not have this role"})
+	}
+
+	if err := revokeAllSessions(user.ID); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke sessions"})
+	}
+
+	revokedBy, _ := authz.UserID(c)
+	publishSecurityEvent("role_revoked", user.ID, map[string]interface{}{"role": role, "revoked_by": revokedBy})
+
+	return getUserRoles(c)
+}
+
+func revokeAllSessions(userID uint) error {
+	sessions, err := activeSessions(userID)
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		if err := revokeSession(userID, s.FamilyID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// A session is one refresh token family: it starts at login and survives every
+// rotation until it is revoked or expires. Its ID is the family ID and access
+// tokens carry it in the sid claim.
+
+var maxSessionsPerUser = getEnvInt("MAX_SESSIONS_PER_USER", 10)
+
+const (
+	revokedSessionPrefix = "revoked:sid:"
+	maxDeviceNameLength  = 100
+	maxUserAgentLength   = 255
+)
+
+type sessionInfo struct {
+	ID         string
+	ClientID   string
+	Scope      string
+	DeviceName string
+	DeviceHash string
+	UserAgent  string
+	IPAddress  string
+	CreatedAt  time.Time
+}
+
+func newSession(c echo.Context, deviceName string) sessionInfo {
+	return sessionInfo{
+		DeviceName: truncate(deviceName, maxDeviceNameLength),
+		UserAgent:  truncate(c.Request().UserAgent(), maxUserAgentLength),
+		IPAddress:  c.RealIP(),
+	}
+}
+
+// continueSession keeps the identity of the session a refresh token belongs to
+// while recording where it is being used from now.
+func continueSession(c echo.Context, refreshToken RefreshToken) sessionInfo {
+	return sessionInfo{
+		ID:         refreshToken.FamilyID,
+		ClientID:   refreshToken.ClientID,
+		Scope:      refreshToken.Scope,
+		DeviceName: refreshToken.DeviceName,
+		DeviceHash: refreshToken.DeviceHash,
+		UserAgent:  truncate(c.Request().UserAgent(), maxUserAgentLength),
+		IPAddress:  c.RealIP(),
+		CreatedAt:  refreshToken.SessionCreatedAt,
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+func activeSessions(userID uint) ([]RefreshToken, error) {
+	var tokens []RefreshToken
+	err := db.Where("user_id = ? AND rotated_at IS NULL AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("session_created_at").Find(&tokens).Error
+	return tokens, err
+}
+
+// enforceSessionLimit revokes the oldest sessions once a user has more than
+// MAX_SESSIONS_PER_USER of them. Zero disables the limit.
+func enforceSessionLimit(userID uint) {
+	if maxSessionsPerUser <= 0 {
+		return
+	}
+	sessions, err := activeSessions(userID)
+	if err != nil {
+		log.Printf("Failed to load sessions for user %d: %v", userID, err)
+		return
+	}
+	for i := 0; i < len(sessions)-int(maxSessionsPerUser); i++ {
+		if err := revokeSession(userID, sessions[i].FamilyID); err != nil {
+			log.Printf("Failed to evict session %s: %v", sessions[i].FamilyID, err)
+		}
+	}
+}
+
+// revokeSession revokes the refresh token family and every access token issued
+// for it.
+func revokeSession(userID uint, sessionID string) error {
+	if err := revokeTokenFamily(sessionID); err != nil {
+		return err
+	}
+	if err := rdb.Set(ctx, revokedSessionPrefix+sessionID, userID, AccessTokenExpiry).Err(); err != nil {
+		return err
+	}
+	publishSessionRevoked(sessionID, userID)
+	return nil
+}
+
+func listSessions(c echo.Context) error {
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	sessions, err := activeSessions(user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	current, _ := c.Get("session_id").(string)
+	result := make([]map[string]interface{}, 0, len(sessions))
+	for _, s := range sessions {
+		result = append(result, map[string]interface{}{
+			"id":           s.FamilyID,
+			"client_id":    s.ClientID,
+			"device_name":  s.DeviceName,
+			"user_agent":   s.UserAgent,
+			"ip_address":   s.IPAddress,
+			"created_at":   s.SessionCreatedAt,
+			"last_used_at": s.LastUsedAt,
+			"expires_at":   s.ExpiresAt,
+			"current":      s.FamilyID == current,
+		})
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+func deleteSession(c echo.Context) error {
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	sessionID := c.Param("id")
+	var refreshToken RefreshToken
+	err = db.Where("user_id = ? AND family_id = ? AND revoked_at IS NULL", user.ID, sessionID).First(&refreshToken).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Session not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	if err := revokeSession(user.ID, sessionID); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke session"})
+	}
+	recordAuthSuccess(c, AuthEventSessionRevoked, *user, sessionID)
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Session revoked"})
+}
+
+func revokeOtherSessions(c echo.Context) error {
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+
+	sessions, err := activeSessions(user.ID)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+
+	current, _ := c.Get("session_id").(string)
+	revoked := 0
+	for _, s := range sessions {
+		if s.FamilyID == current {
+			continue
+		}
+		if err := revokeSession(user.ID, s.FamilyID); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke sessions"})
+		}
+		recordAuthSuccess(c, AuthEventSessionRevoked, *user, s.FamilyID)
+		revoked++
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Other sessions revoked", "revoked": revoked})
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+)
+
+// A step-up token proves that the user re-confirmed their identity shortly
+// before a sensitive operation. It is bound to the user, the login session
+// and one operation, and the service performing the operation consumes it
+// from that session. API keys have no session and cannot spend one.
+
+const (
+	TokenTypeStepUp        = "step_up"
+	StepUpTokenExpiry      = 5 * time.Minute
+	StepUpMaxFailures      = 5
+	StepUpFailureWindow    = 15 * time.Minute
+	stepUpFailureKeyPrefix = "stepup:failures:"
+)
+
+const (
+	StepUpMethodPassword = "password"
+	StepUpMethodSMS      = "sms"
+	StepUpMethodPIN      = "pin"
+)
+
+const StepUpOperationTransfer = "transfer"
+
+var stepUpOperations = map[string]bool{
+	StepUpOperationTransfer: true,
+}
+
+var (
+	errStepUpMissing         = errors.New("step-up token missing")
+	errStepUpInvalid         = errors.New("step-up token is invalid or expired")
+	errStepUpWrongUser       = errors.New("step-up token belongs to another user")
+	errStepUpWrongOperation  = errors.New("step-up token was issued for another operation")
+	errStepUpWrongSession    = errors.New("step-up token was issued to another session")
+	errStepUpTooManyFailures = errors.New("too many failed step-up attempts")
+)
+
+// stepUpReasons are the reason codes reported to the services consuming tokens.
+var stepUpReasons = map[error]string{
+	errStepUpMissing:        "missing",
+	errStepUpInvalid:        "invalid",
+	errStepUpWrongUser:      "wrong_user",
+	errStepUpWrongOperation: "wrong_operation",
+	errStepUpWrongSession:   "wrong_session",
+}
+
+// stepUpMethods lists the ways user can re-confirm their identity.
+func stepUpMethods(user *User) []string {
+	methods := []string{StepUpMethodPassword, StepUpMethodSMS}
+	if user.PINHash != "" {
+		methods = append(methods, StepUpMethodPIN)
+	}
+	return methods
+}
+
+func stepUpFailureKey(userID uint) string {
+	return stepUpFailureKeyPrefix + strconv.FormatUint(uint64(userID), 10)
+}
+
+// reserveStepUpAttempt counts a password or code attempt before it is
+// checked, so parallel guesses cannot all get in under StepUpMaxFailures.
+// The counter is per user so a stolen session cannot be used to guess the
+// password, and a successful check clears it. confirmPassword counts every
+// password a signed-in user re-enters on it.
+func reserveStepUpAttempt(userID uint) error {
+	key := stepUpFailureKey(userID)
+	n, err := rdb.Incr(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+	if n == 1 {
+		rdb.Expire(ctx, key, StepUpFailureWindow)
+	}
+	if n > StepUpMaxFailures {
+		return errStepUpTooManyFailures
+	}
+	return nil
+}
+
+// releaseStepUpAttempt gives back an attempt that guessed nothing, such as
+// one sent after the code expired.
+func releaseStepUpAttempt(userID uint) {
+	rdb.Decr(ctx, stepUpFailureKey(userID))
+}
+
+func stepUpLockedResponse(c echo.Context) error {
+	return c.JSON(http.StatusTooManyRequests, map[string]string{"error": "Too many failed attempts, try again later", "code": "step_up_locked"})
+}
+
+func issueStepUpToken(user *User, sessionID, operation, method string) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	return signClaims(jwt.MapClaims{
+		"jti":     jti,
+		"typ":     TokenTypeStepUp,
+		"user_id": user.ID,
+		"sid":     sessionID,
+		"op":      operation,
+		"amr":     method,
+		"exp":     time.Now().Add(StepUpTokenExpiry).Unix(),
+	})
+}
+
+// consumeStepUpToken checks that token was issued to userID in sessionID for
+// operation and marks it used, so every token authorizes a single operation.
+func consumeStepUpToken(token string, userID uint, sessionID, operation string) error {
+	if token == "" {
+		return errStepUpMissing
+	}
+	claims, err := validateTokenOfType(token, TokenTypeStepUp)
+	if err != nil {
+		if errors.Is(err, errRevocationCheckFailed) {
+			return err
+		}
+		return errStepUpInvalid
+	}
+	if claimUserID(claims) != userID {
+		return errStepUpWrongUser
+	}
+	if op, _ := claims["op"].(string); op != operation {
+		return errStepUpWrongOperation
+	}
+	if sid, _ := claims["sid"].(string); sid == "" || sid != sessionID {
+		return errStepUpWrongSession
+	}
+	return markTokenUsed(claims)
+}
+
+func requestStepUpCode(c echo.Context) error {
+	type StepUpCodeRequest struct {
+		Operation string `json:"operation"`
+	}
+	var req StepUpCodeRequest
+	if err := c.Bind(&req); err != nil || !stepUpOperations[req.Operation] {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid operation"})
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if err := issueVerificationCode(user.ID, PurposeStepUp, user.PhoneNumber); err != nil {
+		return otpErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": "Verification code sent"})
+}
+
+func stepUp(c echo.Context) error {
+	type StepUpRequest struct {
+		Operation string `json:"operation"`
+		Method    string `json:"method"`
+		Password  string `json:"password"`
+		Code      string `json:"code"`
+		PIN       string `json:"pin"`
+	}
+	var req StepUpRequest
+	if err := c.Bind(&req); err != nil || !stepUpOperations[req.Operation] {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid operation"})
+	}
+
+	user, err := currentUser(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	methods := stepUpMethods(user)
+	if !slices.Contains(methods, req.Method) {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":   "Unsupported step-up method",
+			"methods": methods,
+		})
+	}
+	// The password and the PIN are throttled by confirmPassword and verifyPIN
+	switch req.Method {
+	case StepUpMethodPassword:
+		if err := confirmPassword(c, user, req.Password); err != nil {
+			if err == errPasswordInvalid {
+				recordAuthFailure(c, AuthEventStepUp, user, "", "invalid_password")
+			}
+			if errors.Is(err, errStepUpTooManyFailures) {
+				return stepUpLockedResponse(c)
+			}
+			return confirmPasswordResponse(c, err)
+		}
+	case StepUpMethodSMS:
+		if err := reserveStepUpAttempt(user.ID); err != nil {
+			if errors.Is(err, errStepUpTooManyFailures) {
+				return stepUpLockedResponse(c)
+			}
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Step-up temporarily unavailable"})
+		}
+		if _, err := verifyVerificationCode(user.ID, PurposeStepUp, req.Code); err != nil {
+			if err == errOTPInvalid {
+				recordAuthFailure(c, AuthEventStepUp, user, "", "invalid_code")
+			} else {
+				releaseStepUpAttempt(user.ID)
+			}
+			return otpErrorResponse(c, err)
+		}
+	case StepUpMethodPIN:
+		if err := verifyPIN(user, req.PIN); err != nil {
+			if err == errPINInvalid {
+				recordAuthFailure(c, AuthEventStepUp, user, "", "invalid_pin")
+			}
+			return pinErrorResponse(c, user, err)
+		}
+	}
+
+	sessionID, _ := c.Get("session_id").(string)
+	token, err := issueStepUpToken(user, sessionID, req.Operation, req.Method)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to issue step-up token"})
+	}
+	if req.Method == StepUpMethodSMS {
+		rdb.Del(ctx, stepUpFailureKey(user.ID))
+	}
+	recordAuthSuccess(c, AuthEventStepUp, *user, sessionID)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"step_up_token": token,
+		"operation":     req.Operation,
+		"expires_in":    StepUpTokenExpiry.Seconds(),
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"strconv"
 
+	"github.com/elkin/system-design-final/shared/money"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
@@ -12,14 +13,22 @@ import (
 
 func checkFraud(c echo.Context) error {
 	type FraudRequest struct {
-		TransactionID int     `json:"transaction_id"`
-		UserID        uint64  `json:"user_id"`
-		Amount        float64 `json:"amount"`
+		TransactionID int    `json:"transaction_id"`
+		UserID        uint64 `json:"user_id"`
+		Amount        string `json:"amount"`
+		Currency      string `json:"currency"`
 	}
 	var req FraudRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 	}
+	if req.Currency == "" {
+		req.Currency = money.DefaultCurrency
+	}
+	amount, err := money.Parse(req.Amount, req.Currency)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid amount: " + err.Error(), "code": "invalid_amount"})
+	}
 
 	rules, err := getAllFraudRules()
 	if err != nil {
@@ -28,7 +37,7 @@ func checkFraud(c echo.Context) error {
 
 	var maxScore float64
 	for _, rule := range rules {
-		score := calculateRiskScore(req.Amount, rule)
+		score := calculateRiskScore(amount, rule)
 		if score > maxScore {
 			maxScore = score
 		}
@@ -203,7 +212,7 @@ func getSuspiciousTransactions(c echo.Context) error {
 			case "user_id", "transaction_id":
 				val, _ := strconv.ParseUint(v, 10, 64)
 				tx[k] = val
-			case "amount", "score":
+			case "score":
 				val, _ := strconv.ParseFloat(v, 64)
 				tx[k] = val
 			default:
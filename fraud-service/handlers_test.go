@@ -48,7 +48,8 @@ func TestCheckTransaction(t *testing.T) {
 	safeReq := &fraudpb.FraudCheckRequest{
 		TransactionId: 1,
 		UserId:        123,
-		Amount:        500.0,
+		AmountMinor:   50000,
+		Currency:      "KZT",
 	}
 	safeResp, err := server.CheckTransaction(context.Background(), safeReq)
 	assert.NoError(t, err)
@@ -58,7 +59,8 @@ func TestCheckTransaction(t *testing.T) {
 	suspiciousReq := &fraudpb.FraudCheckRequest{
 		TransactionId: 2,
 		UserId:        123,
-		Amount:        1500.0,
+		AmountMinor:   150000,
+		Currency:      "KZT",
 	}
 	suspiciousResp, err := server.CheckTransaction(context.Background(), suspiciousReq)
 	assert.NoError(t, err)
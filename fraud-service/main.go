@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"time"
 
+	"github.com/elkin/system-design-final/shared/authz"
 	"github.com/elkin/system-design-final/shared/fraudpb"
+	"github.com/elkin/system-design-final/shared/money"
 	"github.com/go-redis/redis/v8"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -24,12 +27,16 @@ type fraudServer struct {
 }
 
 func (s *fraudServer) CheckTransaction(ctx context.Context, req *fraudpb.FraudCheckRequest) (*fraudpb.FraudCheckResponse, error) {
-	if req.Amount <= 0 {
+	if !money.ValidCurrency(req.Currency) {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported currency %q", req.Currency)
+	}
+	amount := money.New(req.AmountMinor, req.Currency)
+	if !amount.IsPositive() {
 		return nil, status.Errorf(codes.InvalidArgument, "amount must be positive")
 	}
 
-	log.Printf("Fraud check: user_id=%d, amount=%.2f, transaction_id=%d",
-		req.UserId, req.Amount, req.TransactionId)
+	log.Printf("Fraud check: user_id=%d, amount=%s, transaction_id=%d",
+		req.UserId, amount.Format(), req.TransactionId)
 
 	rules, err := getAllFraudRules()
 	if err != nil {
@@ -46,7 +53,7 @@ func (s *fraudServer) CheckTransaction(ctx context.Context, req *fraudpb.FraudCh
 
 	maxScore := 0.0
 	for _, rule := range rules {
-		score := calculateRiskScore(req.Amount, rule)
+		score := calculateRiskScore(amount, rule)
 		if score > maxScore {
 			maxScore = score
 		}
@@ -55,7 +62,7 @@ func (s *fraudServer) CheckTransaction(ctx context.Context, req *fraudpb.FraudCh
 	status := "safe"
 	if maxScore >= 80 {
 		status = "suspicious"
-		saveSuspiciousTransaction(req, maxScore)
+		saveSuspiciousTransaction(req.UserId, req.TransactionId, amount, maxScore)
 	}
 
 	return &fraudpb.FraudCheckResponse{
@@ -64,12 +71,13 @@ func (s *fraudServer) CheckTransaction(ctx context.Context, req *fraudpb.FraudCh
 	}, nil
 }
 
-func saveSuspiciousTransaction(req *fraudpb.FraudCheckRequest, score float64) {
-	key := fmt.Sprintf("suspicious:tx:%d:%d", req.UserId, time.Now().Unix())
+func saveSuspiciousTransaction(userID, transactionID uint64, amount money.Money, score float64) {
+	key := fmt.Sprintf("suspicious:tx:%d:%d", userID, time.Now().Unix())
 	data := map[string]interface{}{
-		"user_id":        req.UserId,
-		"transaction_id": req.TransactionId,
-		"amount":         req.Amount,
+		"user_id":        userID,
+		"transaction_id": transactionID,
+		"amount":         amount.String(),
+		"currency":       amount.Currency,
 		"score":          score,
 		"timestamp":      time.Now().Format(time.RFC3339),
 	}
@@ -107,12 +115,15 @@ func getAllFraudRules() ([]*FraudRule, error) {
 	return rules, nil
 }
 
-func calculateRiskScore(amount float64, rule *FraudRule) float64 {
-	if amount > rule.Threshold {
+// calculateRiskScore compares amount with the rule threshold, which is in
+// whole currency units. Only the score is approximate, never the amount.
+func calculateRiskScore(amount money.Money, rule *FraudRule) float64 {
+	major := amount.Major()
+	if major > rule.Threshold {
 		return 90.0
 	}
 
-	percentage := amount / rule.Threshold
+	percentage := major / rule.Threshold
 	if percentage > 0.8 {
 		return 70.0 + (percentage-0.8)*100.0
 	} else if percentage > 0.5 {
@@ -139,17 +150,32 @@ func main() {
 	}()
 
 	e := echo.New()
+	ipExtractor, err := authz.ClientIPExtractor(getEnv("TRUSTED_PROXIES", ""))
+	if err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES: ", err)
+	}
+	e.IPExtractor = ipExtractor
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 
-	e.POST("/fraud/check", checkFraud)                      
-	e.POST("/rules", createFraudRule)                       
-	e.GET("/rules", getAllRules)                              
-	e.GET("/rules/:id", getRule)                                
-	e.PUT("/rules/:id", updateRule)                              
-	e.DELETE("/rules/:id", deleteRule)                           
-	e.GET("/transactions/suspicious", getSuspiciousTransactions) 
+	api := e.Group("")
+	api.Use(authz.Authenticate(getEnv("AUTH_SERVICE_URL", "http://localhost:8081") + "/check"))
+
+	api.POST("/fraud/check", checkFraud, authz.RequirePermission(authz.PermFraudCheck))
+	api.POST("/rules", createFraudRule, authz.RequirePermission(authz.PermFraudRulesWrite))
+	api.GET("/rules", getAllRules, authz.RequirePermission(authz.PermFraudRulesRead))
+	api.GET("/rules/:id", getRule, authz.RequirePermission(authz.PermFraudRulesRead))
+	api.PUT("/rules/:id", updateRule, authz.RequirePermission(authz.PermFraudRulesWrite))
+	api.DELETE("/rules/:id", deleteRule, authz.RequirePermission(authz.PermFraudRulesWrite))
+	api.GET("/transactions/suspicious", getSuspiciousTransactions, authz.RequirePermission(authz.PermFraudCasesRead))
 
 	log.Println("Fraud REST API server started on :8083")
 	e.Logger.Fatal(e.Start(":8083"))
 }
+
+func getEnv(key, fallback string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return fallback
+}
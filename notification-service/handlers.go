@@ -40,17 +40,18 @@ func sendSMS(phoneNumber, message string) error {
 
 func handleTransactionEvent(msg *nats.Msg) {
 	var event struct {
-		UserID uint    `json:"user_id"`
-		Amount float64 `json:"amount"`
-		Status string  `json:"status"`
-		Phone  string  `json:"phone"`
+		UserID   uint   `json:"user_id"`
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+		Status   string `json:"status"`
+		Phone    string `json:"phone"`
 	}
 	if err := json.Unmarshal(msg.Data, &event); err != nil {
 		log.Printf("Failed to unmarshal event: %v", err)
 		return
 	}
 
-	message := fmt.Sprintf("Transaction status: %s. Amount: %.2f", event.Status, event.Amount)
+	message := fmt.Sprintf("Transaction status: %s. Amount: %s %s", event.Status, event.Amount, event.Currency)
 	if err := sendSMS(event.Phone, message); err != nil {
 		log.Printf("Failed to send SMS to %s: %v", event.Phone, err)
 	} else {
@@ -34,12 +34,28 @@ type Notification struct {
 	SentAt      time.Time `json:"sent_at,omitempty"`
 	DeliveredAt time.Time `json:"delivered_at,omitempty"`
 	ErrorMsg    string    `json:"error_msg,omitempty"`
+	sensitive   bool
+}
+
+type SMSRequest struct {
+	Phone     string `json:"phone"`
+	Message   string `json:"message"`
+	Type      string `json:"type"`
+	Sensitive bool   `json:"sensitive"`
+}
+
+type SecurityEvent struct {
+	Type        string    `json:"type"`
+	UserID      uint64    `json:"user_id"`
+	PhoneNumber string    `json:"phone_number"`
+	Timestamp   time.Time `json:"timestamp"`
 }
 
 type TransactionEvent struct {
 	TransactionID uint64    `json:"transaction_id"`
 	UserID        uint64    `json:"user_id"`
-	Amount        float64   `json:"amount"`
+	Amount        string    `json:"amount"`
+	Currency      string    `json:"currency"`
 	Type          string    `json:"type"`
 	Status        string    `json:"status"`
 	Timestamp     time.Time `json:"timestamp"`
@@ -172,6 +188,24 @@ func subscribeToNATS() {
 		log.Fatalf("Failed to subscribe to 'transaction.status' subject: %v", err)
 	}
 	log.Println("Subscribed to 'transaction.status' events")
+
+	_, err = natsConn.Subscribe("notification.sms", handleSMSRequest)
+	if err != nil {
+		log.Fatalf("Failed to subscribe to 'notification.sms' subject: %v", err)
+	}
+	log.Println("Subscribed to 'notification.sms' requests")
+
+	_, err = natsConn.Subscribe("auth.security", handleSecurityEvent)
+	if err != nil {
+		log.Fatalf("Failed to subscribe to 'auth.security' subject: %v", err)
+	}
+	log.Println("Subscribed to 'auth.security' events")
+
+	_, err = natsConn.Subscribe("user.deleted", handleUserDeleted)
+	if err != nil {
+		log.Fatalf("Failed to subscribe to 'user.deleted' subject: %v", err)
+	}
+	log.Println("Subscribed to 'user.deleted' events")
 }
 
 func handleTransactionEvent(msg *nats.Msg) {
@@ -181,8 +215,8 @@ func handleTransactionEvent(msg *nats.Msg) {
 		return
 	}
 
-	log.Printf("Received transaction event: ID=%d, Type=%s, Amount=%.2f",
-		event.TransactionID, event.Type, event.Amount)
+	log.Printf("Received transaction event: ID=%d, Type=%s, Amount=%s %s",
+		event.TransactionID, event.Type, event.Amount, event.Currency)
 
 	messageTemplate := getNotificationTemplate(event.Type, event.Status)
 
@@ -192,7 +226,7 @@ func handleTransactionEvent(msg *nats.Msg) {
 		phone = fmt.Sprintf("+7%d", event.UserID) 
 	}
 
-	message := strings.ReplaceAll(messageTemplate, "{amount}", fmt.Sprintf("%.2f", event.Amount))
+	message := strings.ReplaceAll(messageTemplate, "{amount}", event.Amount+" "+event.Currency)
 	message = strings.ReplaceAll(message, "{status}", event.Status)
 	message = strings.ReplaceAll(message, "{transaction_id}", fmt.Sprintf("%d", event.TransactionID))
 
@@ -209,18 +243,19 @@ func handleTransactionEvent(msg *nats.Msg) {
 
 func handleTransactionStatusEvent(msg *nats.Msg) {
 	var event struct {
-		UserID uint64  `json:"user_id"`
-		Amount float64 `json:"amount"`
-		Status string  `json:"status"`
-		Phone  string  `json:"phone"`
+		UserID   uint64 `json:"user_id"`
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+		Status   string `json:"status"`
+		Phone    string `json:"phone"`
 	}
 	if err := json.Unmarshal(msg.Data, &event); err != nil {
 		log.Printf("Failed to unmarshal transaction status event: %v", err)
 		return
 	}
 
-	log.Printf("Received transaction status event: UserID=%d, Amount=%.2f, Status=%s",
-		event.UserID, event.Amount, event.Status)
+	log.Printf("Received transaction status event: UserID=%d, Amount=%s %s, Status=%s",
+		event.UserID, event.Amount, event.Currency, event.Status)
 
 	messageTemplate := getStatusNotificationTemplate(event.Status)
 
@@ -229,7 +264,7 @@ func handleTransactionStatusEvent(msg *nats.Msg) {
 		phone = fmt.Sprintf("+7%d", event.UserID) 
 	}
 
-	message := strings.ReplaceAll(messageTemplate, "{amount}", fmt.Sprintf("%.2f", event.Amount))
+	message := strings.ReplaceAll(messageTemplate, "{amount}", event.Amount+" "+event.Currency)
 	message = strings.ReplaceAll(message, "{status}", event.Status)
 
 	notification := &Notification{
@@ -243,10 +278,86 @@ func handleTransactionStatusEvent(msg *nats.Msg) {
 	go sendSMSAsync(notification)
 }
 
+func handleSMSRequest(msg *nats.Msg) {
+	var req SMSRequest
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		log.Printf("Failed to unmarshal SMS request: %v", err)
+		return
+	}
+	if req.Phone == "" || req.Message == "" {
+		log.Printf("Ignoring SMS request without phone or message")
+		return
+	}
+
+	log.Printf("Received SMS request: Type=%s, Recipient=%s", req.Type, req.Phone)
+
+	notification := &Notification{
+		ID:        fmt.Sprintf("sms_%d", time.Now().UnixNano()),
+		Type:      req.Type,
+		Recipient: req.Phone,
+		Content:   req.Message,
+		Status:    "pending",
+		sensitive: req.Sensitive,
+	}
+
+	go sendSMSAsync(notification)
+}
+
+func handleSecurityEvent(msg *nats.Msg) {
+	var event SecurityEvent
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		log.Printf("Failed to unmarshal security event: %v", err)
+		return
+	}
+
+	log.Printf("Received security event: Type=%s, UserID=%d", event.Type, event.UserID)
+
+	message := getSecurityNotificationTemplate(event.Type)
+	if message == "" || event.PhoneNumber == "" {
+		return
+	}
+
+	notification := &Notification{
+		ID:        fmt.Sprintf("security_%d_%d", event.UserID, time.Now().UnixNano()),
+		Type:      "security_" + event.Type,
+		Recipient: event.PhoneNumber,
+		Content:   message,
+		Status:    "pending",
+	}
+
+	go sendSMSAsync(notification)
+}
+
+// handleUserDeleted forgets the notifications sent to a deleted account.
+func handleUserDeleted(msg *nats.Msg) {
+	var event SecurityEvent
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		log.Printf("Failed to unmarshal user deletion: %v", err)
+		return
+	}
+	if event.PhoneNumber == "" {
+		return
+	}
+
+	removed := 0
+	for id, notification := range sentNotifications {
+		if notification.Recipient == event.PhoneNumber {
+			delete(sentNotifications, id)
+			removed++
+		}
+	}
+	log.Printf("Removed %d notifications of deleted user %d", removed, event.UserID)
+}
+
 func sendSMSAsync(notification *Notification) {
+	content := notification.Content
+	if notification.sensitive {
+		// One-time codes must not be readable through /notifications.
+		notification.Content = "[redacted]"
+	}
 	sentNotifications[notification.ID] = notification
 
-	err := sendSMS(notification.Recipient, notification.Content)
+	err := sendSMS(notification.Recipient, content)
 
 	notification.SentAt = time.Now()
 	if err != nil {
@@ -314,11 +425,44 @@ func getNotificationTemplate(eventType, status string) string {
 		return "You have sent {amount} to another user."
 	case "transfer_received":
 		return "You have received {amount} from another user."
+	case "transfer_reversed":
+		return "Transfer {transaction_id} of {amount} has been reversed."
+	case "top_up_reversed":
+		return "Top-up {transaction_id} of {amount} has been reversed."
 	default:
 		return "Transaction {transaction_id}: {status}. Amount: {amount}"
 	}
 }
 
+func getSecurityNotificationTemplate(eventType string) string {
+	switch eventType {
+	case "account_locked":
+		return "Your account was temporarily locked after several failed login attempts. If this was not you, change your password."
+	case "phone_changed":
+		return "The phone number of your account was changed. If this was not you, contact support immediately."
+	case "account_deactivated":
+		return "Your account has been deactivated. If this was not you, contact support."
+	case "api_key_created":
+		return "A new API key was created for your account. If this was not you, revoke it and change your password."
+	case "new_device_login":
+		return "Your account was signed in from a new device. If this was not you, change your password and remove the device."
+	case "impersonation_started":
+		return "A support agent is viewing your account to help you. Contact support if you did not ask for help."
+	case "transaction_pin_set":
+		return "A transaction PIN was set for your account. If this was not you, change your password immediately."
+	case "transaction_pin_changed":
+		return "Your transaction PIN was changed. If this was not you, change your password immediately."
+	case "transaction_pin_removed":
+		return "Your transaction PIN was removed. If this was not you, change your password immediately."
+	case "transaction_pin_locked":
+		return "Your transaction PIN was locked after too many wrong attempts. If this was not you, change your password."
+	case "kyc_tier_changed":
+		return "Your verification level has changed. Your account limits have been updated."
+	default:
+		return ""
+	}
+}
+
 func getStatusNotificationTemplate(status string) string {
 	switch status {
 	case "completed":
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"gorm.io/gorm"
+)
+
+// handleDeletionCheck answers auth-service before it deletes an account: money
+// cannot be left behind, so the balance has to be zero.
+func handleDeletionCheck(msg *nats.Msg) {
+	var request struct {
+		UserID uint `json:"user_id"`
+	}
+	if err := json.Unmarshal(msg.Data, &request); err != nil {
+		log.Printf("Failed to unmarshal deletion check: %v", err)
+		return
+	}
+
+	reply := map[string]interface{}{"allowed": true}
+	var balance Balance
+	err := db.First(&balance, "user_id = ?", request.UserID).Error
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound):
+		log.Printf("Failed to load balance for deletion check of user %d: %v", request.UserID, err)
+		return
+	case err == nil && !balance.Balance.IsZero():
+		reply = map[string]interface{}{"allowed": false, "reason": "Balance must be zero before the account can be deleted"}
+	}
+
+	data, _ := json.Marshal(reply)
+	if err := msg.Respond(data); err != nil {
+		log.Printf("Failed to answer deletion check: %v", err)
+	}
+}
+
+// handleUserDeleted closes the balance of a deleted user so no money can
+// arrive there anymore. Transactions are kept as financial records.
+func handleUserDeleted(msg *nats.Msg) {
+	var event struct {
+		UserID uint `json:"user_id"`
+	}
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		log.Printf("Failed to unmarshal user deletion: %v", err)
+		return
+	}
+
+	if err := db.Model(&Balance{}).Where("user_id = ? AND closed_at IS NULL", event.UserID).
+		Update("closed_at", time.Now()).Error; err != nil {
+		log.Printf("Failed to close balance of deleted user %d: %v", event.UserID, err)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elkin/system-design-final/shared/authpb"
+	"github.com/elkin/system-design-final/shared/authz"
+	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc"
+)
+
+const (
+	authRequestTimeout = 2 * time.Second
+	tokenCacheTTL      = 30 * time.Second
+	tokenCacheMaxSize  = 10000
+)
+
+var authClient authpb.AuthServiceClient
+
+func initAuthClient() {
+	conn, err := grpc.Dial(getEnv("AUTH_GRPC_ADDR", "localhost:50052"),
+		grpc.WithInsecure(),
+		grpc.WithPerRPCCredentials(authz.ServiceToken(getEnv("AUTH_GRPC_TOKEN", ""))),
+		grpc.WithBlock(),
+		grpc.WithTimeout(3*time.Second))
+	if err != nil {
+		log.Fatalf("Failed to connect to auth-service: %v", err)
+	}
+	authClient = authpb.NewAuthServiceClient(conn)
+}
+
+type cachedToken struct {
+	info      *authpb.IntrospectTokenResponse
+	expiresAt time.Time
+}
+
+// tokenCache keeps active introspection results for a short time. Entries are
+// indexed by jti and session so revocation events can drop them early. An API
+// key has one entry per client address, all under the same jti.
+type tokenCache struct {
+	mu        sync.Mutex
+	entries   map[string]cachedToken
+	byJTI     map[string]map[string]struct{}
+	bySession map[string]map[string]struct{}
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{
+		entries:   make(map[string]cachedToken),
+		byJTI:     make(map[string]map[string]struct{}),
+		bySession: make(map[string]map[string]struct{}),
+	}
+}
+
+func addToIndex(index map[string]map[string]struct{}, id, key string) {
+	if id == "" {
+		return
+	}
+	if index[id] == nil {
+		index[id] = make(map[string]struct{})
+	}
+	index[id][key] = struct{}{}
+}
+
+func removeFromIndex(index map[string]map[string]struct{}, id, key string) {
+	if keys := index[id]; keys != nil {
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(index, id)
+		}
+	}
+}
+
+var introspectionCache = newTokenCache()
+
+func (tc *tokenCache) get(key string) (*authpb.IntrospectTokenResponse, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	entry, ok := tc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		tc.remove(key)
+		return nil, false
+	}
+	return entry.info, true
+}
+
+func (tc *tokenCache) put(key string, info *authpb.IntrospectTokenResponse) {
+	expiresAt := time.Now().Add(tokenCacheTTL)
+	if tokenExpiry := time.Unix(info.ExpiresAt, 0); tokenExpiry.Before(expiresAt) {
+		expiresAt = tokenExpiry
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if len(tc.entries) >= tokenCacheMaxSize {
+		tc.pruneExpired()
+	}
+	if len(tc.entries) >= tokenCacheMaxSize {
+		return
+	}
+
+	tc.entries[key] = cachedToken{info: info, expiresAt: expiresAt}
+	addToIndex(tc.byJTI, info.Jti, key)
+	addToIndex(tc.bySession, info.SessionId, key)
+}
+
+func (tc *tokenCache) invalidate(jti, sessionID string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for key := range tc.byJTI[jti] {
+		tc.remove(key)
+	}
+	for key := range tc.bySession[sessionID] {
+		tc.remove(key)
+	}
+}
+
+// remove must be called with mu held.
+func (tc *tokenCache) remove(key string) {
+	entry, ok := tc.entries[key]
+	if !ok {
+		return
+	}
+	delete(tc.entries, key)
+	removeFromIndex(tc.byJTI, entry.info.Jti, key)
+	removeFromIndex(tc.bySession, entry.info.SessionId, key)
+}
+
+func (tc *tokenCache) pruneExpired() {
+	now := time.Now()
+	for key, entry := range tc.entries {
+		if now.After(entry.expiresAt) {
+			tc.remove(key)
+		}
+	}
+}
+
+func cacheKey(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+func introspectToken(tokenString string) (*authpb.IntrospectTokenResponse, error) {
+	key := cacheKey(tokenString)
+	if info, ok := introspectionCache.get(key); ok {
+		return info, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), authRequestTimeout)
+	defer cancel()
+	info, err := authClient.IntrospectToken(ctx, &authpb.IntrospectTokenRequest{Token: tokenString})
+	if err != nil {
+		return nil, err
+	}
+	if info.Active {
+		introspectionCache.put(key, info)
+	}
+	return info, nil
+}
+
+// introspectAPIKey caches per key and client address because the answer
+// depends on the key's IP allowlist.
+func introspectAPIKey(apiKey, ip string) (*authpb.IntrospectTokenResponse, error) {
+	key := cacheKey("apikey", apiKey, ip)
+	if info, ok := introspectionCache.get(key); ok {
+		return info, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), authRequestTimeout)
+	defer cancel()
+	info, err := authClient.IntrospectAPIKey(ctx, &authpb.IntrospectAPIKeyRequest{Key: apiKey, IpAddress: ip})
+	if err != nil {
+		return nil, err
+	}
+	if info.Active {
+		introspectionCache.put(key, info)
+	}
+	return info, nil
+}
+
+func handleTokenRevoked(msg *nats.Msg) {
+	var event struct {
+		JTI string `json:"jti"`
+		SID string `json:"sid"`
+	}
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		log.Printf("Failed to unmarshal token revocation: %v", err)
+		return
+	}
+	introspectionCache.invalidate(event.JTI, event.SID)
+}
+
+// JWTMiddleware authenticates bearer tokens and API keys through auth-service.
+func JWTMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		authHeader := c.Request().Header.Get("Authorization")
+		isAPIKey := strings.HasPrefix(authHeader, "ApiKey ")
+		if !isAPIKey && !strings.HasPrefix(authHeader, "Bearer ") {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Missing or invalid Authorization header"})
+		}
+
+		var info *authpb.IntrospectTokenResponse
+		var err error
+		if isAPIKey {
+			info, err = introspectAPIKey(strings.TrimPrefix(authHeader, "ApiKey "), c.RealIP())
+		} else {
+			info, err = introspectToken(strings.TrimPrefix(authHeader, "Bearer "))
+		}
+		if err != nil {
+			log.Printf("Token introspection failed: %v", err)
+			return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Authentication service unavailable"})
+		}
+		if !info.Active {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token"})
+		}
+
+		c.Set(authz.ContextUserIDKey, uint(info.UserId))
+		c.Set(authz.ContextRolesKey, info.Roles)
+		c.Set(authz.ContextKYCTierKey, info.KycTier)
+		if isAPIKey {
+			c.Set(authz.ContextScopesKey, append([]string{}, info.Scopes...))
+		} else {
+			c.Set(authz.ContextSessionIDKey, info.SessionId)
+		}
+		if info.ActorId != 0 {
+			return impersonatedRequest(c, info, next)
+		}
+		return next(c)
+	}
+}
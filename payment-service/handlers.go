@@ -5,13 +5,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/elkin/system-design-final/shared/fraudpb"
+	"github.com/elkin/system-design-final/shared/money"
 	"github.com/labstack/echo/v4"
 	"github.com/nats-io/nats.go"
 	"google.golang.org/grpc"
@@ -21,6 +20,9 @@ import (
 var fraudClient fraudpb.FraudCheckerClient
 var natsConn *nats.Conn
 
+// Top-ups above this amount are checked by fraud-service before they are credited.
+var topUpFraudCheckThreshold = money.New(1000000, accountCurrency)
+
 func initFraudClient() {
 	conn, err := grpc.Dial("localhost:50051", grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(3*time.Second))
 	if err != nil {
@@ -36,149 +38,87 @@ func initNATS() {
 		log.Fatal("Failed to connect to NATS: ", err)
 	}
 	log.Println("Connected to NATS")
-}
-
-func JWTMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		authHeader := c.Request().Header.Get("Authorization")
-		if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Missing or invalid Authorization header"})
-		}
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-
-		valid, userID, err := validateTokenWithAuthService(tokenString)
-		if err != nil || !valid {
-			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token"})
-		}
-
-		c.Set("user_id", userID)
-		return next(c)
-	}
-}
-
-func validateTokenWithAuthService(tokenString string) (bool, uint, error) {
-	req, err := http.NewRequest("GET", "http://localhost:8081/check", nil)
-	if err != nil {
-		return false, 0, err
-	}
-	req.Header.Set("Authorization", "Bearer "+tokenString)
-
-	client := http.Client{Timeout: 3 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return false, 0, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return false, 0, errors.New("token validation failed")
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return false, 0, err
-	}
 
-	var result map[string]interface{}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return false, 0, err
+	if _, err := natsConn.Subscribe("auth.token.revoked", handleTokenRevoked); err != nil {
+		log.Fatal("Failed to subscribe to token revocations: ", err)
 	}
-
-	valid, ok := result["valid"].(bool)
-	if !ok || !valid {
-		return false, 0, errors.New("invalid token response")
+	if _, err := natsConn.QueueSubscribe("user.deletion.check", "payment-service", handleDeletionCheck); err != nil {
+		log.Fatal("Failed to subscribe to deletion checks: ", err)
 	}
-
-	userIDFloat, ok := result["user_id"].(float64)
-	if !ok {
-		return false, 0, errors.New("user_id not found")
+	if _, err := natsConn.QueueSubscribe("user.deleted", "payment-service", handleUserDeleted); err != nil {
+		log.Fatal("Failed to subscribe to user deletions: ", err)
 	}
-
-	return true, uint(userIDFloat), nil
 }
 
 func topUpBalance(c echo.Context) error {
 	type TopUpRequest struct {
-		UserID uint    `json:"user_id"`
-		Amount float64 `json:"amount"`
+		UserID   uint   `json:"user_id"`
+		Amount   string `json:"amount"`
+		Currency string `json:"currency,omitempty"`
 	}
 	var req TopUpRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 	}
 
-	if req.UserID == 0 || req.Amount <= 0 {
+	amount, err := parseAmount(req.Amount, req.Currency)
+	if err != nil {
+		return invalidAmountResponse(c, err)
+	}
+	if req.UserID == 0 || !amount.IsPositive() {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user_id or amount"})
 	}
 
-	if req.Amount > 10000 {
+	tier, err := accountTier(c, req.UserID)
+	if err != nil {
+		return accountTierError(c, err)
+	}
+	transaction := Transaction{
+		SenderID:        req.UserID,
+		RecipientID:     nil,
+		Amount:          amount,
+		TransactionType: "top_up",
+		Description:     "Balance top-up",
+	}
+	if err := createTransaction(&transaction); err != nil {
+		log.Printf("Failed to create top-up of user %d: %v", req.UserID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update balance"})
+	}
+	c.Set(idempotencyRecordedKey, true)
+
+	if exceeds(amount, topUpFraudCheckThreshold) {
 		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 		defer cancel()
 		fraudResp, err := fraudClient.CheckTransaction(ctx, &fraudpb.FraudCheckRequest{
-			TransactionId: 0,
+			TransactionId: uint64(transaction.ID),
 			UserId:        uint64(req.UserID),
-			Amount:        req.Amount,
+			AmountMinor:   amount.Minor,
+			Currency:      amount.Currency,
 		})
 		if err != nil {
 			log.Printf("Fraud check failed: %v", err)
 		} else if fraudResp.Status == "suspicious" {
-			return c.JSON(http.StatusForbidden, map[string]string{"error": "Suspicious transaction"})
+			return holdTransaction(c, &transaction, map[string]interface{}{"error": "Suspicious transaction"})
 		}
 	}
 
-	tx := db.Begin()
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-		}
-	}()
-
-	var balance Balance
-	if err := tx.Set("gorm:query_option", "FOR UPDATE").First(&balance, "user_id = ?", req.UserID).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			balance = Balance{
-				UserID:  req.UserID,
-				Balance: 0,
-				Version: 1,
-			}
-			if err := tx.Create(&balance).Error; err != nil {
-				tx.Rollback()
-				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create balance"})
-			}
-		} else {
-			tx.Rollback()
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	balance, err := settleTopUp(&transaction, tier, nil)
+	if err != nil {
+		failRefused(&transaction, err)
+		var refused *refusal
+		if errors.As(err, &refused) {
+			return refused.respond(c)
 		}
-	}
-
-	balance.Balance += req.Amount
-	balance.Version++
-	if err := tx.Save(&balance).Error; err != nil {
-		tx.Rollback()
+		log.Printf("Top-up of user %d failed: %v", req.UserID, err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update balance"})
 	}
 
-	transaction := Transaction{
-		SenderID:        req.UserID,
-		RecipientID:     nil,
-		Amount:          req.Amount,
-		Status:          "completed",
-		TransactionType: "top_up",
-		Description:     "Balance top-up",
-	}
-	if err := tx.Create(&transaction).Error; err != nil {
-		tx.Rollback()
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create transaction"})
-	}
-
-	tx.Commit()
-
-	publishTransactionEvent(transaction.ID, req.UserID, req.Amount, "top_up", "completed")
-
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"message":        "Balance updated successfully",
-		"balance":        balance.Balance,
+		"balance":        balance.String(),
+		"currency":       balance.Currency,
 		"transaction_id": transaction.ID,
+		"status":         transaction.Status,
 	})
 }
 
@@ -199,51 +139,96 @@ func getBalance(c echo.Context) error {
 	}
 
 	return c.JSON(http.StatusOK, map[string]interface{}{
-		"user_id": balance.UserID,
-		"balance": balance.Balance,
+		"user_id":  balance.UserID,
+		"balance":  balance.Balance.String(),
+		"currency": balance.Balance.Currency,
 	})
 }
 
 func processTransaction(c echo.Context) error {
 	type TransactionRequest struct {
-		SenderID uint    `json:"sender_id"`
-		Amount   float64 `json:"amount"`
+		SenderID uint   `json:"sender_id"`
+		Amount   string `json:"amount"`
+		Currency string `json:"currency,omitempty"`
 	}
 	var req TransactionRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 	}
+	amount, err := parseAmount(req.Amount, req.Currency)
+	if err != nil {
+		return invalidAmountResponse(c, err)
+	}
+	if req.SenderID == 0 || !amount.IsPositive() {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid sender_id or amount"})
+	}
+	userID, ok := c.Get("user_id").(uint)
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+	}
+	if userID != req.SenderID {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "You can only process your own transactions"})
+	}
+
+	// A payment moves no money here; it is recorded so fraud-service can be
+	// told its ID and an operator can review it if flagged
+	transaction := Transaction{
+		SenderID:        req.SenderID,
+		Amount:          amount,
+		TransactionType: "payment",
+		Description:     "Payment",
+	}
+	if err := createTransaction(&transaction); err != nil {
+		log.Printf("Failed to create payment of user %d: %v", req.SenderID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to process transaction"})
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 	fraudResp, err := fraudClient.CheckTransaction(ctx, &fraudpb.FraudCheckRequest{
-		TransactionId: 0,
+		TransactionId: uint64(transaction.ID),
 		UserId:        uint64(req.SenderID),
-		Amount:        req.Amount,
+		AmountMinor:   amount.Minor,
+		Currency:      amount.Currency,
 	})
 	if err != nil {
+		failRefused(&transaction, err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Fraud check failed"})
 	}
 	if fraudResp.Status == "suspicious" {
-		return c.JSON(http.StatusForbidden, map[string]string{"error": "Suspicious transaction"})
+		return holdTransaction(c, &transaction, map[string]interface{}{"error": "Suspicious transaction"})
+	}
+
+	if err := changeTransactionStatus(&transaction, TransactionCompleted, reasonSettled, nil); err != nil {
+		log.Printf("Failed to complete payment %d: %v", transaction.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to process transaction"})
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{"message": "Transaction processed successfully"})
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message":        "Transaction processed successfully",
+		"transaction_id": transaction.ID,
+		"status":         transaction.Status,
+	})
 }
 
 func transferFunds(c echo.Context) error {
 	type TransferRequest struct {
-		SenderID    uint    `json:"sender_id"`
-		RecipientID uint    `json:"recipient_id"`
-		Amount      float64 `json:"amount"`
-		Description string  `json:"description,omitempty"`
+		SenderID    uint   `json:"sender_id"`
+		RecipientID uint   `json:"recipient_id"`
+		Amount      string `json:"amount"`
+		Currency    string `json:"currency,omitempty"`
+		Description string `json:"description,omitempty"`
 	}
 	var req TransferRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 	}
 
-	if req.Amount <= 0 {
+	amount, err := parseAmount(req.Amount, req.Currency)
+	if err != nil {
+		return invalidAmountResponse(c, err)
+	}
+	if !amount.IsPositive() {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Amount must be positive"})
 	}
 	if req.SenderID == 0 || req.RecipientID == 0 {
@@ -262,60 +247,40 @@ func transferFunds(c echo.Context) error {
 		return c.JSON(http.StatusForbidden, map[string]string{"error": "You can only transfer from your own account"})
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
-	fraudResp, err := fraudClient.CheckTransaction(ctx, &fraudpb.FraudCheckRequest{
-		TransactionId: 0,
-		UserId:        uint64(req.SenderID),
-		Amount:        req.Amount,
-	})
-	if err != nil {
-		log.Printf("Fraud check error: %v", err)
-	} else if fraudResp != nil && fraudResp.Status == "suspicious" {
-		return c.JSON(http.StatusForbidden, map[string]interface{}{
-			"error":       "Transaction flagged as suspicious",
-			"fraud_score": fraudResp.FraudScore,
-		})
+	if ok, err := requireTransactionPIN(c, userID); !ok {
+		return err
 	}
 
-	tx := db.Begin()
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-		}
-	}()
-
-	var sender, recipient Balance
-	if err := tx.Set("gorm:query_option", "FOR UPDATE").First(&sender, "user_id = ?", req.SenderID).Error; err != nil {
-		tx.Rollback()
-		return c.JSON(http.StatusNotFound, map[string]string{"error": "Sender balance not found"})
+	senderTier, err := accountTier(c, req.SenderID)
+	if err != nil {
+		return accountTierError(c, err)
+	}
+	recipientTier, err := accountTier(c, req.RecipientID)
+	if err != nil {
+		return accountTierError(c, err)
 	}
-	if err := tx.Set("gorm:query_option", "FOR UPDATE").FirstOrCreate(&recipient, Balance{UserID: req.RecipientID}).Error; err != nil {
-		tx.Rollback()
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get recipient balance"})
+	senderLimits := limitsFor(senderTier)
+	if exceeds(amount, senderLimits.PerTransaction) {
+		return limitExceededResponse(c, "Transfer exceeds the limits of your verification tier", senderTier, limitPerTransaction, senderLimits.PerTransaction)
 	}
 
-	if sender.Balance < req.Amount {
-		tx.Rollback()
-		return c.JSON(http.StatusBadRequest, map[string]interface{}{
-			"error":    "Insufficient funds",
-			"balance":  sender.Balance,
-			"required": req.Amount,
-		})
+	// A step-up token is single-use, so every refusal that can be decided
+	// now comes first. Once it is consumed the transfer is created; a fraud
+	// hold or a refusal from a balance that changed in the meantime still
+	// uses it up.
+	if err := precheckTransfer(req.SenderID, req.RecipientID, amount, senderTier, recipientTier); err != nil {
+		var refused *refusal
+		if errors.As(err, &refused) {
+			return refused.respond(c)
+		}
+		log.Printf("Transfer check from user %d to user %d failed: %v", req.SenderID, req.RecipientID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Transfer failed"})
 	}
 
-	sender.Balance -= req.Amount
-	recipient.Balance += req.Amount
-	sender.Version++
-	recipient.Version++
-
-	if err := tx.Save(&sender).Error; err != nil {
-		tx.Rollback()
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update sender balance"})
-	}
-	if err := tx.Save(&recipient).Error; err != nil {
-		tx.Rollback()
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update recipient balance"})
+	if exceeds(amount, stepUpThreshold) {
+		if ok, err := requireStepUp(c, userID, stepUpOperationTransfer); !ok {
+			return err
+		}
 	}
 
 	description := "Transfer between users"
@@ -326,28 +291,50 @@ func transferFunds(c echo.Context) error {
 	transaction := Transaction{
 		SenderID:        req.SenderID,
 		RecipientID:     &req.RecipientID,
-		Amount:          req.Amount,
-		Status:          "completed",
+		Amount:          amount,
 		TransactionType: "transfer",
 		Description:     description,
 	}
-
-	if err := tx.Create(&transaction).Error; err != nil {
-		tx.Rollback()
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create transaction record"})
+	if err := createTransaction(&transaction); err != nil {
+		log.Printf("Failed to create transfer from user %d to user %d: %v", req.SenderID, req.RecipientID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Transfer failed"})
 	}
+	c.Set(idempotencyRecordedKey, true)
 
-	if err := tx.Commit().Error; err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to commit transaction"})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	fraudResp, err := fraudClient.CheckTransaction(ctx, &fraudpb.FraudCheckRequest{
+		TransactionId: uint64(transaction.ID),
+		UserId:        uint64(req.SenderID),
+		AmountMinor:   amount.Minor,
+		Currency:      amount.Currency,
+	})
+	if err != nil {
+		log.Printf("Fraud check error: %v", err)
+	} else if fraudResp != nil && fraudResp.Status == "suspicious" {
+		return holdTransaction(c, &transaction, map[string]interface{}{
+			"error":       "Transaction flagged as suspicious",
+			"fraud_score": fraudResp.FraudScore,
+		})
 	}
 
-	publishTransactionEvent(transaction.ID, req.SenderID, req.Amount, "transfer_sent", "completed")
-	publishTransactionEvent(transaction.ID, req.RecipientID, req.Amount, "transfer_received", "completed")
+	senderBalance, err := settleTransfer(&transaction, senderTier, recipientTier, nil)
+	if err != nil {
+		failRefused(&transaction, err)
+		var refused *refusal
+		if errors.As(err, &refused) {
+			return refused.respond(c)
+		}
+		log.Printf("Transfer from user %d to user %d failed: %v", req.SenderID, req.RecipientID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Transfer failed"})
+	}
 
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"message":        "Transfer successful",
 		"transaction_id": transaction.ID,
-		"sender_balance": sender.Balance,
+		"status":         transaction.Status,
+		"sender_balance": senderBalance.String(),
+		"currency":       senderBalance.Currency,
 	})
 }
 
@@ -364,7 +351,7 @@ func getTransactionHistory(c echo.Context) error {
 	return c.JSON(http.StatusOK, transactions)
 }
 
-func checkFraudWithService(senderID uint, amount float64) (*FraudResponse, error) {
+func checkFraudWithService(senderID uint, amount money.Money) (*FraudResponse, error) {
 	type FraudResponse struct {
 		Status string `json:"status"`
 	}
@@ -382,12 +369,14 @@ func checkFraudWithService(senderID uint, amount float64) (*FraudResponse, error
 	return &fraudResp, nil
 }
 
-func publishTransactionStatus(userID uint, amount float64, status, phone string) {
+func publishTransactionStatus(userID uint, amount money.Money, status, phone string) {
 	event := map[string]interface{}{
-		"user_id": userID,
-		"amount":  amount,
-		"status":  status,
-		"phone":   phone,
+		"user_id":      userID,
+		"amount":       amount.String(),
+		"amount_minor": amount.Minor,
+		"currency":     amount.Currency,
+		"status":       status,
+		"phone":        phone,
 	}
 
 	jsonData, err := json.Marshal(event)
@@ -404,7 +393,7 @@ func publishTransactionStatus(userID uint, amount float64, status, phone string)
 	}
 }
 
-func publishTransactionEvent(transactionID uint, userID uint, amount float64, transactionType, status string) {
+func publishTransactionEvent(transactionID uint, userID uint, amount money.Money, transactionType, status string) {
 	if natsConn == nil {
 		log.Println("NATS not initialized")
 		return
@@ -413,7 +402,9 @@ func publishTransactionEvent(transactionID uint, userID uint, amount float64, tr
 	event := map[string]interface{}{
 		"transaction_id": transactionID,
 		"user_id":        userID,
-		"amount":         amount,
+		"amount":         amount.String(),
+		"amount_minor":   amount.Minor,
+		"currency":       amount.Currency,
 		"type":           transactionType,
 		"status":         status,
 		"timestamp":      time.Now(),
@@ -2,14 +2,28 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/elkin/system-design-final/shared/authpb"
+	"github.com/elkin/system-design-final/shared/authz"
+	"github.com/elkin/system-design-final/shared/fraudpb"
+	"github.com/elkin/system-design-final/shared/money"
 	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/grpc"
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
 func setupTestDB() {
@@ -18,14 +32,22 @@ func setupTestDB() {
 	if err != nil {
 		panic(err)
 	}
-	db.AutoMigrate(&Balance{}, &Transaction{})
+	// Every connection to :memory: opens a new, empty database
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(1)
+	db.AutoMigrate(&Balance{}, &Transaction{}, &LedgerAccount{}, &JournalEntry{}, &Posting{}, &IdempotencyKey{}, &TransactionTransition{})
+	authClient = &fakeAuthClient{}
+	fraudClient = &fakeFraudClient{}
 
 	balance := Balance{
 		UserID:  1,
-		Balance: 1000,
+		Balance: money.New(100000, "KZT"),
 		Version: 1,
 	}
 	db.Create(&balance)
+	if err := openLedger(); err != nil {
+		panic(err)
+	}
 }
 
 func TestGetBalance(t *testing.T) {
@@ -50,7 +72,7 @@ func TestGetBalance(t *testing.T) {
 		t.Errorf("Failed to parse response: %v", err)
 	}
 
-	if resp["balance"] != float64(1000) {
+	if resp["balance"] != "1000.00" || resp["currency"] != "KZT" {
 		t.Errorf("Expected balance 1000, got %v", resp["balance"])
 	}
 }
@@ -61,7 +83,7 @@ func TestTopUpBalance(t *testing.T) {
 
 	payload := map[string]interface{}{
 		"user_id": 1,
-		"amount":  500,
+		"amount":  "500",
 	}
 	jsonBytes, _ := json.Marshal(payload)
 	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBytes))
@@ -79,13 +101,13 @@ func TestTopUpBalance(t *testing.T) {
 
 	var balance Balance
 	db.First(&balance, "user_id = ?", 1)
-	if balance.Balance != 1500 {
+	if balance.Balance != money.New(150000, "KZT") {
 		t.Errorf("Expected balance 1500 after top-up, got %v", balance.Balance)
 	}
 
 	var transaction Transaction
 	db.First(&transaction, "sender_id = ? AND transaction_type = ?", 1, "top_up")
-	if transaction.Amount != 500 {
+	if transaction.Amount != money.New(50000, "KZT") {
 		t.Errorf("Expected transaction amount 500, got %v", transaction.Amount)
 	}
 }
@@ -95,7 +117,7 @@ func TestTransferFunds(t *testing.T) {
 
 	recipient := Balance{
 		UserID:  2,
-		Balance: 0,
+		Balance: money.Zero("KZT"),
 		Version: 1,
 	}
 	db.Create(&recipient)
@@ -105,7 +127,7 @@ func TestTransferFunds(t *testing.T) {
 	payload := map[string]interface{}{
 		"sender_id":    1,
 		"recipient_id": 2,
-		"amount":       300,
+		"amount":       "300.00",
 		"description":  "Test transfer",
 	}
 	jsonBytes, _ := json.Marshal(payload)
@@ -128,20 +150,1136 @@ func TestTransferFunds(t *testing.T) {
 	db.First(&senderBalance, "user_id = ?", 1)
 	db.First(&recipientBalance, "user_id = ?", 2)
 
-	if senderBalance.Balance != 700 {
+	if senderBalance.Balance != money.New(70000, "KZT") {
 		t.Errorf("Expected sender balance 700 after transfer, got %v", senderBalance.Balance)
 	}
 
-	if recipientBalance.Balance != 300 {
+	if recipientBalance.Balance != money.New(30000, "KZT") {
 		t.Errorf("Expected recipient balance 300 after transfer, got %v", recipientBalance.Balance)
 	}
 
 	var transaction Transaction
 	db.First(&transaction, "sender_id = ? AND transaction_type = ?", 1, "transfer")
-	if transaction.Amount != 300 {
+	if transaction.Amount != money.New(30000, "KZT") {
 		t.Errorf("Expected transaction amount 300, got %v", transaction.Amount)
 	}
 	if *transaction.RecipientID != 2 {
 		t.Errorf("Expected recipient ID 2, got %v", *transaction.RecipientID)
 	}
 }
+
+func TestHistoryRequiresOwnershipOrPermission(t *testing.T) {
+	setupTestDB()
+	e := echo.New()
+	guarded := authz.RequireSelfOrPermission("user_id", authz.PermTransactionsReadAny)(getTransactionHistory)
+
+	cases := []struct {
+		name   string
+		userID uint
+		roles  []string
+		status int
+	}{
+		{"own history", 1, []string{authz.RoleUser}, http.StatusOK},
+		{"someone else", 2, []string{authz.RoleUser}, http.StatusForbidden},
+		{"support agent", 2, []string{authz.RoleUser, authz.RoleSupport}, http.StatusOK},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("user_id")
+		c.SetParamValues("1")
+		c.Set(authz.ContextUserIDKey, tc.userID)
+		c.Set(authz.ContextRolesKey, tc.roles)
+
+		guarded(c)
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.status, rec.Code)
+		}
+	}
+}
+
+type fakeAuthClient struct {
+	authpb.AuthServiceClient
+	calls    int
+	active   bool
+	tiers    map[uint64]string
+	actor    uint64
+	readOnly bool
+	pin      string
+	// allowedIP, when set, is the only address API keys may be used from
+	allowedIP string
+}
+
+// GetUser reports users as fully verified unless a test sets their tier.
+func (f *fakeAuthClient) GetUser(ctx context.Context, in *authpb.GetUserRequest, opts ...grpc.CallOption) (*authpb.GetUserResponse, error) {
+	tier, ok := f.tiers[in.UserId]
+	if !ok {
+		tier = authz.KYCTierFull
+	}
+	return &authpb.GetUserResponse{UserId: in.UserId, KycTier: tier}, nil
+}
+
+func (f *fakeAuthClient) IntrospectToken(ctx context.Context, in *authpb.IntrospectTokenRequest, opts ...grpc.CallOption) (*authpb.IntrospectTokenResponse, error) {
+	f.calls++
+	if !f.active {
+		return &authpb.IntrospectTokenResponse{Active: false}, nil
+	}
+	return &authpb.IntrospectTokenResponse{
+		Active:    true,
+		UserId:    1,
+		Roles:     []string{authz.RoleUser},
+		Jti:       "jti-1",
+		SessionId: "sid-1",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		ActorId:   f.actor,
+		ReadOnly:  f.readOnly,
+	}, nil
+}
+
+func (f *fakeAuthClient) IntrospectAPIKey(ctx context.Context, in *authpb.IntrospectAPIKeyRequest, opts ...grpc.CallOption) (*authpb.IntrospectTokenResponse, error) {
+	f.calls++
+	if !f.active || (f.allowedIP != "" && in.IpAddress != f.allowedIP) {
+		return &authpb.IntrospectTokenResponse{Active: false}, nil
+	}
+	return &authpb.IntrospectTokenResponse{
+		Active:    true,
+		UserId:    1,
+		Roles:     []string{authz.RoleUser, authz.RoleSupport},
+		Jti:       "apikey:7",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		Scopes:    []string{authz.PermTransactionsCreate},
+	}, nil
+}
+
+func (f *fakeAuthClient) ConsumeStepUpToken(ctx context.Context, in *authpb.ConsumeStepUpTokenRequest, opts ...grpc.CallOption) (*authpb.ConsumeStepUpTokenResponse, error) {
+	f.calls++
+	if in.Token == "step-up-ok" && in.UserId == 1 && in.Operation == stepUpOperationTransfer && in.SessionId == "sid-1" {
+		return &authpb.ConsumeStepUpTokenResponse{Valid: true}, nil
+	}
+	return &authpb.ConsumeStepUpTokenResponse{Reason: "missing", Methods: []string{"password", "sms"}}, nil
+}
+
+// VerifyTransactionPIN asks for a PIN only when a test sets one.
+func (f *fakeAuthClient) VerifyTransactionPIN(ctx context.Context, in *authpb.VerifyTransactionPINRequest, opts ...grpc.CallOption) (*authpb.VerifyTransactionPINResponse, error) {
+	switch {
+	case f.pin == "":
+		return &authpb.VerifyTransactionPINResponse{Required: false}, nil
+	case in.Pin == f.pin:
+		return &authpb.VerifyTransactionPINResponse{Required: true, Valid: true}, nil
+	case in.Pin == "":
+		return &authpb.VerifyTransactionPINResponse{Required: true, Reason: "missing"}, nil
+	default:
+		return &authpb.VerifyTransactionPINResponse{Required: true, Reason: "invalid", AttemptsLeft: 4}, nil
+	}
+}
+
+type fakeFraudClient struct {
+	fraudpb.FraudCheckerClient
+	suspicious     bool
+	mu             sync.Mutex
+	transactionIDs []uint64
+}
+
+func (f *fakeFraudClient) CheckTransaction(ctx context.Context, in *fraudpb.FraudCheckRequest, opts ...grpc.CallOption) (*fraudpb.FraudCheckResponse, error) {
+	f.mu.Lock()
+	f.transactionIDs = append(f.transactionIDs, in.TransactionId)
+	f.mu.Unlock()
+	if f.suspicious {
+		return &fraudpb.FraudCheckResponse{Status: "suspicious", FraudScore: 90}, nil
+	}
+	return &fraudpb.FraudCheckResponse{Status: "safe"}, nil
+}
+
+func TestJWTMiddlewareCachesIntrospection(t *testing.T) {
+	fake := &fakeAuthClient{active: true}
+	authClient = fake
+	introspectionCache = newTokenCache()
+	e := echo.New()
+
+	call := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		JWTMiddleware(func(c echo.Context) error {
+			if id, _ := authz.UserID(c); id != 1 {
+				t.Errorf("expected user 1 in context, got %v", c.Get("user_id"))
+			}
+			return c.NoContent(http.StatusOK)
+		})(e.NewContext(req, rec))
+		return rec.Code
+	}
+
+	if code := call("token-a"); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	call("token-a")
+	if fake.calls != 1 {
+		t.Errorf("expected the second request to be served from cache, got %d calls", fake.calls)
+	}
+
+	handleTokenRevoked(&nats.Msg{Data: []byte(`{"sid":"sid-1"}`)})
+	fake.active = false
+	if code := call("token-a"); code != http.StatusUnauthorized {
+		t.Errorf("expected revoked token to be rejected, got %d", code)
+	}
+	if fake.calls != 2 {
+		t.Errorf("expected revocation to drop the cached result, got %d calls", fake.calls)
+	}
+
+	call("token-a")
+	if fake.calls != 3 {
+		t.Errorf("inactive results must not be cached, got %d calls", fake.calls)
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	setupTestDB()
+	fake := &fakeAuthClient{active: true}
+	authClient = fake
+	introspectionCache = newTokenCache()
+	e := echo.New()
+
+	call := func(ip string, handler echo.HandlerFunc, middleware echo.MiddlewareFunc) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "ApiKey pk_abc_def")
+		req.Header.Set(echo.HeaderXRealIP, ip)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("user_id")
+		c.SetParamValues("2")
+		JWTMiddleware(middleware(handler))(c)
+		return rec.Code
+	}
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+
+	if code := call("10.0.0.1", ok, authz.RequirePermission(authz.PermTransactionsCreate)); code != http.StatusOK {
+		t.Errorf("expected the key to use its scope, got %d", code)
+	}
+	if code := call("10.0.0.1", getTransactionHistory, authz.RequireSelfOrPermission("user_id", authz.PermTransactionsReadAny)); code != http.StatusForbidden {
+		t.Errorf("expected a role permission outside the key's scopes to be refused, got %d", code)
+	}
+
+	call("10.0.0.2", ok, authz.RequirePermission(authz.PermTransactionsCreate))
+	if fake.calls != 2 {
+		t.Errorf("expected one introspection per client address, got %d calls", fake.calls)
+	}
+	handleTokenRevoked(&nats.Msg{Data: []byte(`{"jti":"apikey:7"}`)})
+	if len(introspectionCache.entries) != 0 {
+		t.Errorf("expected revocation to drop the key for every address, %d entries left", len(introspectionCache.entries))
+	}
+}
+
+func TestAPIKeyAllowlistIgnoresSpoofedForwardedFor(t *testing.T) {
+	setupTestDB()
+	authClient = &fakeAuthClient{active: true, allowedIP: "192.168.1.20"}
+	introspectionCache = newTokenCache()
+	e := echo.New()
+	extractor, err := authz.ClientIPExtractor("10.0.0.2")
+	if err != nil {
+		t.Fatalf("ClientIPExtractor error: %v", err)
+	}
+	e.IPExtractor = extractor
+
+	call := func(remoteAddr, forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "ApiKey pk_abc_def")
+		req.Header.Set(echo.HeaderXForwardedFor, forwardedFor)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		JWTMiddleware(func(c echo.Context) error { return c.NoContent(http.StatusOK) })(e.NewContext(req, rec))
+		return rec.Code
+	}
+
+	if code := call("203.0.113.7:5000", "192.168.1.20"); code != http.StatusUnauthorized {
+		t.Errorf("expected a spoofed header sent straight to the service to be ignored, got %d", code)
+	}
+	if code := call("10.0.0.2:5000", "192.168.1.20, 203.0.113.7"); code != http.StatusUnauthorized {
+		t.Errorf("expected a spoofed entry before the one nginx added to be ignored, got %d", code)
+	}
+	if code := call("10.0.0.2:5000", "192.168.1.20"); code != http.StatusOK {
+		t.Errorf("expected the address nginx saw to be allowed, got %d", code)
+	}
+}
+
+func TestDeletedUserBalanceIsClosed(t *testing.T) {
+	setupTestDB()
+	e := echo.New()
+
+	handleUserDeleted(&nats.Msg{Data: []byte(`{"user_id":1}`)})
+
+	jsonBytes, _ := json.Marshal(map[string]interface{}{"user_id": 1, "amount": "100"})
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBytes))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	topUpBalance(e.NewContext(req, rec))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected top-up of a closed balance to be refused, got %d", rec.Code)
+	}
+}
+
+func TestTransferAboveThresholdRequiresStepUp(t *testing.T) {
+	setupTestDB()
+	fake := &fakeAuthClient{active: true}
+	authClient = fake
+	fraudClient = &fakeFraudClient{}
+	e := echo.New()
+	sessionID := "sid-1"
+
+	transfer := func(amount string, stepUpToken string) *httptest.ResponseRecorder {
+		jsonBytes, _ := json.Marshal(map[string]interface{}{"sender_id": 1, "recipient_id": 2, "amount": amount})
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBytes))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if stepUpToken != "" {
+			req.Header.Set(stepUpHeader, stepUpToken)
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("user_id", uint(1))
+		c.Set(authz.ContextSessionIDKey, sessionID)
+		transferFunds(c)
+		return rec
+	}
+
+	// Enough money for a transfer just above the threshold
+	above, _ := stepUpThreshold.Add(money.New(50000, accountCurrency))
+	topUp, _ := json.Marshal(map[string]interface{}{"user_id": 1, "amount": "1000"})
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(topUp))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if rec := httptest.NewRecorder(); topUpBalance(e.NewContext(req, rec)) != nil || rec.Code != http.StatusOK {
+		t.Fatalf("top-up failed: %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec := transfer(above.String(), "")
+	var body struct {
+		Code    string   `json:"code"`
+		Methods []string `json:"methods"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusForbidden || body.Code != "step_up_required" || len(body.Methods) == 0 {
+		t.Fatalf("expected step_up_required with methods, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// A transfer that would be refused anyway does not use up the token
+	tooMuch, _ := above.Add(money.New(100000, accountCurrency))
+	calls := fake.calls
+	if rec := transfer(tooMuch.String(), "step-up-ok"); rec.Code != http.StatusBadRequest || fake.calls != calls {
+		t.Errorf("expected insufficient funds before the step-up token is consumed, got %d with %d step-up calls", rec.Code, fake.calls-calls)
+	}
+
+	// A token is only spent from the session it was issued to
+	sessionID = "sid-2"
+	if rec := transfer(above.String(), "step-up-ok"); rec.Code != http.StatusForbidden {
+		t.Errorf("expected a step-up token from another session to be refused, got %d %s", rec.Code, rec.Body.String())
+	}
+	sessionID = "sid-1"
+	if rec := transfer(above.String(), "step-up-ok"); rec.Code != http.StatusOK {
+		t.Errorf("expected the transfer to go through with a step-up token, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	calls = fake.calls
+	if rec := transfer("100", ""); rec.Code != http.StatusOK || fake.calls != calls {
+		t.Errorf("expected a small transfer without step-up, got %d with %d step-up calls", rec.Code, fake.calls-calls)
+	}
+}
+
+func TestKYCTierLimits(t *testing.T) {
+	setupTestDB()
+	authClient = &fakeAuthClient{tiers: map[uint64]string{2: authz.KYCTierUnverified}}
+	fraudClient = &fakeFraudClient{}
+	e := echo.New()
+
+	call := func(handler echo.HandlerFunc, tier string, body map[string]interface{}) (int, map[string]interface{}) {
+		jsonBytes, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBytes))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set(authz.ContextUserIDKey, uint(1))
+		c.Set(authz.ContextKYCTierKey, tier)
+		handler(c)
+		var resp map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+	expectLimit := func(name string, code int, resp map[string]interface{}, limit string) {
+		t.Helper()
+		if code != http.StatusForbidden || resp["code"] != "kyc_limit_exceeded" || resp["limit"] != limit {
+			t.Errorf("%s: expected the %s limit, got %d %v", name, limit, code, resp)
+		}
+	}
+
+	code, resp := call(topUpBalance, authz.KYCTierUnverified, map[string]interface{}{"user_id": 1, "amount": "150"})
+	expectLimit("unverified top-up", code, resp, limitPerTransaction)
+
+	// User 1 already holds 1000, above the unverified balance cap
+	code, resp = call(topUpBalance, authz.KYCTierUnverified, map[string]interface{}{"user_id": 1, "amount": "50"})
+	expectLimit("unverified balance", code, resp, limitBalance)
+
+	if code, resp := call(topUpBalance, authz.KYCTierBasic, map[string]interface{}{"user_id": 1, "amount": "900"}); code != http.StatusOK {
+		t.Fatalf("expected a basic top-up to pass, got %d %v", code, resp)
+	}
+	transfer := map[string]interface{}{"sender_id": 1, "recipient_id": 3, "amount": "900"}
+	if code, resp := call(transferFunds, authz.KYCTierBasic, transfer); code != http.StatusOK {
+		t.Fatalf("expected a basic transfer to pass, got %d %v", code, resp)
+	}
+	// The recipient's own tier caps what they may hold
+	code, resp = call(transferFunds, authz.KYCTierBasic, map[string]interface{}{"sender_id": 1, "recipient_id": 2, "amount": "600"})
+	expectLimit("recipient balance", code, resp, limitBalance)
+	if resp["tier"] != authz.KYCTierUnverified {
+		t.Errorf("expected the recipient's tier in the error, got %v", resp["tier"])
+	}
+
+	for i := 0; i < 3; i++ {
+		call(topUpBalance, authz.KYCTierBasic, map[string]interface{}{"user_id": 1, "amount": "900"})
+		call(transferFunds, authz.KYCTierBasic, transfer)
+	}
+	// 3600 topped up and 3600 sent within a day
+	code, resp = call(transferFunds, authz.KYCTierBasic, transfer)
+	expectLimit("basic daily", code, resp, limitDaily)
+}
+
+func TestImpersonationCannotMoveMoney(t *testing.T) {
+	setupTestDB()
+	e := echo.New()
+
+	call := func(readOnly bool, method string, handler echo.HandlerFunc) *httptest.ResponseRecorder {
+		authClient = &fakeAuthClient{active: true, actor: 42, readOnly: readOnly}
+		introspectionCache = newTokenCache()
+		jsonBytes, _ := json.Marshal(map[string]interface{}{"user_id": 1, "amount": "10"})
+		req := httptest.NewRequest(method, "/", bytes.NewReader(jsonBytes))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("Authorization", "Bearer impersonation")
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("user_id")
+		c.SetParamValues("1")
+		JWTMiddleware(handler)(c)
+		return rec
+	}
+
+	if rec := call(true, http.MethodGet, getBalance); rec.Code != http.StatusOK {
+		t.Errorf("expected the agent to read the balance, got %d", rec.Code)
+	}
+	if rec := call(true, http.MethodPost, authz.RefuseImpersonation(topUpBalance)); rec.Code != http.StatusForbidden || !bytes.Contains(rec.Body.Bytes(), []byte("impersonation_read_only")) {
+		t.Errorf("expected a read-only token to be refused, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := call(false, http.MethodPost, authz.RefuseImpersonation(topUpBalance)); rec.Code != http.StatusForbidden || !bytes.Contains(rec.Body.Bytes(), []byte("impersonation_forbidden")) {
+		t.Errorf("expected money movement to be refused while impersonating, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	var balance Balance
+	db.First(&balance, "user_id = ?", 1)
+	if balance.Balance != money.New(100000, "KZT") {
+		t.Errorf("expected the balance to stay at 1000, got %v", balance.Balance)
+	}
+}
+
+func TestTransferRequiresTransactionPIN(t *testing.T) {
+	setupTestDB()
+	authClient = &fakeAuthClient{active: true, pin: "2580"}
+	fraudClient = &fakeFraudClient{}
+	e := echo.New()
+
+	transfer := func(pin string, apiKey bool) *httptest.ResponseRecorder {
+		jsonBytes, _ := json.Marshal(map[string]interface{}{"sender_id": 1, "recipient_id": 2, "amount": "10"})
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBytes))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if pin != "" {
+			req.Header.Set(transactionPINHeader, pin)
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("user_id", uint(1))
+		if apiKey {
+			c.Set(authz.ContextScopesKey, []string{authz.PermTransactionsCreate})
+		}
+		transferFunds(c)
+		return rec
+	}
+
+	var body struct {
+		Code         string `json:"code"`
+		AttemptsLeft int    `json:"attempts_left"`
+	}
+	rec := transfer("", false)
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusForbidden || body.Code != "transaction_pin_required" {
+		t.Errorf("expected transaction_pin_required, got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = transfer("1111", false)
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusForbidden || body.Code != "transaction_pin_invalid" || body.AttemptsLeft != 4 {
+		t.Errorf("expected transaction_pin_invalid with attempts left, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := transfer("2580", false); rec.Code != http.StatusOK {
+		t.Errorf("expected the transfer with the right PIN to succeed, got %d %s", rec.Code, rec.Body.String())
+	}
+	// Any session can create an API key, so keys need the PIN as well
+	if rec := transfer("", true); rec.Code != http.StatusForbidden || !bytes.Contains(rec.Body.Bytes(), []byte("transaction_pin_required")) {
+		t.Errorf("expected API keys to need the PIN, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := transfer("2580", true); rec.Code != http.StatusOK {
+		t.Errorf("expected an API key with the PIN to transfer, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAmountsAreExact(t *testing.T) {
+	setupTestDB()
+	e := echo.New()
+
+	topUp := func(amount interface{}) *httptest.ResponseRecorder {
+		jsonBytes, _ := json.Marshal(map[string]interface{}{"user_id": 1, "amount": amount})
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBytes))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		topUpBalance(e.NewContext(req, rec))
+		return rec
+	}
+
+	for _, amount := range []interface{}{"10.001", "1e3", "12,50", ".5", "", 10.5} {
+		if rec := topUp(amount); rec.Code != http.StatusBadRequest {
+			t.Errorf("expected %#v to be rejected, got %d %s", amount, rec.Code, rec.Body.String())
+		}
+	}
+
+	// Ten top-ups of 0.10 add up to exactly 1.00, which floats do not
+	for i := 0; i < 10; i++ {
+		if rec := topUp("0.10"); rec.Code != http.StatusOK {
+			t.Fatalf("expected top-up to pass, got %d %s", rec.Code, rec.Body.String())
+		}
+	}
+	var balance Balance
+	db.First(&balance, "user_id = ?", 1)
+	if balance.Balance != money.New(100100, "KZT") {
+		t.Errorf("expected 1001.00 KZT, got %s", balance.Balance.Format())
+	}
+
+	// A row that does not name its currency is refused, not labelled KZT
+	if err := db.Create(&Balance{UserID: 5, Balance: money.Money{Minor: 100}}).Error; err == nil {
+		t.Errorf("expected a balance without a currency to be refused")
+	}
+}
+
+func TestLedgerKeepsMoneyBalanced(t *testing.T) {
+	setupTestDB()
+	e := echo.New()
+
+	post := func(handler echo.HandlerFunc, body map[string]interface{}) {
+		t.Helper()
+		jsonBytes, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBytes))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("user_id", uint(1))
+		handler(c)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected %v to pass, got %d %s", body, rec.Code, rec.Body.String())
+		}
+	}
+	post(topUpBalance, map[string]interface{}{"user_id": 1, "amount": "250.50"})
+	post(transferFunds, map[string]interface{}{"sender_id": 1, "recipient_id": 2, "amount": "100.25"})
+
+	var total int64
+	db.Model(&Posting{}).Select("SUM(amount_minor)").Scan(&total)
+	if total != 0 {
+		t.Errorf("expected postings to sum to zero, got %d", total)
+	}
+	funding, _ := systemLedgerAccount(db, externalFundingAccount, "KZT")
+	var funded int64
+	db.Model(&Posting{}).Select("SUM(amount_minor)").Where("account_id = ?", funding.ID).Scan(&funded)
+	if funded != -25050 {
+		t.Errorf("expected the top-up to come from external funding, got %d", funded)
+	}
+
+	check := func() ledgerReport {
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+		c.Set(authz.ContextRolesKey, []string{authz.RoleAdmin})
+		authz.RequirePermission(authz.PermLedgerAudit)(getLedgerCheck)(c)
+		var report ledgerReport
+		json.Unmarshal(rec.Body.Bytes(), &report)
+		return report
+	}
+	if report := check(); !report.Consistent || report.AccountsChecked != 2 {
+		t.Errorf("expected a consistent ledger over 2 accounts, got %+v", report)
+	}
+
+	db.Model(&Balance{}).Where("user_id = ?", 2).Update("balance_minor", 20000)
+	report := check()
+	if report.Consistent || len(report.Drift) != 1 || report.Drift[0].UserID != 2 || report.Drift[0].Difference != "99.75" {
+		t.Errorf("expected drift of 99.75 on user 2, got %+v", report)
+	}
+
+	unbalanced := []ledgerLeg{{account: funding, amount: money.New(100, "KZT")}, {account: funding, amount: money.New(-99, "KZT")}}
+	if err := postJournalEntry(db, &JournalEntry{}, unbalanced); err != errUnbalancedEntry {
+		t.Errorf("expected an unbalanced entry to be refused, got %v", err)
+	}
+}
+
+func TestIdempotencyKeyReplaysTransfers(t *testing.T) {
+	setupTestDB()
+	e := echo.New()
+
+	transfer := func(key, amount string) *httptest.ResponseRecorder {
+		jsonBytes, _ := json.Marshal(map[string]interface{}{"sender_id": 1, "recipient_id": 2, "amount": amount})
+		req := httptest.NewRequest(http.MethodPost, "/transactions/transfer", bytes.NewReader(jsonBytes))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(idempotencyHeader, key)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("user_id", uint(1))
+		Idempotent(transferFunds)(c)
+		return rec
+	}
+	senderBalance := func() money.Money {
+		var balance Balance
+		db.First(&balance, "user_id = ?", 1)
+		return balance.Balance
+	}
+
+	first := transfer("retry-1", "100")
+	if first.Code != http.StatusOK {
+		t.Fatalf("expected the transfer to pass, got %d %s", first.Code, first.Body.String())
+	}
+	replay := transfer("retry-1", "100")
+	if replay.Code != http.StatusOK || replay.Body.String() != first.Body.String() || replay.Header().Get(idempotencyReplayHeader) != "true" {
+		t.Errorf("expected the original response to be replayed, got %d %s", replay.Code, replay.Body.String())
+	}
+	if rec := transfer("retry-1", "200"); rec.Code != http.StatusConflict || !bytes.Contains(rec.Body.Bytes(), []byte("idempotency_key_reused")) {
+		t.Errorf("expected a different body with the same key to conflict, got %d %s", rec.Code, rec.Body.String())
+	}
+	if balance := senderBalance(); balance != money.New(90000, "KZT") {
+		t.Errorf("expected one transfer of 100, balance is %s", balance.Format())
+	}
+
+	// Duplicates arriving together wait for the first one and move money once
+	codes := make(chan int, 10)
+	for i := 0; i < cap(codes); i++ {
+		go func() { codes <- transfer("retry-2", "50").Code }()
+	}
+	for i := 0; i < cap(codes); i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("expected every duplicate to get the original response, got %d", code)
+		}
+	}
+	if balance := senderBalance(); balance != money.New(85000, "KZT") {
+		t.Errorf("expected one more transfer of 50, balance is %s", balance.Format())
+	}
+}
+
+func TestIdempotencyKeyIsReleasedForMissingCredentials(t *testing.T) {
+	setupTestDB()
+	authClient = &fakeAuthClient{active: true, pin: "2580"}
+	fraud := &fakeFraudClient{}
+	fraudClient = fraud
+	e := echo.New()
+
+	transfer := func(key, amount string, headers map[string]string) *httptest.ResponseRecorder {
+		jsonBytes, _ := json.Marshal(map[string]interface{}{"sender_id": 1, "recipient_id": 2, "amount": amount})
+		req := httptest.NewRequest(http.MethodPost, "/transactions/transfer", bytes.NewReader(jsonBytes))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(idempotencyHeader, key)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("user_id", uint(1))
+		c.Set(authz.ContextSessionIDKey, "sid-1")
+		Idempotent(transferFunds)(c)
+		return rec
+	}
+
+	// The retry that brings the PIN is run, not answered with the refusal
+	if rec := transfer("pin-1", "10", nil); rec.Code != http.StatusForbidden || !bytes.Contains(rec.Body.Bytes(), []byte("transaction_pin_required")) {
+		t.Fatalf("expected transaction_pin_required, got %d %s", rec.Code, rec.Body.String())
+	}
+	pin := map[string]string{transactionPINHeader: "2580"}
+	if rec := transfer("pin-1", "10", pin); rec.Code != http.StatusOK || rec.Header().Get(idempotencyReplayHeader) != "" {
+		t.Errorf("expected the retry with a PIN to run, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Same for the step-up token, once the PIN is given
+	above, _ := stepUpThreshold.Add(money.New(100, accountCurrency))
+	topUp, _ := json.Marshal(map[string]interface{}{"user_id": 1, "amount": "1000"})
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(topUp))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if rec := httptest.NewRecorder(); topUpBalance(e.NewContext(req, rec)) != nil || rec.Code != http.StatusOK {
+		t.Fatalf("top-up failed: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := transfer("step-up-1", above.String(), pin); rec.Code != http.StatusForbidden || !bytes.Contains(rec.Body.Bytes(), []byte("step_up_required")) {
+		t.Fatalf("expected step_up_required, got %d %s", rec.Code, rec.Body.String())
+	}
+	withStepUp := map[string]string{transactionPINHeader: "2580", stepUpHeader: "step-up-ok"}
+	first := transfer("step-up-1", above.String(), withStepUp)
+	if first.Code != http.StatusOK || first.Header().Get(idempotencyReplayHeader) != "" {
+		t.Fatalf("expected the retry with a step-up token to run, got %d %s", first.Code, first.Body.String())
+	}
+	if rec := transfer("step-up-1", above.String(), withStepUp); rec.Body.String() != first.Body.String() || rec.Header().Get(idempotencyReplayHeader) != "true" {
+		t.Errorf("expected the transfer to be replayed, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Business refusals and fraud holds are the outcome and are replayed
+	if rec := transfer("funds-1", above.String(), withStepUp); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected insufficient funds, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := transfer("funds-1", above.String(), withStepUp); rec.Code != http.StatusBadRequest || rec.Header().Get(idempotencyReplayHeader) != "true" {
+		t.Errorf("expected the refusal to be replayed, got %d %s", rec.Code, rec.Body.String())
+	}
+	fraud.suspicious = true
+	held := transfer("hold-1", "10", pin)
+	if held.Code != http.StatusForbidden || !bytes.Contains(held.Body.Bytes(), []byte(TransactionOnHold)) {
+		t.Fatalf("expected the transfer to be held, got %d %s", held.Code, held.Body.String())
+	}
+	if rec := transfer("hold-1", "10", pin); rec.Body.String() != held.Body.String() || rec.Header().Get(idempotencyReplayHeader) != "true" {
+		t.Errorf("expected the hold to be replayed, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestOpeningLedgerTwice(t *testing.T) {
+	setupTestDB()
+	// Balances written before the ledger existed
+	db.Create(&Balance{UserID: 2, Balance: money.New(40000, "KZT"), Version: 1})
+	db.Create(&Balance{UserID: 3, Balance: money.New(10000, "KZT"), Version: 1})
+
+	// A second replica runs the same pass again
+	for i := 0; i < 2; i++ {
+		if err := openLedger(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var openings int64
+	db.Model(&JournalEntry{}).Where("description = ?", "Opening balance").Count(&openings)
+	if openings != 3 {
+		t.Errorf("expected one opening entry per balance, got %d", openings)
+	}
+
+	// A user whose account was opened after the pass listed them is skipped
+	var posted bool
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		posted, err = openLedgerAccount(tx, 2)
+		return err
+	})
+	if err != nil || posted {
+		t.Errorf("expected an opened account to be skipped, got %v %v", posted, err)
+	}
+	if report, err := checkLedgerSnapshot(); err != nil || !report.Consistent {
+		t.Errorf("expected the ledger to match the balances, got %+v %v", report, err)
+	}
+}
+
+func TestConcurrentTransfersKeepTotalBalance(t *testing.T) {
+	setupTestDB()
+	e := echo.New()
+
+	const users, transfers = 8, 2000
+	for id := uint(2); id <= users; id++ {
+		db.Create(&Balance{UserID: id, Balance: money.New(100000, "KZT"), Version: 1})
+	}
+	if err := openLedger(); err != nil {
+		t.Fatal(err)
+	}
+	total := func() int64 {
+		var sum int64
+		db.Model(&Balance{}).Select("SUM(balance_minor)").Scan(&sum)
+		return sum
+	}
+	before := total()
+
+	var wg sync.WaitGroup
+	results := make(chan int, transfers)
+	for i := 0; i < transfers; i++ {
+		// Pairs in both directions, so opposite transfers overlap all the time
+		sender, recipient := uint(i%users)+1, uint((i*3+1)%users)+1
+		if sender == recipient {
+			recipient = sender%users + 1
+		}
+		amount := strconv.Itoa(i%50 + 1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			jsonBytes, _ := json.Marshal(map[string]interface{}{"sender_id": sender, "recipient_id": recipient, "amount": amount})
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBytes))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.Set("user_id", sender)
+			transferFunds(c)
+			results <- rec.Code
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	succeeded := 0
+	for code := range results {
+		switch code {
+		case http.StatusOK:
+			succeeded++
+		case http.StatusBadRequest:
+			// Insufficient funds is a fine outcome, money was not moved
+		default:
+			t.Errorf("unexpected status %d", code)
+		}
+	}
+	if succeeded == 0 {
+		t.Fatal("expected transfers to succeed")
+	}
+	if after := total(); after != before {
+		t.Errorf("expected the total balance to stay %d, got %d", before, after)
+	}
+	var negative int64
+	db.Model(&Balance{}).Where("balance_minor < 0").Count(&negative)
+	if negative != 0 {
+		t.Errorf("expected no negative balances, got %d", negative)
+	}
+	if report, err := checkLedger(db); err != nil || !report.Consistent {
+		t.Errorf("expected the ledger to match the balances, got %+v %v", report, err)
+	}
+}
+
+// TestConcurrentOppositeTransfersOnPostgres runs transfers in both
+// directions between the same two users on Postgres, where they really run
+// at once and can deadlock or conflict, unlike on the single SQLite
+// connection of the other tests. PAYMENT_TEST_POSTGRES_DSN names a scratch
+// database; the payment tables in it are dropped.
+func TestConcurrentOppositeTransfersOnPostgres(t *testing.T) {
+	dsn := os.Getenv("PAYMENT_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("PAYMENT_TEST_POSTGRES_DSN is not set")
+	}
+	var err error
+	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(setupTestDB)
+	sqlDB, _ := db.DB()
+	sqlDB.SetMaxOpenConns(32)
+	models := []interface{}{&Balance{}, &Transaction{}, &LedgerAccount{}, &JournalEntry{}, &Posting{}, &IdempotencyKey{}, &TransactionTransition{}}
+	if err := db.Migrator().DropTable(models...); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(models...); err != nil {
+		t.Fatal(err)
+	}
+	authClient = &fakeAuthClient{}
+	fraudClient = &fakeFraudClient{}
+	for id := uint(1); id <= 2; id++ {
+		db.Create(&Balance{UserID: id, Balance: money.New(100000, "KZT"), Version: 1})
+	}
+	if err := openLedger(); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	const transfers = 400
+	var wg sync.WaitGroup
+	results := make(chan int, transfers)
+	for i := 0; i < transfers; i++ {
+		sender, recipient := uint(i%2)+1, uint((i+1)%2)+1
+		amount := strconv.Itoa(i%50 + 1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			jsonBytes, _ := json.Marshal(map[string]interface{}{"sender_id": sender, "recipient_id": recipient, "amount": amount})
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBytes))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.Set("user_id", sender)
+			transferFunds(c)
+			results <- rec.Code
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	succeeded := 0
+	for code := range results {
+		switch code {
+		case http.StatusOK:
+			succeeded++
+		case http.StatusBadRequest:
+		default:
+			// A deadlock or a conflict that outlasted the retries
+			t.Errorf("unexpected status %d", code)
+		}
+	}
+	if succeeded == 0 {
+		t.Fatal("expected transfers to succeed")
+	}
+	var total, negative int64
+	db.Model(&Balance{}).Select("SUM(balance_minor)").Scan(&total)
+	db.Model(&Balance{}).Where("balance_minor < 0").Count(&negative)
+	if total != 200000 || negative != 0 {
+		t.Errorf("expected 2000.00 in non-negative balances, got %d minor units and %d negative balances", total, negative)
+	}
+	if report, err := checkLedgerSnapshot(); err != nil || !report.Consistent {
+		t.Errorf("expected the ledger to match the balances, got %+v %v", report, err)
+	}
+}
+
+func TestStaleBalanceVersionIsRetried(t *testing.T) {
+	setupTestDB()
+	db.Create(&Balance{UserID: 2, Balance: money.Zero("KZT"), Version: 1})
+
+	attempts := 0
+	err := runTransaction(func(tx *gorm.DB) error {
+		attempts++
+		balances, err := lockBalances(tx, 2, 1)
+		if err != nil {
+			return err
+		}
+		sender, recipient := balances[1], balances[2]
+		if attempts == 1 {
+			// Another writer got there first
+			tx.Model(&Balance{}).Where("user_id = ?", 1).Update("version", sender.Version+1)
+		}
+		transaction := Transaction{SenderID: 1, RecipientID: &recipient.UserID, Amount: money.New(100, "KZT"), Status: "completed", TransactionType: "transfer"}
+		if err := tx.Create(&transaction).Error; err != nil {
+			return err
+		}
+		return postTransfer(tx, &transaction, sender, recipient)
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("expected the stale version to be retried once, got %d attempts and %v", attempts, err)
+	}
+	var sender Balance
+	db.First(&sender, "user_id = ?", 1)
+	if sender.Balance != money.New(99900, "KZT") {
+		t.Errorf("expected one transfer to be applied, got %s", sender.Balance.Format())
+	}
+}
+
+func TestRunTransactionRetries(t *testing.T) {
+	setupTestDB()
+
+	attempts := 0
+	err := runTransaction(func(tx *gorm.DB) error {
+		attempts++
+		if attempts < 3 {
+			return errVersionConflict
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("expected to succeed on the third attempt, got %d attempts and %v", attempts, err)
+	}
+
+	attempts = 0
+	err = runTransaction(func(tx *gorm.DB) error {
+		attempts++
+		return errVersionConflict
+	})
+	if !errors.Is(err, errVersionConflict) || attempts != txMaxAttempts {
+		t.Errorf("expected to give up after %d attempts, got %d and %v", txMaxAttempts, attempts, err)
+	}
+
+	// Refusals and other errors are not retried
+	for _, want := range []error{refuse(reasonInsufficientFunds, nil), errors.New("connection reset")} {
+		attempts = 0
+		err = runTransaction(func(tx *gorm.DB) error {
+			attempts++
+			return want
+		})
+		if err != want || attempts != 1 {
+			t.Errorf("expected %v to be returned after one attempt, got %d attempts and %v", want, attempts, err)
+		}
+	}
+}
+
+func TestTransactionStatusTransitions(t *testing.T) {
+	setupTestDB()
+	fraud := &fakeFraudClient{}
+	fraudClient = fraud
+	e := echo.New()
+
+	transfer := func(amount string) (int, map[string]interface{}) {
+		t.Helper()
+		jsonBytes, _ := json.Marshal(map[string]interface{}{"sender_id": 1, "recipient_id": 2, "amount": amount})
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBytes))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("user_id", uint(1))
+		transferFunds(c)
+		var body map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body
+	}
+	changeStatus := func(id uint, status, reason string) (int, Transaction) {
+		t.Helper()
+		jsonBytes, _ := json.Marshal(map[string]string{"status": status, "reason": reason})
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBytes))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues(strconv.FormatUint(uint64(id), 10))
+		c.Set(authz.ContextUserIDKey, uint(99))
+		c.Set(authz.ContextRolesKey, []string{authz.RoleAdmin})
+		authz.RequirePermission(authz.PermTransactionsManage)(updateTransactionStatus)(c)
+		var transaction Transaction
+		json.Unmarshal(rec.Body.Bytes(), &transaction)
+		return rec.Code, transaction
+	}
+	history := func(id uint) []string {
+		var transitions []TransactionTransition
+		db.Order("id").Find(&transitions, "transaction_id = ?", id)
+		var steps []string
+		for _, transition := range transitions {
+			steps = append(steps, transition.FromStatus+">"+transition.ToStatus+":"+transition.Reason)
+		}
+		return steps
+	}
+	balanceOf := func(userID uint) money.Money {
+		var balance Balance
+		db.First(&balance, "user_id = ?", userID)
+		return balance.Balance
+	}
+
+	code, body := transfer("100.00")
+	completed := uint(body["transaction_id"].(float64))
+	if code != http.StatusOK || body["status"] != TransactionCompleted {
+		t.Fatalf("expected the transfer to complete, got %d %v", code, body)
+	}
+	if len(fraud.transactionIDs) != 1 || fraud.transactionIDs[0] != uint64(completed) {
+		t.Errorf("expected fraud-service to be sent transaction %d, got %v", completed, fraud.transactionIDs)
+	}
+	if steps := history(completed); len(steps) != 2 || steps[0] != ">pending:created" || steps[1] != "pending>completed:settled" {
+		t.Errorf("expected pending then completed, got %v", steps)
+	}
+
+	code, body = transfer("999.00")
+	if code != http.StatusBadRequest {
+		t.Fatalf("expected insufficient funds, got %d %v", code, body)
+	}
+	var count int64
+	db.Model(&Transaction{}).Count(&count)
+	if count != 1 {
+		t.Errorf("expected a transfer refused up front not to be recorded, got %d transactions", count)
+	}
+
+	// Balances can change between the up-front check and settling
+	recipientID := uint(2)
+	failed := Transaction{SenderID: 1, RecipientID: &recipientID, Amount: money.New(99900, "KZT"), TransactionType: "transfer"}
+	if err := createTransaction(&failed); err != nil {
+		t.Fatalf("createTransaction error: %v", err)
+	}
+	_, err := settleTransfer(&failed, authz.KYCTierFull, authz.KYCTierFull, nil)
+	failRefused(&failed, err)
+	db.First(&failed, failed.ID)
+	if failed.Status != TransactionFailed || failed.StatusReason != reasonInsufficientFunds || failed.StatusChangedAt == nil {
+		t.Errorf("expected the transfer to fail for insufficient funds, got %+v", failed)
+	}
+
+	// Operators leave a pending transaction to its request, and one left by
+	// a request that died is failed once it is old enough
+	abandoned := Transaction{SenderID: 1, RecipientID: &recipientID, Amount: money.New(100, "KZT"), TransactionType: "transfer"}
+	if err := createTransaction(&abandoned); err != nil {
+		t.Fatalf("createTransaction error: %v", err)
+	}
+	for _, status := range []string{TransactionCompleted, TransactionFailed} {
+		if code, _ := changeStatus(abandoned.ID, status, "looks stuck"); code != http.StatusConflict {
+			t.Errorf("expected operators not to move a pending transaction to %s, got %d", status, code)
+		}
+	}
+	if n, err := failPendingBefore(time.Now().Add(-pendingTransactionTimeout)); err != nil || n != 0 {
+		t.Errorf("expected a recent pending transaction to be left alone, got %d %v", n, err)
+	}
+	if n, err := failPendingBefore(time.Now().Add(time.Second)); err != nil || n != 1 {
+		t.Errorf("expected the abandoned transaction to be failed, got %d %v", n, err)
+	}
+	db.First(&abandoned, abandoned.ID)
+	if abandoned.Status != TransactionFailed || abandoned.StatusReason != reasonAbandoned {
+		t.Errorf("expected the transfer to fail as abandoned, got %+v", abandoned)
+	}
+
+	fraud.suspicious = true
+	code, body = transfer("50.00")
+	held := uint(body["transaction_id"].(float64))
+	if code != http.StatusForbidden || body["status"] != TransactionOnHold {
+		t.Fatalf("expected the transfer to be held, got %d %v", code, body)
+	}
+	if balanceOf(1) != money.New(90000, "KZT") {
+		t.Errorf("expected a held transfer to move no money, got %s", balanceOf(1).Format())
+	}
+
+	if code, _ := changeStatus(held, TransactionReversed, "mistake"); code != http.StatusConflict {
+		t.Errorf("expected a held transfer not to be reversible, got %d", code)
+	}
+	code, released := changeStatus(held, TransactionCompleted, "reviewed by analyst")
+	if code != http.StatusOK || released.Status != TransactionCompleted || balanceOf(2) != money.New(15000, "KZT") {
+		t.Fatalf("expected the released transfer to settle, got %d %+v", code, released)
+	}
+	var transition TransactionTransition
+	db.Last(&transition, "transaction_id = ?", held)
+	if transition.ActorID == nil || *transition.ActorID != 99 {
+		t.Errorf("expected the operator to be recorded, got %+v", transition)
+	}
+
+	code, reversed := changeStatus(completed, TransactionReversed, "customer dispute")
+	if code != http.StatusOK || reversed.Status != TransactionReversed || reversed.StatusReason != "customer dispute" {
+		t.Fatalf("expected the transfer to be reversed, got %d %+v", code, reversed)
+	}
+	if balanceOf(1) != money.New(95000, "KZT") || balanceOf(2) != money.New(5000, "KZT") {
+		t.Errorf("expected the reversal to return the money, got %s and %s", balanceOf(1).Format(), balanceOf(2).Format())
+	}
+	if report, err := checkLedger(db); err != nil || !report.Consistent {
+		t.Errorf("expected a consistent ledger after the reversal, got %+v %v", report, err)
+	}
+	if code, _ := changeStatus(completed, TransactionReversed, "again"); code != http.StatusConflict {
+		t.Errorf("expected a second reversal to be refused, got %d", code)
+	}
+	if code, _ := changeStatus(completed, TransactionCompleted, ""); code != http.StatusBadRequest {
+		t.Errorf("expected a reason to be required, got %d", code)
+	}
+
+	// A payment is recorded for the fraud check and moves no money
+	process := func() (int, map[string]interface{}) {
+		t.Helper()
+		jsonBytes, _ := json.Marshal(map[string]interface{}{"sender_id": 1, "amount": "30.00"})
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(jsonBytes))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("user_id", uint(1))
+		processTransaction(c)
+		var body map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body
+	}
+	code, body = process()
+	payment := uint(body["transaction_id"].(float64))
+	if code != http.StatusForbidden || body["status"] != TransactionOnHold {
+		t.Fatalf("expected the payment to be held, got %d %v", code, body)
+	}
+	if last := fraud.transactionIDs[len(fraud.transactionIDs)-1]; last != uint64(payment) {
+		t.Errorf("expected fraud-service to be sent payment %d, got %d", payment, last)
+	}
+	if code, released := changeStatus(payment, TransactionCompleted, "reviewed by analyst"); code != http.StatusOK || released.Status != TransactionCompleted {
+		t.Fatalf("expected the released payment to complete, got %d %+v", code, released)
+	}
+	if code, reversed := changeStatus(payment, TransactionReversed, "customer dispute"); code != http.StatusOK || reversed.Status != TransactionReversed {
+		t.Fatalf("expected the payment to be reversed, got %d %+v", code, reversed)
+	}
+	fraud.suspicious = false
+	code, body = process()
+	if code != http.StatusOK || body["status"] != TransactionCompleted {
+		t.Fatalf("expected the payment to complete, got %d %v", code, body)
+	}
+	if steps := history(uint(body["transaction_id"].(float64))); len(steps) != 2 || steps[1] != "pending>completed:settled" {
+		t.Errorf("expected pending then completed, got %v", steps)
+	}
+	if balanceOf(1) != money.New(95000, "KZT") || balanceOf(2) != money.New(5000, "KZT") {
+		t.Errorf("expected payments to move no money, got %s and %s", balanceOf(1).Format(), balanceOf(2).Format())
+	}
+	if report, err := checkLedger(db); err != nil || !report.Consistent {
+		t.Errorf("expected a consistent ledger after the payments, got %+v %v", report, err)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// A client that did not see the response to a payment retries it with the
+// same Idempotency-Key and gets the original response instead of paying twice.
+
+const (
+	idempotencyHeader       = "Idempotency-Key"
+	idempotencyReplayHeader = "Idempotent-Replayed"
+	idempotencyKeyMaxLength = 255
+	idempotencyKeyTTL       = 24 * time.Hour
+	// A request still running after this long is assumed to have died with
+	// its process, and its key may be claimed again.
+	idempotencyAbandonAfter = time.Minute
+	// How long a duplicate waits for the original request to finish.
+	idempotencyWait = 10 * time.Second
+	// Handlers set this on the context once the request has created a
+	// transaction, so its response is kept whatever the status.
+	idempotencyRecordedKey = "idempotency_recorded"
+)
+
+// IdempotencyKey remembers the response to a request sent with an
+// Idempotency-Key. StatusCode is zero while the request is running.
+type IdempotencyKey struct {
+	UserID      uint   `gorm:"primaryKey"`
+	Key         string `gorm:"primaryKey;size:255"`
+	Fingerprint string `gorm:"size:64;not null"`
+	StatusCode  int    `gorm:"not null;default:0"`
+	Response    []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time `gorm:"index;not null"`
+}
+
+// requestFingerprint identifies what was asked for: the same key may only be
+// used again for the same method, path and body.
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type recordingWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// Idempotent makes a money-moving handler safe to retry. Requests without the
+// header run as before. Keys are scoped to the user, so one user cannot replay
+// another's response.
+func Idempotent(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get(idempotencyHeader)
+		if key == "" {
+			return next(c)
+		}
+		if len(key) > idempotencyKeyMaxLength {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Idempotency-Key is too long", "code": "invalid_idempotency_key"})
+		}
+		userID, ok := c.Get("user_id").(uint)
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+		}
+
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+		}
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := requestFingerprint(c.Request(), body)
+
+		claimed, stored, err := claimIdempotencyKey(userID, key, fingerprint)
+		if err != nil {
+			log.Printf("Failed to claim idempotency key of user %d: %v", userID, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+		}
+		if claimed == nil {
+			return replayIdempotent(c, stored, fingerprint)
+		}
+
+		// Only the claim made here is touched, not one that replaced it
+		// after this request was taken for abandoned
+		ours := func() *gorm.DB {
+			return db.Model(&IdempotencyKey{}).Where("user_id = ? AND key = ? AND created_at = ? AND status_code = 0",
+				userID, key, claimed.CreatedAt)
+		}
+		writer := &recordingWriter{ResponseWriter: c.Response().Writer}
+		c.Response().Writer = writer
+		completed := false
+		defer func() {
+			if !completed {
+				if err := ours().Delete(&IdempotencyKey{}).Error; err != nil {
+					log.Printf("Failed to release idempotency key of user %d: %v", userID, err)
+				}
+			}
+		}()
+
+		if err := next(c); err != nil {
+			return err
+		}
+		if !finalOutcome(c) {
+			return nil
+		}
+		if err := ours().Updates(map[string]interface{}{
+			"status_code": c.Response().Status,
+			"response":    writer.body.Bytes(),
+		}).Error; err != nil {
+			log.Printf("Failed to store response for idempotency key of user %d: %v", userID, err)
+			return nil
+		}
+		completed = true
+		return nil
+	}
+}
+
+// finalOutcome reports whether a response is the outcome of the request and
+// is replayed to retries. Business refusals such as insufficient funds are;
+// server errors and responses asking for credentials (401, 403 and 429, such
+// as a missing step-up token or PIN) are not, so the retry that brings them
+// is run. Otherwise a request that created a transaction keeps its response,
+// such as a fraud hold, since running it again would create another one.
+func finalOutcome(c echo.Context) bool {
+	status := c.Response().Status
+	if status >= http.StatusInternalServerError {
+		return false
+	}
+	if recorded, _ := c.Get(idempotencyRecordedKey).(bool); recorded {
+		return true
+	}
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return false
+	}
+	return true
+}
+
+// claimIdempotencyKey records that the request is running and returns the
+// claim. When the key is already taken, the request holding it is waited for
+// and returned as stored instead.
+func claimIdempotencyKey(userID uint, key, fingerprint string) (*IdempotencyKey, *IdempotencyKey, error) {
+	deadline := time.Now().Add(idempotencyWait)
+	wait := 25 * time.Millisecond
+	for {
+		// Postgres keeps microseconds, and the claim is found again by it
+		now := time.Now().Truncate(time.Microsecond)
+		record := IdempotencyKey{UserID: userID, Key: key, Fingerprint: fingerprint, CreatedAt: now, ExpiresAt: now.Add(idempotencyKeyTTL)}
+		result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+		if result.Error != nil {
+			return nil, nil, result.Error
+		}
+		if result.RowsAffected == 1 {
+			return &record, nil, nil
+		}
+
+		var stored IdempotencyKey
+		err := db.First(&stored, "user_id = ? AND key = ?", userID, key).Error
+		if err == gorm.ErrRecordNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		abandoned := stored.StatusCode == 0 && stored.CreatedAt.Before(now.Add(-idempotencyAbandonAfter))
+		if stored.ExpiresAt.Before(now) || abandoned {
+			if err := db.Where("user_id = ? AND key = ? AND created_at = ?", userID, key, stored.CreatedAt).
+				Delete(&IdempotencyKey{}).Error; err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		if stored.StatusCode != 0 || stored.Fingerprint != fingerprint || now.After(deadline) {
+			return nil, &stored, nil
+		}
+
+		time.Sleep(wait)
+		if wait < 500*time.Millisecond {
+			wait *= 2
+		}
+	}
+}
+
+func replayIdempotent(c echo.Context, stored *IdempotencyKey, fingerprint string) error {
+	if stored.Fingerprint != fingerprint {
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": "Idempotency-Key was already used for a different request",
+			"code":  "idempotency_key_reused",
+		})
+	}
+	if stored.StatusCode == 0 {
+		c.Response().Header().Set("Retry-After", "1")
+		return c.JSON(http.StatusConflict, map[string]string{
+			"error": "A request with this Idempotency-Key is still being processed",
+			"code":  "idempotency_request_in_progress",
+		})
+	}
+	c.Response().Header().Set(idempotencyReplayHeader, strconv.FormatBool(true))
+	return c.JSONBlob(stored.StatusCode, stored.Response)
+}
+
+func cleanupIdempotencyKeys() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := db.Where("expires_at < ?", time.Now()).Delete(&IdempotencyKey{}).Error; err != nil {
+			log.Printf("Failed to clean up idempotency keys: %v", err)
+		}
+	}
+}
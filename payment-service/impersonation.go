@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/elkin/system-design-final/shared/authpb"
+	"github.com/elkin/system-design-final/shared/authz"
+	"github.com/labstack/echo/v4"
+)
+
+const subjectImpersonationRequests = "auth.impersonation.requests"
+
+// impersonatedRequest handles a request made with an impersonation token and
+// reports it to auth-service, which keeps the audit trail of the session.
+func impersonatedRequest(c echo.Context, info *authpb.IntrospectTokenResponse, next echo.HandlerFunc) error {
+	c.Set(authz.ContextActorIDKey, uint(info.ActorId))
+	c.Set(authz.ContextReadOnlyKey, info.ReadOnly)
+
+	var err error
+	if authz.ReadOnlyViolation(c) {
+		err = authz.ReadOnlyResponse(c)
+	} else {
+		err = next(c)
+	}
+
+	log.Printf("Impersonated request by agent %d as user %d: %s %s -> %d",
+		info.ActorId, info.UserId, c.Request().Method, c.Request().URL.Path, c.Response().Status)
+	publishImpersonatedRequest(info.SessionId, c)
+	return err
+}
+
+func publishImpersonatedRequest(sessionID string, c echo.Context) {
+	if natsConn == nil {
+		log.Println("NATS not initialized")
+		return
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"session_id": sessionID,
+		"service":    "payment-service",
+		"method":     c.Request().Method,
+		"path":       c.Request().URL.RequestURI(),
+		"status":     c.Response().Status,
+		"ip_address": c.RealIP(),
+	})
+	if err != nil {
+		log.Printf("Failed to marshal impersonated request: %v", err)
+		return
+	}
+	if err := natsConn.Publish(subjectImpersonationRequests, data); err != nil {
+		log.Printf("Failed to publish impersonated request: %v", err)
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/elkin/system-design-final/shared/money"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The ledger records every movement of money as a journal entry whose
+// postings sum to zero in each currency, so money only moves between accounts
+// and is never created or destroyed. Money from outside the system comes from
+// the external funding account, which goes negative by what users were paid
+// in. Balance rows are a cache of the postings on each user's account and are
+// only changed by postJournalEntry, which checks their version.
+
+const (
+	ledgerAccountUser   = "user"
+	ledgerAccountSystem = "system"
+
+	externalFundingAccount = "external_funding"
+	openingBalanceAccount  = "opening_balances"
+)
+
+var (
+	errUnbalancedEntry = errors.New("journal entry postings do not sum to zero")
+	errTooFewPostings  = errors.New("journal entry needs at least two postings")
+	errZeroPosting     = errors.New("posting amount is zero")
+	errNoBalance       = errors.New("balance of ledger account was not loaded")
+)
+
+// LedgerAccount holds money: one per user and currency, plus system accounts
+// such as external funding.
+type LedgerAccount struct {
+	ID        uint   `gorm:"primaryKey"`
+	Code      string `gorm:"uniqueIndex:idx_ledger_accounts_code_currency;not null"`
+	Currency  string `gorm:"uniqueIndex:idx_ledger_accounts_code_currency;size:3;not null"`
+	Type      string `gorm:"not null"`
+	UserID    *uint  `gorm:"index"`
+	CreatedAt time.Time
+}
+
+type JournalEntry struct {
+	ID            uint  `gorm:"primaryKey"`
+	TransactionID *uint `gorm:"index"`
+	Description   string
+	CreatedAt     time.Time
+	Postings      []Posting
+}
+
+// Posting is one side of a journal entry. A positive amount increases the
+// balance of the account, a negative one decreases it.
+type Posting struct {
+	ID             uint        `gorm:"primaryKey"`
+	JournalEntryID uint        `gorm:"index;not null"`
+	AccountID      uint        `gorm:"index;not null"`
+	Amount         money.Money `gorm:"embedded;embeddedPrefix:amount_"`
+	CreatedAt      time.Time
+}
+
+// ledgerLeg is a posting to be made. Legs on a user account carry the
+// user's balance as read in the same transaction.
+type ledgerLeg struct {
+	account LedgerAccount
+	amount  money.Money
+	balance *Balance
+}
+
+// moveLegs moves amount from one account to another.
+func moveLegs(from, to LedgerAccount, amount money.Money, fromBalance, toBalance *Balance) []ledgerLeg {
+	return []ledgerLeg{
+		{account: from, amount: money.New(-amount.Minor, amount.Currency), balance: fromBalance},
+		{account: to, amount: amount, balance: toBalance},
+	}
+}
+
+func userLedgerAccount(tx *gorm.DB, userID uint, currency string) (LedgerAccount, error) {
+	return ledgerAccount(tx, LedgerAccount{
+		Code:     "user:" + strconv.FormatUint(uint64(userID), 10),
+		Currency: currency,
+		Type:     ledgerAccountUser,
+		UserID:   &userID,
+	})
+}
+
+func systemLedgerAccount(tx *gorm.DB, name, currency string) (LedgerAccount, error) {
+	return ledgerAccount(tx, LedgerAccount{Code: "system:" + name, Currency: currency, Type: ledgerAccountSystem})
+}
+
+// ledgerAccount returns the account with the code and currency of account,
+// creating it on first use. Concurrent first uses create it only once.
+func ledgerAccount(tx *gorm.DB, account LedgerAccount) (LedgerAccount, error) {
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&account).Error; err != nil {
+		return LedgerAccount{}, err
+	}
+	var existing LedgerAccount
+	err := tx.First(&existing, "code = ? AND currency = ?", account.Code, account.Currency).Error
+	return existing, err
+}
+
+func checkBalanced(legs []ledgerLeg) error {
+	if len(legs) < 2 {
+		return errTooFewPostings
+	}
+	sums := make(map[string]money.Money)
+	for _, leg := range legs {
+		if leg.amount.IsZero() {
+			return errZeroPosting
+		}
+		if leg.amount.Currency != leg.account.Currency {
+			return money.ErrCurrencyMismatch
+		}
+		sum, ok := sums[leg.amount.Currency]
+		if !ok {
+			sum = money.Zero(leg.amount.Currency)
+		}
+		sum, err := sum.Add(leg.amount)
+		if err != nil {
+			return err
+		}
+		sums[leg.amount.Currency] = sum
+	}
+	for _, sum := range sums {
+		if !sum.IsZero() {
+			return errUnbalancedEntry
+		}
+	}
+	return nil
+}
+
+// recordJournalEntry writes entry with one posting per leg, without touching
+// the cached balances.
+func recordJournalEntry(tx *gorm.DB, entry *JournalEntry, legs []ledgerLeg) error {
+	if err := checkBalanced(legs); err != nil {
+		return err
+	}
+	entry.Postings = make([]Posting, len(legs))
+	for i, leg := range legs {
+		entry.Postings[i] = Posting{AccountID: leg.account.ID, Amount: leg.amount}
+	}
+	return tx.Create(entry).Error
+}
+
+// postJournalEntry records entry and applies its postings to the cached
+// balances of the user accounts involved. A balance whose version changed
+// since it was read fails the entry with errVersionConflict.
+func postJournalEntry(tx *gorm.DB, entry *JournalEntry, legs []ledgerLeg) error {
+	if err := recordJournalEntry(tx, entry, legs); err != nil {
+		return err
+	}
+	for _, leg := range legs {
+		if leg.account.UserID == nil {
+			continue
+		}
+		if leg.balance == nil || leg.balance.UserID != *leg.account.UserID {
+			return errNoBalance
+		}
+		updated, err := leg.balance.Balance.Add(leg.amount)
+		if err != nil {
+			return err
+		}
+		result := tx.Model(&Balance{}).
+			Where("user_id = ? AND version = ?", leg.balance.UserID, leg.balance.Version).
+			Updates(map[string]interface{}{
+				"balance_minor":    updated.Minor,
+				"balance_currency": updated.Currency,
+				"version":          leg.balance.Version + 1,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errVersionConflict
+		}
+		leg.balance.Balance = updated
+		leg.balance.Version++
+	}
+	return nil
+}
+
+// postTopUp credits a top-up to the user from the external funding account.
+func postTopUp(tx *gorm.DB, transaction *Transaction, balance *Balance) error {
+	funding, err := systemLedgerAccount(tx, externalFundingAccount, transaction.Amount.Currency)
+	if err != nil {
+		return err
+	}
+	account, err := userLedgerAccount(tx, transaction.SenderID, transaction.Amount.Currency)
+	if err != nil {
+		return err
+	}
+	entry := JournalEntry{TransactionID: &transaction.ID, Description: transaction.Description}
+	return postJournalEntry(tx, &entry, moveLegs(funding, account, transaction.Amount, nil, balance))
+}
+
+func postTransfer(tx *gorm.DB, transaction *Transaction, sender, recipient *Balance) error {
+	senderAccount, err := userLedgerAccount(tx, transaction.SenderID, transaction.Amount.Currency)
+	if err != nil {
+		return err
+	}
+	recipientAccount, err := userLedgerAccount(tx, *transaction.RecipientID, transaction.Amount.Currency)
+	if err != nil {
+		return err
+	}
+	entry := JournalEntry{TransactionID: &transaction.ID, Description: transaction.Description}
+	return postJournalEntry(tx, &entry, moveLegs(senderAccount, recipientAccount, transaction.Amount, sender, recipient))
+}
+
+// postReversal moves the money of a top-up or transfer back: from the user to
+// the external funding account, or from the recipient to the sender. sender
+// and receiver are the same balance for a top-up.
+func postReversal(tx *gorm.DB, transaction *Transaction, sender, receiver *Balance) error {
+	var from, to LedgerAccount
+	var err error
+	if transaction.RecipientID == nil {
+		if from, err = userLedgerAccount(tx, transaction.SenderID, transaction.Amount.Currency); err != nil {
+			return err
+		}
+		if to, err = systemLedgerAccount(tx, externalFundingAccount, transaction.Amount.Currency); err != nil {
+			return err
+		}
+		sender = nil
+	} else {
+		if from, err = userLedgerAccount(tx, *transaction.RecipientID, transaction.Amount.Currency); err != nil {
+			return err
+		}
+		if to, err = userLedgerAccount(tx, transaction.SenderID, transaction.Amount.Currency); err != nil {
+			return err
+		}
+	}
+	entry := JournalEntry{TransactionID: &transaction.ID, Description: "Reversal: " + transaction.Description}
+	return postJournalEntry(tx, &entry, moveLegs(from, to, transaction.Amount, receiver, sender))
+}
+
+// openLedger gives every balance written before the ledger existed an
+// account and an opening entry against the opening balances account, so the
+// ledger accounts for all money held. Replicas starting together take turns
+// under an advisory lock.
+func openLedger() error {
+	return db.Connection(func(conn *gorm.DB) error {
+		conn = conn.Session(&gorm.Session{NewDB: true})
+		if err := advisoryLock(conn, ledgerOpeningLockID); err != nil {
+			return err
+		}
+		defer func() {
+			if err := advisoryUnlock(conn, ledgerOpeningLockID); err != nil {
+				log.Printf("Failed to release ledger opening lock: %v", err)
+			}
+		}()
+
+		var userIDs []uint
+		err := conn.Model(&Balance{}).
+			Where("NOT EXISTS (SELECT 1 FROM ledger_accounts WHERE ledger_accounts.user_id = balances.user_id)").
+			Pluck("user_id", &userIDs).Error
+		if err != nil {
+			return err
+		}
+
+		opened := 0
+		for _, userID := range userIDs {
+			var posted bool
+			err := conn.Transaction(func(tx *gorm.DB) error {
+				var err error
+				posted, err = openLedgerAccount(tx, userID)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("opening ledger account of user %d: %w", userID, err)
+			}
+			if posted {
+				opened++
+			}
+		}
+		if opened > 0 {
+			log.Printf("Opened ledger accounts for %d existing balances", opened)
+		}
+		return nil
+	})
+}
+
+// openLedgerAccount posts the opening entry of a user whose balance predates
+// the ledger. The balance is locked and read again, and the user is skipped
+// if an account was opened since it was listed, because a transfer posts to
+// that account under the same lock and the balance no longer predates it.
+func openLedgerAccount(tx *gorm.DB, userID uint) (bool, error) {
+	balances, err := lockBalances(tx, userID)
+	if err != nil {
+		return false, err
+	}
+	balance := balances[userID]
+	if balance == nil {
+		return false, nil
+	}
+	var accounts int64
+	if err := tx.Model(&LedgerAccount{}).Where("user_id = ?", userID).Count(&accounts).Error; err != nil {
+		return false, err
+	}
+	if accounts > 0 {
+		return false, nil
+	}
+
+	currency := balance.Balance.Currency
+	account, err := userLedgerAccount(tx, userID, currency)
+	if err != nil || balance.Balance.IsZero() {
+		return false, err
+	}
+	opening, err := systemLedgerAccount(tx, openingBalanceAccount, currency)
+	if err != nil {
+		return false, err
+	}
+	entry := JournalEntry{Description: "Opening balance"}
+	return true, recordJournalEntry(tx, &entry, []ledgerLeg{
+		{account: opening, amount: money.New(-balance.Balance.Minor, currency)},
+		{account: account, amount: balance.Balance},
+	})
+}
+
+// ledgerOpeningLockID is the Postgres advisory lock openLedger runs under.
+const ledgerOpeningLockID = 0x6c656467
+
+func advisoryLock(conn *gorm.DB, id int64) error {
+	if conn.Dialector.Name() != "postgres" {
+		return nil
+	}
+	return conn.Exec("SELECT pg_advisory_lock(?)", id).Error
+}
+
+// advisoryXactLock takes the advisory lock id until tx ends.
+func advisoryXactLock(tx *gorm.DB, id int64) error {
+	if tx.Dialector.Name() != "postgres" {
+		return nil
+	}
+	return tx.Exec("SELECT pg_advisory_xact_lock(?)", id).Error
+}
+
+func advisoryUnlock(conn *gorm.DB, id int64) error {
+	if conn.Dialector.Name() != "postgres" {
+		return nil
+	}
+	return conn.Exec("SELECT pg_advisory_unlock(?)", id).Error
+}
+
+type balanceDrift struct {
+	UserID     uint   `json:"user_id"`
+	Currency   string `json:"currency"`
+	Cached     string `json:"cached"`
+	Ledger     string `json:"ledger"`
+	Difference string `json:"difference"`
+}
+
+type unbalancedEntry struct {
+	JournalEntryID uint   `json:"journal_entry_id"`
+	Currency       string `json:"currency"`
+	Sum            string `json:"sum"`
+}
+
+type ledgerReport struct {
+	Consistent        bool              `json:"consistent"`
+	AccountsChecked   int               `json:"accounts_checked"`
+	EntriesChecked    int64             `json:"entries_checked"`
+	UnbalancedEntries []unbalancedEntry `json:"unbalanced_entries"`
+	Drift             []balanceDrift    `json:"drift"`
+	CheckedAt         time.Time         `json:"checked_at"`
+}
+
+// checkLedger verifies that every journal entry sums to zero and that every
+// cached balance equals the sum of the postings on the user's account. Its
+// queries only agree with each other when tx reads a single snapshot.
+func checkLedger(tx *gorm.DB) (*ledgerReport, error) {
+	report := &ledgerReport{
+		UnbalancedEntries: []unbalancedEntry{},
+		Drift:             []balanceDrift{},
+		CheckedAt:         time.Now(),
+	}
+	if err := tx.Model(&JournalEntry{}).Count(&report.EntriesChecked).Error; err != nil {
+		return nil, err
+	}
+
+	var sums []struct {
+		JournalEntryID uint
+		AmountCurrency string
+		Sum            int64
+	}
+	err := tx.Model(&Posting{}).
+		Select("journal_entry_id, amount_currency, SUM(amount_minor) AS sum").
+		Group("journal_entry_id, amount_currency").
+		Having("SUM(amount_minor) <> 0").
+		Scan(&sums).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sums {
+		report.UnbalancedEntries = append(report.UnbalancedEntries, unbalancedEntry{
+			JournalEntryID: s.JournalEntryID,
+			Currency:       s.AmountCurrency,
+			Sum:            money.New(s.Sum, s.AmountCurrency).String(),
+		})
+	}
+
+	var held []struct {
+		UserID   uint
+		Currency string
+		Minor    int64
+	}
+	err = tx.Model(&LedgerAccount{}).
+		Select("ledger_accounts.user_id, ledger_accounts.currency, COALESCE(SUM(postings.amount_minor), 0) AS minor").
+		Joins("LEFT JOIN postings ON postings.account_id = ledger_accounts.id").
+		Where("ledger_accounts.type = ?", ledgerAccountUser).
+		Group("ledger_accounts.user_id, ledger_accounts.currency").
+		Scan(&held).Error
+	if err != nil {
+		return nil, err
+	}
+	ledger := make(map[uint]money.Money, len(held))
+	for _, h := range held {
+		ledger[h.UserID] = money.New(h.Minor, h.Currency)
+	}
+
+	var balances []Balance
+	if err := tx.Find(&balances).Error; err != nil {
+		return nil, err
+	}
+	for _, balance := range balances {
+		expected, ok := ledger[balance.UserID]
+		if !ok {
+			expected = money.Zero(balance.Balance.Currency)
+		}
+		delete(ledger, balance.UserID)
+		if expected == balance.Balance {
+			continue
+		}
+		report.Drift = append(report.Drift, newBalanceDrift(balance.UserID, balance.Balance, expected))
+	}
+	// Accounts holding money without a cached balance at all
+	for userID, expected := range ledger {
+		if !expected.IsZero() {
+			report.Drift = append(report.Drift, newBalanceDrift(userID, money.Zero(expected.Currency), expected))
+		}
+	}
+
+	report.AccountsChecked = len(balances)
+	report.Consistent = len(report.UnbalancedEntries) == 0 && len(report.Drift) == 0
+	return report, nil
+}
+
+func newBalanceDrift(userID uint, cached, ledger money.Money) balanceDrift {
+	drift := balanceDrift{UserID: userID, Currency: cached.Currency, Cached: cached.String(), Ledger: ledger.String()}
+	if difference, err := cached.Sub(ledger); err == nil {
+		drift.Difference = difference.String()
+	}
+	return drift
+}
+
+// checkLedgerSnapshot runs checkLedger on one snapshot of the database, so
+// transfers committed while it reads are not reported as drift.
+func checkLedgerSnapshot() (*ledgerReport, error) {
+	var report *ledgerReport
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		report, err = checkLedger(tx)
+		return err
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	return report, err
+}
+
+func getLedgerCheck(c echo.Context) error {
+	report, err := checkLedgerSnapshot()
+	if err != nil {
+		log.Printf("Ledger check failed: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check ledger"})
+	}
+	if !report.Consistent {
+		log.Printf("Ledger check found %d unbalanced entries and %d drifted balances",
+			len(report.UnbalancedEntries), len(report.Drift))
+	}
+	return c.JSON(http.StatusOK, report)
+}
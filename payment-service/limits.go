@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elkin/system-design-final/shared/authpb"
+	"github.com/elkin/system-design-final/shared/authz"
+	"github.com/elkin/system-design-final/shared/money"
+	"github.com/labstack/echo/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+)
+
+// tierLimits caps what an account may move depending on its KYC tier. Zero
+// means no limit. Daily is a rolling 24 hours of top-ups and sent transfers.
+type tierLimits struct {
+	PerTransaction money.Money
+	Daily          money.Money
+	MaxBalance     money.Money
+}
+
+const (
+	limitPerTransaction = "per_transaction"
+	limitDaily          = "daily"
+	limitBalance        = "balance"
+)
+
+// KYC_LIMITS_<TIER> overrides the defaults as "per_transaction,daily,balance".
+var kycLimits = map[string]tierLimits{
+	authz.KYCTierUnverified: loadTierLimits(authz.KYCTierUnverified, "100", "200", "500"),
+	authz.KYCTierBasic:      loadTierLimits(authz.KYCTierBasic, "1000", "5000", "10000"),
+	authz.KYCTierFull:       loadTierLimits(authz.KYCTierFull, "10000", "50000", "0"),
+}
+
+var errAccountNotFound = errors.New("account not found")
+
+func loadTierLimits(tier string, defaults ...string) tierLimits {
+	key := "KYC_LIMITS_" + strings.ToUpper(tier)
+	value := getEnv(key, strings.Join(defaults, ","))
+	parts := strings.Split(value, ",")
+	if len(parts) != 3 {
+		log.Fatalf("%s must be per_transaction,daily,balance", key)
+	}
+	var limits [3]money.Money
+	for i, part := range parts {
+		v, err := money.Parse(strings.TrimSpace(part), accountCurrency)
+		if err != nil || v.IsNegative() {
+			log.Fatalf("Invalid %s: %q", key, value)
+		}
+		limits[i] = v
+	}
+	return tierLimits{PerTransaction: limits[0], Daily: limits[1], MaxBalance: limits[2]}
+}
+
+// exceeds reports whether amount is over limit. A zero limit is no limit.
+func exceeds(amount, limit money.Money) bool {
+	if limit.IsZero() {
+		return false
+	}
+	cmp, err := amount.Cmp(limit)
+	return err != nil || cmp > 0
+}
+
+// accountTier returns the tier of the account. The caller's own tier comes
+// from the token; any other account is looked up in auth-service.
+func accountTier(c echo.Context, userID uint) (string, error) {
+	if callerID, ok := authz.UserID(c); ok && callerID == userID {
+		if tier, _ := c.Get(authz.ContextKYCTierKey).(string); authz.ValidKYCTier(tier) {
+			return tier, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), authRequestTimeout)
+	defer cancel()
+	user, err := authClient.GetUser(ctx, &authpb.GetUserRequest{UserId: uint64(userID)})
+	if status.Code(err) == codes.NotFound {
+		return "", errAccountNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if !authz.ValidKYCTier(user.KycTier) {
+		return authz.KYCTierUnverified, nil
+	}
+	return user.KycTier, nil
+}
+
+func limitsFor(tier string) tierLimits {
+	if limits, ok := kycLimits[tier]; ok {
+		return limits
+	}
+	return kycLimits[authz.KYCTierUnverified]
+}
+
+// exceededLimit reports which limit an outgoing or top-up amount would break
+// and the value of that limit. It must run with the account's balance locked
+// so concurrent requests cannot both fit under the daily limit.
+func exceededLimit(tx *gorm.DB, userID uint, amount money.Money, limits tierLimits) (string, money.Money, error) {
+	if exceeds(amount, limits.PerTransaction) {
+		return limitPerTransaction, limits.PerTransaction, nil
+	}
+	if !limits.Daily.IsZero() {
+		var minor int64
+		err := tx.Model(&Transaction{}).
+			Select("COALESCE(SUM(amount_minor), 0)").
+			Where("sender_id = ? AND amount_currency = ? AND transaction_type IN ? AND status = ? AND created_at > ?",
+				userID, amount.Currency, []string{"top_up", "transfer"}, TransactionCompleted, time.Now().Add(-24*time.Hour)).
+			Scan(&minor).Error
+		if err != nil {
+			return "", money.Money{}, err
+		}
+		total, err := money.New(minor, amount.Currency).Add(amount)
+		if err != nil || exceeds(total, limits.Daily) {
+			return limitDaily, limits.Daily, nil
+		}
+	}
+	return "", money.Money{}, nil
+}
+
+func limitExceededResponse(c echo.Context, message, tier, limit string, max money.Money) error {
+	return c.JSON(http.StatusForbidden, map[string]interface{}{
+		"error":    message,
+		"code":     "kyc_limit_exceeded",
+		"tier":     tier,
+		"limit":    limit,
+		"max":      max.String(),
+		"currency": max.Currency,
+	})
+}
+
+func accountTierError(c echo.Context, err error) error {
+	if err == errAccountNotFound {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+	log.Printf("KYC tier lookup failed: %v", err)
+	return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Authentication service unavailable"})
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"log"
+	"os"
+
+	"github.com/elkin/system-design-final/shared/authz"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
@@ -8,22 +12,40 @@ import (
 func main() {
 	initDB()
 	initFraudClient()
+	initAuthClient()
 	initNATS()
+	go cleanupIdempotencyKeys()
+	go failAbandonedTransactions()
 
 	e := echo.New()
+	ipExtractor, err := authz.ClientIPExtractor(getEnv("TRUSTED_PROXIES", ""))
+	if err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES: ", err)
+	}
+	e.IPExtractor = ipExtractor
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 
-	e.GET("/balance/:user_id", getBalance)
-
 	protected := e.Group("")
 	protected.Use(JWTMiddleware)
 
-	protected.POST("/balance/top-up", topUpBalance)
+	protected.GET("/balance/:user_id", getBalance, authz.RequireSelfOrPermission("user_id", authz.PermBalanceReadAny))
+	// Support agents impersonating a customer may look but never move money
+	protected.POST("/balance/top-up", topUpBalance, authz.RefuseImpersonation, authz.RequirePermission(authz.PermTransactionsCreate), Idempotent)
+
+	protected.POST("/transactions/transfer", transferFunds, authz.RefuseImpersonation, authz.RequirePermission(authz.PermTransactionsCreate), Idempotent)
+	protected.POST("/transactions/process", processTransaction, authz.RefuseImpersonation, authz.RequirePermission(authz.PermTransactionsCreate))
+	protected.GET("/transactions/history/:user_id", getTransactionHistory, authz.RequireSelfOrPermission("user_id", authz.PermTransactionsReadAny))
 
-	protected.POST("/transactions/transfer", transferFunds)
-	protected.POST("/transactions/process", processTransaction)
-	protected.GET("/transactions/history/:user_id", getTransactionHistory)
+	protected.GET("/admin/ledger/check", getLedgerCheck, authz.RequirePermission(authz.PermLedgerAudit))
+	protected.POST("/admin/transactions/:id/status", updateTransactionStatus, authz.RequirePermission(authz.PermTransactionsManage))
 
 	e.Logger.Fatal(e.Start(":8082"))
 }
+
+func getEnv(key, fallback string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return fallback
+}
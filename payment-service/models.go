@@ -5,6 +5,7 @@ import (
 	"log"
 	"time"
 
+	"github.com/elkin/system-design-final/shared/money"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -20,17 +21,27 @@ func initDB() {
 	}
 	fmt.Println("Connected to PostgreSQL")
 
-	err = db.AutoMigrate(&Balance{}, &Transaction{})
+	if err := migrateMoneyColumns(); err != nil {
+		log.Fatal("Money migration failed: ", err)
+	}
+
+	err = db.AutoMigrate(&Balance{}, &Transaction{}, &LedgerAccount{}, &JournalEntry{}, &Posting{}, &IdempotencyKey{}, &TransactionTransition{})
 	if err != nil {
 		log.Fatal("Migration failed")
 	}
+	if err := openLedger(); err != nil {
+		log.Fatal("Opening the ledger failed: ", err)
+	}
 	fmt.Println("Migrations applied")
 }
 
+// Balance caches what the user's ledger account holds, so reads and locks do
+// not have to sum postings. Only postJournalEntry changes it.
 type Balance struct {
-	UserID    uint    `gorm:"primaryKey"`
-	Balance   float64 `gorm:"not null;default:0"`
-	Version   int     `gorm:"not null;default:1"`
+	UserID    uint        `gorm:"primaryKey"`
+	Balance   money.Money `gorm:"embedded;embeddedPrefix:balance_"`
+	Version   int         `gorm:"not null;default:1"`
+	ClosedAt  *time.Time
 	UpdatedAt time.Time
 }
 
@@ -38,10 +49,80 @@ type Transaction struct {
 	ID              uint `gorm:"primaryKey"`
 	SenderID        uint `gorm:"not null"`
 	RecipientID     *uint
-	Amount          float64 `gorm:"not null"`
-	Status          string  `gorm:"not null"`
-	TransactionType string  `gorm:"not null"`
+	Amount          money.Money `gorm:"embedded;embeddedPrefix:amount_"`
+	Status          string      `gorm:"not null"`
+	StatusReason    string
+	StatusChangedAt *time.Time
+	TransactionType string `gorm:"not null"`
 	Description     string
 	CreatedAt       time.Time
 	UpdatedAt       time.Time
 }
+
+// migrateMoneyColumns moves the float balance and amount columns written by
+// older versions into integer minor units of accountCurrency, rounding each
+// value to the nearest minor unit, and drops the currency defaults older
+// versions declared. Replicas starting together take turns under an
+// advisory lock, and the second finds nothing left to move.
+func migrateMoneyColumns() error {
+	exp, err := money.Exponent(accountCurrency)
+	if err != nil {
+		return err
+	}
+	columns := []struct{ table, column string }{
+		{"balances", "balance"},
+		{"transactions", "amount"},
+	}
+	currencyColumns := []struct{ table, column string }{
+		{"balances", "balance_currency"},
+		{"transactions", "amount_currency"},
+		{"postings", "amount_currency"},
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := advisoryXactLock(tx, moneyMigrationLockID); err != nil {
+			return err
+		}
+		migrator := tx.Migrator()
+		for _, c := range columns {
+			if !migrator.HasTable(c.table) || !migrator.HasColumn(c.table, c.column) {
+				continue
+			}
+			statements := []string{
+				fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s_minor bigint", c.table, c.column),
+				fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s_currency varchar(3)", c.table, c.column),
+				fmt.Sprintf("UPDATE %s SET %s_minor = ROUND(%s::numeric * %d)::bigint, %s_currency = '%s' WHERE %s_minor IS NULL",
+					c.table, c.column, c.column, pow10(exp), c.column, accountCurrency, c.column),
+				fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", c.table, c.column),
+			}
+			for _, statement := range statements {
+				if err := tx.Exec(statement).Error; err != nil {
+					return err
+				}
+			}
+			log.Printf("Migrated %s.%s to minor units of %s", c.table, c.column, accountCurrency)
+		}
+		// A row without a currency is refused rather than taken for KZT
+		for _, c := range currencyColumns {
+			if !migrator.HasTable(c.table) || !migrator.HasColumn(c.table, c.column) {
+				continue
+			}
+			if err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP DEFAULT", c.table, c.column)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// moneyMigrationLockID is the Postgres advisory lock migrateMoneyColumns
+// runs under.
+const moneyMigrationLockID = 0x6d6f6e79
+
+func pow10(exp int) int64 {
+	n := int64(1)
+	for i := 0; i < exp; i++ {
+		n *= 10
+	}
+	return n
+}
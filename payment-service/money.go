@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/elkin/system-design-final/shared/money"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// accountCurrency is the currency of every balance. Requests may name it but
+// no other currency: the service does not convert between currencies.
+var accountCurrency = loadAccountCurrency()
+
+func loadAccountCurrency() string {
+	currency := getEnv("CURRENCY", money.DefaultCurrency)
+	if !money.ValidCurrency(currency) {
+		log.Fatalf("Unsupported CURRENCY %q", currency)
+	}
+	return currency
+}
+
+// parseAmount reads an amount sent as a decimal string. An empty currency
+// means accountCurrency.
+func parseAmount(amount, currency string) (money.Money, error) {
+	if currency == "" {
+		currency = accountCurrency
+	}
+	if currency != accountCurrency {
+		return money.Money{}, money.ErrUnknownCurrency
+	}
+	return money.Parse(amount, currency)
+}
+
+func invalidAmountResponse(c echo.Context, err error) error {
+	return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid amount: " + err.Error(), "code": "invalid_amount"})
+}
+
+// getEnvMoney reads a decimal amount of accountCurrency from the environment.
+func getEnvMoney(key string, fallback money.Money) money.Money {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	amount, err := money.Parse(value, accountCurrency)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", key, value, err)
+	}
+	return amount
+}
+
+// requireCurrency refuses to write amounts that do not name a supported
+// currency. Go leaves an unset currency empty, which NOT NULL would accept.
+func requireCurrency(amounts ...money.Money) error {
+	for _, amount := range amounts {
+		if !money.ValidCurrency(amount.Currency) {
+			return fmt.Errorf("%w: %q", money.ErrUnknownCurrency, amount.Currency)
+		}
+	}
+	return nil
+}
+
+func (b *Balance) BeforeCreate(tx *gorm.DB) error { return requireCurrency(b.Balance) }
+
+func (t *Transaction) BeforeCreate(tx *gorm.DB) error { return requireCurrency(t.Amount) }
+
+func (p *Posting) BeforeCreate(tx *gorm.DB) error { return requireCurrency(p.Amount) }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/elkin/system-design-final/shared/authpb"
+	"github.com/labstack/echo/v4"
+)
+
+const transactionPINHeader = "X-Transaction-PIN"
+
+// requireTransactionPIN checks the PIN sent with a transfer when the user has
+// opted in to confirming transfers with one. Requests made with an API key
+// send it too: any session can create a key, so a key proves no more than
+// the phone it was created on.
+func requireTransactionPIN(c echo.Context, userID uint) (ok bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), authRequestTimeout)
+	defer cancel()
+	resp, err := authClient.VerifyTransactionPIN(ctx, &authpb.VerifyTransactionPINRequest{
+		UserId: uint64(userID),
+		Pin:    c.Request().Header.Get(transactionPINHeader),
+	})
+	if err != nil {
+		log.Printf("Transaction PIN check failed: %v", err)
+		return false, c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Authentication service unavailable"})
+	}
+	if !resp.Required || resp.Valid {
+		return true, nil
+	}
+
+	switch resp.Reason {
+	case "locked":
+		c.Response().Header().Set("Retry-After", strconv.FormatInt(resp.RetryAfter, 10))
+		return false, c.JSON(http.StatusTooManyRequests, map[string]interface{}{
+			"error":       "Too many wrong PINs, try again later",
+			"code":        "transaction_pin_locked",
+			"retry_after": resp.RetryAfter,
+		})
+	case "invalid":
+		return false, c.JSON(http.StatusForbidden, map[string]interface{}{
+			"error":         "Incorrect transaction PIN",
+			"code":          "transaction_pin_invalid",
+			"attempts_left": resp.AttemptsLeft,
+		})
+	default:
+		return false, c.JSON(http.StatusForbidden, map[string]string{
+			"error":  "Transaction PIN required",
+			"code":   "transaction_pin_required",
+			"header": transactionPINHeader,
+		})
+	}
+}
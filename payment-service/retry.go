@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/elkin/system-design-final/shared/money"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	txMaxAttempts    = 5
+	txRetryBaseDelay = 10 * time.Millisecond
+	txRetryMaxDelay  = 200 * time.Millisecond
+)
+
+// errVersionConflict means a balance changed between being read and being
+// written. The transaction is run again with fresh balances.
+var errVersionConflict = errors.New("balance was changed by another transaction")
+
+// refusal is a response decided inside a database transaction, such as
+// insufficient funds. Returning it rolls the transaction back without a retry
+// and the handler sends it with respond. reason is recorded when the refusal
+// fails a transaction.
+type refusal struct {
+	reason  string
+	respond func(c echo.Context) error
+}
+
+func (r *refusal) Error() string { return "request refused" }
+
+func refuse(reason string, respond func(c echo.Context) error) error {
+	return &refusal{reason: reason, respond: respond}
+}
+
+// retryable reports whether err means the transaction lost a race and would
+// likely succeed if run again: a serialization failure or deadlock reported
+// by Postgres, or a stale balance version.
+func retryable(err error) bool {
+	if errors.Is(err, errVersionConflict) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "40001" || pgErr.Code == "40P01"
+	}
+	return false
+}
+
+// runTransaction runs fn in a database transaction and runs it again, after
+// a growing, jittered pause, when it fails in a way another attempt can fix.
+// fn must not have side effects outside tx.
+func runTransaction(fn func(tx *gorm.DB) error) error {
+	delay := txRetryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := db.Transaction(fn)
+		if err == nil || !retryable(err) {
+			return err
+		}
+		if attempt == txMaxAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		log.Printf("Retrying transaction after attempt %d: %v", attempt, err)
+		time.Sleep(delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)))
+		delay = min(2*delay, txRetryMaxDelay)
+	}
+}
+
+// ensureBalance creates an empty balance for userID unless there is one.
+func ensureBalance(tx *gorm.DB, userID uint, currency string) error {
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&Balance{UserID: userID, Balance: money.Zero(currency), Version: 1}).Error
+}
+
+// lockBalances locks the balances of userIDs until tx ends. Locks are always
+// taken in user_id order, so two transfers between the same users in opposite
+// directions wait for each other instead of deadlocking. Users without a
+// balance are missing from the result.
+func lockBalances(tx *gorm.DB, userIDs ...uint) (map[uint]*Balance, error) {
+	ids := append([]uint(nil), userIDs...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	balances := make(map[uint]*Balance, len(ids))
+	for _, id := range ids {
+		var balance Balance
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&balance, "user_id = ?", id).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		balances[id] = &balance
+	}
+	return balances, nil
+}
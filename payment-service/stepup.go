@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/elkin/system-design-final/shared/authpb"
+	"github.com/elkin/system-design-final/shared/authz"
+	"github.com/elkin/system-design-final/shared/money"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	stepUpHeader            = "X-Step-Up-Token"
+	stepUpOperationTransfer = "transfer"
+)
+
+// Transfers above STEP_UP_THRESHOLD need a step-up token from auth-service.
+var stepUpThreshold = getEnvMoney("STEP_UP_THRESHOLD", money.New(100000, accountCurrency))
+
+// requireStepUp consumes the step-up token sent with the request. When it is
+// missing or unusable the client gets a step_up_required error listing the
+// methods it can use to obtain one, and ok is false. The token has to come
+// from the session it was issued to.
+func requireStepUp(c echo.Context, userID uint, operation string) (ok bool, err error) {
+	sessionID, _ := c.Get(authz.ContextSessionIDKey).(string)
+	ctx, cancel := context.WithTimeout(context.Background(), authRequestTimeout)
+	defer cancel()
+	resp, err := authClient.ConsumeStepUpToken(ctx, &authpb.ConsumeStepUpTokenRequest{
+		Token:     c.Request().Header.Get(stepUpHeader),
+		UserId:    uint64(userID),
+		Operation: operation,
+		SessionId: sessionID,
+	})
+	if err != nil {
+		log.Printf("Step-up check failed: %v", err)
+		return false, c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Authentication service unavailable"})
+	}
+	if resp.Valid {
+		return true, nil
+	}
+
+	return false, c.JSON(http.StatusForbidden, map[string]interface{}{
+		"error":     "Step-up authentication required",
+		"code":      "step_up_required",
+		"reason":    resp.Reason,
+		"operation": operation,
+		"methods":   resp.Methods,
+		"header":    stepUpHeader,
+	})
+}
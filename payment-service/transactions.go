@@ -0,0 +1,570 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/elkin/system-design-final/shared/authz"
+	"github.com/elkin/system-design-final/shared/money"
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+)
+
+// A transaction is written as pending before any money moves, so fraud-service
+// can be told its ID, and then changes status only along transactionTransitions:
+//
+//	pending -> completed | failed | on_hold
+//	on_hold -> completed | failed
+//	completed -> reversed
+//
+// Each change is recorded in transaction_transitions with its time and reason
+// and published on NATS. Operators may only make the changes in
+// operatorTransitions; a pending transaction is settled by the request that
+// created it, or failed by failAbandonedTransactions if that request died.
+
+const (
+	TransactionPending   = "pending"
+	TransactionCompleted = "completed"
+	TransactionFailed    = "failed"
+	TransactionOnHold    = "on_hold"
+	TransactionReversed  = "reversed"
+)
+
+var transactionTransitions = map[string][]string{
+	"":                   {TransactionPending},
+	TransactionPending:   {TransactionCompleted, TransactionFailed, TransactionOnHold},
+	TransactionOnHold:    {TransactionCompleted, TransactionFailed},
+	TransactionCompleted: {TransactionReversed},
+}
+
+var operatorTransitions = map[string][]string{
+	TransactionOnHold:    {TransactionCompleted, TransactionFailed},
+	TransactionCompleted: {TransactionReversed},
+}
+
+// A pending transaction older than this was left by a process that died
+// while settling it.
+const pendingTransactionTimeout = 5 * time.Minute
+
+// Reasons recorded with a status change
+const (
+	reasonCreated           = "created"
+	reasonSettled           = "settled"
+	reasonFraudSuspected    = "fraud_suspected"
+	reasonInsufficientFunds = "insufficient_funds"
+	reasonLimitExceeded     = "limit_exceeded"
+	reasonAccountClosed     = "account_closed"
+	reasonAccountNotFound   = "account_not_found"
+	reasonInvalidAmount     = "invalid_amount"
+	reasonInternalError     = "internal_error"
+	reasonAbandoned         = "abandoned"
+)
+
+const transactionTransitionSubject = "transactions.transitions"
+
+var (
+	errInvalidTransition  = errors.New("transaction status change is not allowed")
+	errTransitionConflict = errors.New("transaction status was changed by another request")
+)
+
+// TransactionTransition records a status change. ActorID is the operator who
+// made it, nil for changes made by the service itself.
+type TransactionTransition struct {
+	ID            uint   `gorm:"primaryKey"`
+	TransactionID uint   `gorm:"index;not null"`
+	FromStatus    string `gorm:"not null;default:''"`
+	ToStatus      string `gorm:"not null"`
+	Reason        string
+	ActorID       *uint
+	CreatedAt     time.Time
+}
+
+func canTransition(from, to string) bool {
+	return allowedTransition(transactionTransitions, from, to)
+}
+
+func allowedTransition(transitions map[string][]string, from, to string) bool {
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transitionTransaction changes the status of t inside tx. It fails if the
+// change is not allowed or if t no longer has the status it was read with.
+func transitionTransaction(tx *gorm.DB, t *Transaction, to, reason string, actorID *uint) (TransactionTransition, error) {
+	if !canTransition(t.Status, to) {
+		return TransactionTransition{}, fmt.Errorf("%w: %s to %s", errInvalidTransition, t.Status, to)
+	}
+	now := time.Now()
+	result := tx.Model(&Transaction{}).
+		Where("id = ? AND status = ?", t.ID, t.Status).
+		Updates(map[string]interface{}{"status": to, "status_reason": reason, "status_changed_at": now})
+	if result.Error != nil {
+		return TransactionTransition{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return TransactionTransition{}, errTransitionConflict
+	}
+
+	transition := TransactionTransition{
+		TransactionID: t.ID,
+		FromStatus:    t.Status,
+		ToStatus:      to,
+		Reason:        reason,
+		ActorID:       actorID,
+		CreatedAt:     now,
+	}
+	if err := tx.Create(&transition).Error; err != nil {
+		return TransactionTransition{}, err
+	}
+	t.Status, t.StatusReason, t.StatusChangedAt = to, reason, &now
+	return transition, nil
+}
+
+// createTransaction writes t as pending.
+func createTransaction(t *Transaction) error {
+	now := time.Now()
+	created := *t
+	created.Status, created.StatusReason, created.StatusChangedAt = TransactionPending, reasonCreated, &now
+	var transition TransactionTransition
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&created).Error; err != nil {
+			return err
+		}
+		transition = TransactionTransition{TransactionID: created.ID, ToStatus: TransactionPending, Reason: reasonCreated, CreatedAt: now}
+		return tx.Create(&transition).Error
+	})
+	if err != nil {
+		return err
+	}
+	*t = created
+	publishTransactionTransition(t, transition)
+	return nil
+}
+
+// changeTransactionStatus changes the status of t when no money moves with
+// it: holds and failures.
+func changeTransactionStatus(t *Transaction, to, reason string, actorID *uint) error {
+	return runStatusChange(t, func(tx *gorm.DB, current *Transaction) (TransactionTransition, error) {
+		return transitionTransaction(tx, current, to, reason, actorID)
+	})
+}
+
+// runStatusChange runs change on a copy of t in a retried database
+// transaction and, once it is committed, updates t and publishes the change.
+func runStatusChange(t *Transaction, change func(tx *gorm.DB, current *Transaction) (TransactionTransition, error)) error {
+	var updated Transaction
+	var transition TransactionTransition
+	err := runTransaction(func(tx *gorm.DB) error {
+		updated = *t
+		var err error
+		transition, err = change(tx, &updated)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	*t = updated
+	publishTransactionTransition(t, transition)
+	return nil
+}
+
+// failRefused fails a pending transaction that settling refused, or that
+// could not be settled at all.
+func failRefused(t *Transaction, err error) {
+	reason := reasonInternalError
+	var refused *refusal
+	if errors.As(err, &refused) && refused.reason != "" {
+		reason = refused.reason
+	}
+	if err := changeTransactionStatus(t, TransactionFailed, reason, nil); err != nil {
+		log.Printf("Failed to mark transaction %d as failed: %v", t.ID, err)
+	}
+}
+
+func failAbandonedTransactions() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		failed, err := failPendingBefore(time.Now().Add(-pendingTransactionTimeout))
+		if err != nil {
+			log.Printf("Failed to fail abandoned transactions: %v", err)
+		}
+		if failed > 0 {
+			log.Printf("Failed %d abandoned pending transactions", failed)
+		}
+	}
+}
+
+// failPendingBefore fails the transactions created before cutoff that are
+// still pending. No money moved for them, since it only moves as a
+// transaction leaves pending. A request still settling one loses the race on
+// its status and answers with an error.
+func failPendingBefore(cutoff time.Time) (int, error) {
+	var pending []Transaction
+	if err := db.Where("status = ? AND created_at < ?", TransactionPending, cutoff).Find(&pending).Error; err != nil {
+		return 0, err
+	}
+	failed := 0
+	for i := range pending {
+		err := changeTransactionStatus(&pending[i], TransactionFailed, reasonAbandoned, nil)
+		if errors.Is(err, errTransitionConflict) {
+			// Settled or failed by someone else meanwhile
+			continue
+		}
+		if err != nil {
+			return failed, err
+		}
+		failed++
+	}
+	return failed, nil
+}
+
+// holdTransaction puts a transaction fraud-service flagged on hold for an
+// operator to review and sends body with its ID and status.
+func holdTransaction(c echo.Context, t *Transaction, body map[string]interface{}) error {
+	if err := changeTransactionStatus(t, TransactionOnHold, reasonFraudSuspected, nil); err != nil {
+		log.Printf("Failed to hold transaction %d: %v", t.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to hold transaction"})
+	}
+	body["transaction_id"] = t.ID
+	body["status"] = t.Status
+	return c.JSON(http.StatusForbidden, body)
+}
+
+// settleTopUp credits a pending or held top-up and completes it. It returns
+// the user's new balance.
+func settleTopUp(t *Transaction, tier string, actorID *uint) (money.Money, error) {
+	limits := limitsFor(tier)
+	var balanceAfter money.Money
+	err := runStatusChange(t, func(tx *gorm.DB, current *Transaction) (TransactionTransition, error) {
+		if err := ensureBalance(tx, current.SenderID, current.Amount.Currency); err != nil {
+			return TransactionTransition{}, err
+		}
+		balances, err := lockBalances(tx, current.SenderID)
+		if err != nil {
+			return TransactionTransition{}, err
+		}
+		balance := balances[current.SenderID]
+		if balance == nil {
+			return TransactionTransition{}, gorm.ErrRecordNotFound
+		}
+		if balance.ClosedAt != nil {
+			return TransactionTransition{}, refuse(reasonAccountClosed, func(c echo.Context) error {
+				return c.JSON(http.StatusConflict, map[string]string{"error": "Account is closed"})
+			})
+		}
+
+		limit, max, err := exceededLimit(tx, current.SenderID, current.Amount, limits)
+		if err != nil {
+			return TransactionTransition{}, err
+		}
+		newBalance, err := balance.Balance.Add(current.Amount)
+		if err != nil {
+			return TransactionTransition{}, refuse(reasonInvalidAmount, func(c echo.Context) error { return invalidAmountResponse(c, err) })
+		}
+		if limit == "" && exceeds(newBalance, limits.MaxBalance) {
+			limit, max = limitBalance, limits.MaxBalance
+		}
+		if limit != "" {
+			return TransactionTransition{}, refuse(reasonLimitExceeded, func(c echo.Context) error {
+				return limitExceededResponse(c, "Top-up exceeds the limits of the account's verification tier", tier, limit, max)
+			})
+		}
+
+		if err := postTopUp(tx, current, balance); err != nil {
+			return TransactionTransition{}, err
+		}
+		balanceAfter = balance.Balance
+		return transitionTransaction(tx, current, TransactionCompleted, reasonSettled, actorID)
+	})
+	if err != nil {
+		return money.Money{}, err
+	}
+
+	publishTransactionEvent(t.ID, t.SenderID, t.Amount, "top_up", t.Status)
+	return balanceAfter, nil
+}
+
+// settleTransfer moves the money of a pending or held transfer and completes
+// it. It returns the sender's new balance. Refusals leave the transaction as
+// it was.
+func settleTransfer(t *Transaction, senderTier, recipientTier string, actorID *uint) (money.Money, error) {
+	recipientID := *t.RecipientID
+	var balanceAfter money.Money
+	err := runStatusChange(t, func(tx *gorm.DB, current *Transaction) (TransactionTransition, error) {
+		if err := ensureBalance(tx, recipientID, current.Amount.Currency); err != nil {
+			return TransactionTransition{}, err
+		}
+		balances, err := lockBalances(tx, current.SenderID, recipientID)
+		if err != nil {
+			return TransactionTransition{}, err
+		}
+		sender, recipient := balances[current.SenderID], balances[recipientID]
+		if recipient == nil {
+			return TransactionTransition{}, gorm.ErrRecordNotFound
+		}
+		if err := transferRefusal(tx, current.SenderID, sender, recipient, current.Amount, senderTier, recipientTier); err != nil {
+			return TransactionTransition{}, err
+		}
+
+		if err := postTransfer(tx, current, sender, recipient); err != nil {
+			return TransactionTransition{}, err
+		}
+		balanceAfter = sender.Balance
+		return transitionTransaction(tx, current, TransactionCompleted, reasonSettled, actorID)
+	})
+	if err != nil {
+		return money.Money{}, err
+	}
+
+	publishTransactionEvent(t.ID, t.SenderID, t.Amount, "transfer_sent", t.Status)
+	publishTransactionEvent(t.ID, recipientID, t.Amount, "transfer_received", t.Status)
+	return balanceAfter, nil
+}
+
+// transferRefusal returns the refusal for moving amount from sender to
+// recipient, or nil when the transfer may go ahead. sender is nil when the
+// sender has no balance.
+func transferRefusal(tx *gorm.DB, senderID uint, sender, recipient *Balance, amount money.Money, senderTier, recipientTier string) error {
+	senderLimits, recipientLimits := limitsFor(senderTier), limitsFor(recipientTier)
+	if sender == nil {
+		return refuse(reasonAccountNotFound, func(c echo.Context) error {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Sender balance not found"})
+		})
+	}
+	if recipient.ClosedAt != nil {
+		return refuse(reasonAccountClosed, func(c echo.Context) error {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Recipient account is closed"})
+		})
+	}
+
+	senderBalance, err := sender.Balance.Sub(amount)
+	if err != nil {
+		return refuse(reasonInvalidAmount, func(c echo.Context) error { return invalidAmountResponse(c, err) })
+	}
+	recipientBalance, err := recipient.Balance.Add(amount)
+	if err != nil {
+		return refuse(reasonInvalidAmount, func(c echo.Context) error { return invalidAmountResponse(c, err) })
+	}
+	if senderBalance.IsNegative() {
+		available := sender.Balance
+		return refuse(reasonInsufficientFunds, func(c echo.Context) error {
+			return c.JSON(http.StatusBadRequest, map[string]interface{}{
+				"error":    "Insufficient funds",
+				"balance":  available.String(),
+				"required": amount.String(),
+				"currency": amount.Currency,
+			})
+		})
+	}
+
+	limit, max, err := exceededLimit(tx, senderID, amount, senderLimits)
+	if err != nil {
+		return err
+	}
+	if limit != "" {
+		return refuse(reasonLimitExceeded, func(c echo.Context) error {
+			return limitExceededResponse(c, "Transfer exceeds the limits of your verification tier", senderTier, limit, max)
+		})
+	}
+	if exceeds(recipientBalance, recipientLimits.MaxBalance) {
+		return refuse(reasonLimitExceeded, func(c echo.Context) error {
+			return limitExceededResponse(c, "Recipient's balance would exceed the limit of their verification tier", recipientTier, limitBalance, recipientLimits.MaxBalance)
+		})
+	}
+	return nil
+}
+
+// precheckTransfer runs the checks of settleTransfer against the current
+// balances without locking them, so a transfer that would be refused is
+// answered before anything single-use, like a step-up token, is spent on it.
+// settleTransfer checks again once the balances are locked.
+func precheckTransfer(senderID, recipientID uint, amount money.Money, senderTier, recipientTier string) error {
+	var balances []Balance
+	if err := db.Where("user_id IN ?", []uint{senderID, recipientID}).Find(&balances).Error; err != nil {
+		return err
+	}
+	var sender *Balance
+	// A recipient without a balance gets an empty one when the transfer settles
+	recipient := &Balance{UserID: recipientID, Balance: money.Zero(amount.Currency)}
+	for i := range balances {
+		switch balances[i].UserID {
+		case senderID:
+			sender = &balances[i]
+		case recipientID:
+			recipient = &balances[i]
+		}
+	}
+	return transferRefusal(db, senderID, sender, recipient, amount, senderTier, recipientTier)
+}
+
+// reverseTransaction returns the money of a completed transaction to where it
+// came from. The account that received it must still hold it. A payment moved
+// no money, so only its status changes.
+func reverseTransaction(t *Transaction, reason string, actorID *uint) error {
+	if t.TransactionType == "payment" {
+		return changeTransactionStatus(t, TransactionReversed, reason, actorID)
+	}
+	err := runStatusChange(t, func(tx *gorm.DB, current *Transaction) (TransactionTransition, error) {
+		if !canTransition(current.Status, TransactionReversed) {
+			return TransactionTransition{}, fmt.Errorf("%w: %s to %s", errInvalidTransition, current.Status, TransactionReversed)
+		}
+		userIDs := []uint{current.SenderID}
+		receiverID := current.SenderID
+		if current.RecipientID != nil {
+			receiverID = *current.RecipientID
+			userIDs = append(userIDs, receiverID)
+		}
+		balances, err := lockBalances(tx, userIDs...)
+		if err != nil {
+			return TransactionTransition{}, err
+		}
+		receiver := balances[receiverID]
+		if receiver == nil {
+			return TransactionTransition{}, gorm.ErrRecordNotFound
+		}
+		if left, err := receiver.Balance.Sub(current.Amount); err != nil || left.IsNegative() {
+			return TransactionTransition{}, refuse(reasonInsufficientFunds, func(c echo.Context) error {
+				return c.JSON(http.StatusConflict, map[string]string{
+					"error": "The account that received the money no longer holds it",
+					"code":  "reversal_insufficient_funds",
+				})
+			})
+		}
+
+		if err := postReversal(tx, current, balances[current.SenderID], balances[receiverID]); err != nil {
+			return TransactionTransition{}, err
+		}
+		return transitionTransaction(tx, current, TransactionReversed, reason, actorID)
+	})
+	if err != nil {
+		return err
+	}
+
+	if t.RecipientID != nil {
+		publishTransactionEvent(t.ID, t.SenderID, t.Amount, "transfer_reversed", t.Status)
+		publishTransactionEvent(t.ID, *t.RecipientID, t.Amount, "transfer_reversed", t.Status)
+	} else {
+		publishTransactionEvent(t.ID, t.SenderID, t.Amount, "top_up_reversed", t.Status)
+	}
+	return nil
+}
+
+func publishTransactionTransition(t *Transaction, transition TransactionTransition) {
+	if natsConn == nil {
+		return
+	}
+	event := map[string]interface{}{
+		"transaction_id": t.ID,
+		"type":           t.TransactionType,
+		"sender_id":      t.SenderID,
+		"recipient_id":   t.RecipientID,
+		"amount":         t.Amount.String(),
+		"amount_minor":   t.Amount.Minor,
+		"currency":       t.Amount.Currency,
+		"from":           transition.FromStatus,
+		"to":             transition.ToStatus,
+		"reason":         transition.Reason,
+		"actor_id":       transition.ActorID,
+		"timestamp":      transition.CreatedAt,
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal transaction transition: %v", err)
+		return
+	}
+	if err := natsConn.Publish(transactionTransitionSubject, data); err != nil {
+		log.Printf("Failed to publish transition of transaction %d: %v", t.ID, err)
+	}
+}
+
+// updateTransactionStatus lets operators release or reject a held transaction
+// and reverse a completed one, and nothing else. A reason is required for the
+// record.
+func updateTransactionStatus(c echo.Context) error {
+	type StatusRequest struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	var req StatusRequest
+	if err := c.Bind(&req); err != nil || req.Reason == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "status and reason are required"})
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid transaction id"})
+	}
+	var transaction Transaction
+	if err := db.First(&transaction, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Transaction not found"})
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
+	}
+	if !allowedTransition(operatorTransitions, transaction.Status, req.Status) {
+		return invalidTransitionResponse(c, transaction.Status, req.Status)
+	}
+	var actorID *uint
+	if id, ok := authz.UserID(c); ok {
+		actorID = &id
+	}
+
+	switch req.Status {
+	case TransactionCompleted:
+		// Only held transactions get here; settle them as their owners would
+		// have. A pending one is still being settled by its own request
+		if transaction.TransactionType == "payment" {
+			err = changeTransactionStatus(&transaction, TransactionCompleted, req.Reason, actorID)
+			break
+		}
+		senderTier, tierErr := accountTier(c, transaction.SenderID)
+		if tierErr != nil {
+			return accountTierError(c, tierErr)
+		}
+		if transaction.RecipientID == nil {
+			_, err = settleTopUp(&transaction, senderTier, actorID)
+			break
+		}
+		recipientTier, tierErr := accountTier(c, *transaction.RecipientID)
+		if tierErr != nil {
+			return accountTierError(c, tierErr)
+		}
+		_, err = settleTransfer(&transaction, senderTier, recipientTier, actorID)
+	case TransactionReversed:
+		err = reverseTransaction(&transaction, req.Reason, actorID)
+	default:
+		err = changeTransactionStatus(&transaction, req.Status, req.Reason, actorID)
+	}
+
+	var refused *refusal
+	switch {
+	case errors.As(err, &refused):
+		return refused.respond(c)
+	case errors.Is(err, errInvalidTransition), errors.Is(err, errTransitionConflict):
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Transaction status changed, reload it and try again", "code": "transition_conflict"})
+	case err != nil:
+		log.Printf("Failed to change status of transaction %d to %s: %v", transaction.ID, req.Status, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to change transaction status"})
+	}
+	return c.JSON(http.StatusOK, transaction)
+}
+
+func invalidTransitionResponse(c echo.Context, from, to string) error {
+	return c.JSON(http.StatusConflict, map[string]interface{}{
+		"error":   "Transaction cannot change from " + from + " to " + to,
+		"code":    "invalid_transition",
+		"from":    from,
+		"to":      to,
+		"allowed": operatorTransitions[from],
+	})
+}
@@ -2,6 +2,10 @@ CREATE TABLE IF NOT EXISTS users (
     id SERIAL PRIMARY KEY,
     phone_number VARCHAR(20) UNIQUE NOT NULL,
     password_hash VARCHAR(255) NOT NULL,
+    kyc_tier VARCHAR(20) NOT NULL DEFAULT 'unverified',
+    pin_hash VARCHAR(255),
+    pin_required BOOLEAN NOT NULL DEFAULT FALSE,
+    pin_set_at TIMESTAMP,
     created_at TIMESTAMP NOT NULL DEFAULT NOW(),
     updated_at TIMESTAMP NOT NULL DEFAULT NOW()
 );
@@ -9,7 +13,8 @@ CREATE TABLE IF NOT EXISTS users (
 CREATE TABLE IF NOT EXISTS balances (
     id SERIAL PRIMARY KEY,
     user_id INT NOT NULL REFERENCES users(id),
-    amount DECIMAL(15, 2) NOT NULL DEFAULT 0.0,
+    balance_minor BIGINT NOT NULL DEFAULT 0,
+    balance_currency VARCHAR(3) NOT NULL,
     version INT NOT NULL DEFAULT 0,
     created_at TIMESTAMP NOT NULL DEFAULT NOW(),
     updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
@@ -20,26 +25,235 @@ CREATE TABLE IF NOT EXISTS transactions (
     id SERIAL PRIMARY KEY,
     transaction_type VARCHAR(50) NOT NULL,
     user_id INT NOT NULL REFERENCES users(id),
-    amount DECIMAL(15, 2) NOT NULL,
+    amount_minor BIGINT NOT NULL,
+    amount_currency VARCHAR(3) NOT NULL,
     recipient_id INT REFERENCES users(id),
     status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    status_reason TEXT,
+    status_changed_at TIMESTAMP,
     created_at TIMESTAMP NOT NULL DEFAULT NOW(),
     updated_at TIMESTAMP NOT NULL DEFAULT NOW()
 );
 
+CREATE TABLE IF NOT EXISTS transaction_transitions (
+    id SERIAL PRIMARY KEY,
+    transaction_id INT NOT NULL REFERENCES transactions(id),
+    from_status VARCHAR(20) NOT NULL DEFAULT '',
+    to_status VARCHAR(20) NOT NULL,
+    reason TEXT,
+    actor_id INT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS ledger_accounts (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(64) NOT NULL,
+    currency VARCHAR(3) NOT NULL,
+    type VARCHAR(20) NOT NULL,
+    user_id INT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    CONSTRAINT idx_ledger_accounts_code_currency UNIQUE (code, currency)
+);
+
+CREATE TABLE IF NOT EXISTS journal_entries (
+    id SERIAL PRIMARY KEY,
+    transaction_id INT REFERENCES transactions(id),
+    description TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS postings (
+    id SERIAL PRIMARY KEY,
+    journal_entry_id INT NOT NULL REFERENCES journal_entries(id),
+    account_id INT NOT NULL REFERENCES ledger_accounts(id),
+    amount_minor BIGINT NOT NULL,
+    amount_currency VARCHAR(3) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    user_id INT NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    fingerprint VARCHAR(64) NOT NULL,
+    status_code INT NOT NULL DEFAULT 0,
+    response BYTEA,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, key)
+);
+
 CREATE TABLE IF NOT EXISTS refresh_tokens (
     id SERIAL PRIMARY KEY,
     user_id INT NOT NULL REFERENCES users(id),
-    token VARCHAR(255) NOT NULL,
+    family_id VARCHAR(64) NOT NULL,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    rotated_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    device_name VARCHAR(100),
+    device_hash VARCHAR(64) NOT NULL DEFAULT '',
+    user_agent VARCHAR(255),
+    ip_address VARCHAR(45),
+    last_used_at TIMESTAMP,
+    session_created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    client_id VARCHAR(64) NOT NULL DEFAULT '',
+    scope TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id INT NOT NULL REFERENCES users(id),
+    role VARCHAR(32) NOT NULL,
+    granted_by INT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, role)
+);
+
+CREATE TABLE IF NOT EXISTS o_auth_clients (
+    id VARCHAR(64) PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    secret_hash VARCHAR(64),
+    redirect_uris TEXT,
+    scopes TEXT NOT NULL,
+    grant_types TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS o_auth_authorization_codes (
+    code_hash VARCHAR(64) PRIMARY KEY,
+    client_id VARCHAR(64) NOT NULL,
+    user_id INT NOT NULL REFERENCES users(id),
+    redirect_uri TEXT NOT NULL,
+    scope TEXT,
+    nonce TEXT,
+    code_challenge VARCHAR(128) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS o_auth_consents (
+    user_id INT NOT NULL REFERENCES users(id),
+    client_id VARCHAR(64) NOT NULL,
+    scope TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, client_id)
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id),
+    name VARCHAR(100) NOT NULL,
+    prefix VARCHAR(12) NOT NULL UNIQUE,
+    key_hash VARCHAR(64) NOT NULL,
+    scopes TEXT NOT NULL,
+    allowed_ips TEXT,
     expires_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP,
+    last_used_ip VARCHAR(45),
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS trusted_devices (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id),
+    device_hash VARCHAR(64) NOT NULL,
+    name VARCHAR(100),
+    user_agent VARCHAR(255),
+    ip_address VARCHAR(45),
+    last_used_at TIMESTAMP NOT NULL DEFAULT NOW(),
     created_at TIMESTAMP NOT NULL DEFAULT NOW(),
-    CONSTRAINT unique_user_token UNIQUE (user_id, token)
+    UNIQUE (user_id, device_hash)
+);
+
+CREATE TABLE IF NOT EXISTS kyc_documents (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id),
+    type VARCHAR(32) NOT NULL,
+    file_name VARCHAR(255),
+    content_type VARCHAR(64) NOT NULL,
+    size BIGINT NOT NULL,
+    sha256 VARCHAR(64) NOT NULL,
+    storage_path VARCHAR(255) NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    reviewed_by INT,
+    review_note TEXT,
+    reviewed_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS kyc_tier_changes (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id),
+    from_tier VARCHAR(20) NOT NULL,
+    to_tier VARCHAR(20) NOT NULL,
+    changed_by INT,
+    note TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS impersonations (
+    id SERIAL PRIMARY KEY,
+    session_id VARCHAR(64) UNIQUE NOT NULL,
+    agent_id INT NOT NULL REFERENCES users(id),
+    user_id INT NOT NULL REFERENCES users(id),
+    reason TEXT NOT NULL,
+    read_only BOOLEAN NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    ended_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS impersonation_requests (
+    id SERIAL PRIMARY KEY,
+    session_id VARCHAR(64) NOT NULL,
+    service VARCHAR(100) NOT NULL,
+    method VARCHAR(10) NOT NULL,
+    path VARCHAR(255) NOT NULL,
+    status INT,
+    ip_address VARCHAR(45),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS auth_events (
+    id SERIAL PRIMARY KEY,
+    user_id INT,
+    phone_number VARCHAR(20),
+    type VARCHAR(32) NOT NULL,
+    outcome VARCHAR(16) NOT NULL,
+    reason VARCHAR(64),
+    session_id VARCHAR(64),
+    ip_address VARCHAR(45),
+    user_agent VARCHAR(255),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
 );
 
 CREATE INDEX IF NOT EXISTS idx_transactions_user_id ON transactions(user_id);
 CREATE INDEX IF NOT EXISTS idx_transactions_recipient_id ON transactions(recipient_id);
 CREATE INDEX IF NOT EXISTS idx_transactions_status ON transactions(status);
-CREATE INDEX IF NOT EXISTS idx_refresh_tokens_token ON refresh_tokens(token);
+CREATE INDEX IF NOT EXISTS idx_transaction_transitions_transaction_id ON transaction_transitions(transaction_id);
+CREATE INDEX IF NOT EXISTS idx_ledger_accounts_user_id ON ledger_accounts(user_id);
+CREATE INDEX IF NOT EXISTS idx_journal_entries_transaction_id ON journal_entries(transaction_id);
+CREATE INDEX IF NOT EXISTS idx_postings_journal_entry_id ON postings(journal_entry_id);
+CREATE INDEX IF NOT EXISTS idx_postings_account_id ON postings(account_id);
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_client_id ON refresh_tokens(client_id);
+CREATE INDEX IF NOT EXISTS idx_api_keys_user_id ON api_keys(user_id);
+CREATE INDEX IF NOT EXISTS idx_kyc_documents_user_id ON kyc_documents(user_id);
+CREATE INDEX IF NOT EXISTS idx_kyc_documents_status ON kyc_documents(status);
+CREATE INDEX IF NOT EXISTS idx_kyc_tier_changes_user_id ON kyc_tier_changes(user_id);
+CREATE INDEX IF NOT EXISTS idx_impersonations_agent_id ON impersonations(agent_id);
+CREATE INDEX IF NOT EXISTS idx_impersonations_user_id ON impersonations(user_id);
+CREATE INDEX IF NOT EXISTS idx_impersonation_requests_session_id ON impersonation_requests(session_id);
+CREATE INDEX IF NOT EXISTS idx_auth_events_user_id ON auth_events(user_id);
+CREATE INDEX IF NOT EXISTS idx_auth_events_phone_number ON auth_events(phone_number);
+CREATE INDEX IF NOT EXISTS idx_auth_events_created_at ON auth_events(created_at);
+CREATE INDEX IF NOT EXISTS idx_o_auth_authorization_codes_client_id ON o_auth_authorization_codes(client_id);
 
 INSERT INTO users (phone_number, password_hash) 
 VALUES 
@@ -47,28 +261,28 @@ VALUES
     ('+79009876543', '$2a$10$NUIwJJj.zOcPKH.YX.OXUe5vNOK.BL0GZpCgKFn5TW8aXvBtkn.xW') 
 ON CONFLICT (phone_number) DO NOTHING;
 
-INSERT INTO balances (user_id, amount)
-SELECT id, 1000.00 FROM users WHERE phone_number = '+79001234567'
+INSERT INTO balances (user_id, balance_minor, balance_currency)
+SELECT id, 100000, 'KZT' FROM users WHERE phone_number = '+79001234567'
 ON CONFLICT (user_id) DO NOTHING;
 
-INSERT INTO balances (user_id, amount)
-SELECT id, 500.00 FROM users WHERE phone_number = '+79009876543'
+INSERT INTO balances (user_id, balance_minor, balance_currency)
+SELECT id, 50000, 'KZT' FROM users WHERE phone_number = '+79009876543'
 ON CONFLICT (user_id) DO NOTHING;
 
-INSERT INTO transactions (transaction_type, user_id, amount, recipient_id, status)
-SELECT 'top_up', u1.id, 1000.00, NULL, 'completed'
+INSERT INTO transactions (transaction_type, user_id, amount_minor, amount_currency, recipient_id, status)
+SELECT 'top_up', u1.id, 100000, 'KZT', NULL, 'completed'
 FROM users u1
 WHERE u1.phone_number = '+79001234567'
 LIMIT 1;
 
-INSERT INTO transactions (transaction_type, user_id, amount, recipient_id, status)
-SELECT 'top_up', u2.id, 500.00, NULL, 'completed'
+INSERT INTO transactions (transaction_type, user_id, amount_minor, amount_currency, recipient_id, status)
+SELECT 'top_up', u2.id, 50000, 'KZT', NULL, 'completed'
 FROM users u2
 WHERE u2.phone_number = '+79009876543'
 LIMIT 1;
 
-INSERT INTO transactions (transaction_type, user_id, amount, recipient_id, status)
-SELECT 'transfer', u1.id, 200.00, u2.id, 'completed'
+INSERT INTO transactions (transaction_type, user_id, amount_minor, amount_currency, recipient_id, status)
+SELECT 'transfer', u1.id, 20000, 'KZT', u2.id, 'completed'
 FROM users u1, users u2
 WHERE u1.phone_number = '+79001234567' AND u2.phone_number = '+79009876543'
 LIMIT 1;
\ No newline at end of file
@@ -0,0 +1,206 @@
+// Package authz holds the role and permission model shared by all services and
+// echo middleware to enforce it. auth-service puts the roles of a user into the
+// roles claim of the access token; other services map them to permissions here.
+package authz
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	RoleUser         = "user"
+	RoleSupport      = "support"
+	RoleFraudAnalyst = "fraud_analyst"
+	RoleAdmin        = "admin"
+)
+
+const (
+	PermTransactionsCreate  = "transactions:create"
+	PermBalanceReadAny      = "balance:read_any"
+	PermTransactionsReadAny = "transactions:read_any"
+	PermFraudCheck          = "fraud:check"
+	PermFraudRulesRead      = "fraud_rules:read"
+	PermFraudRulesWrite     = "fraud_rules:write"
+	PermFraudCasesRead      = "fraud_cases:read"
+	PermUsersRead           = "users:read"
+	PermUsersManage         = "users:manage"
+	PermRolesManage         = "roles:manage"
+	PermOAuthClientsManage  = "oauth_clients:manage"
+	PermKYCReview           = "kyc:review"
+	PermUsersImpersonate    = "users:impersonate"
+	PermLedgerAudit         = "ledger:audit"
+	PermTransactionsManage  = "transactions:manage"
+)
+
+var AllPermissions = []string{
+	PermTransactionsCreate,
+	PermBalanceReadAny,
+	PermTransactionsReadAny,
+	PermFraudCheck,
+	PermFraudRulesRead,
+	PermFraudRulesWrite,
+	PermFraudCasesRead,
+	PermUsersRead,
+	PermUsersManage,
+	PermRolesManage,
+	PermOAuthClientsManage,
+	PermKYCReview,
+	PermUsersImpersonate,
+	PermLedgerAudit,
+	PermTransactionsManage,
+}
+
+// RolePermissions lists what every role may do. Admins may do everything.
+var RolePermissions = map[string][]string{
+	RoleUser: {
+		PermTransactionsCreate,
+	},
+	RoleSupport: {
+		PermBalanceReadAny,
+		PermTransactionsReadAny,
+		PermFraudCasesRead,
+		PermUsersRead,
+		PermKYCReview,
+	},
+	RoleFraudAnalyst: {
+		PermTransactionsReadAny,
+		PermFraudCheck,
+		PermFraudRulesRead,
+		PermFraudRulesWrite,
+		PermFraudCasesRead,
+	},
+}
+
+const (
+	ContextUserIDKey = "user_id"
+	ContextRolesKey  = "roles"
+	// ContextScopesKey is set for API keys, which may only use the
+	// permissions they were created with.
+	ContextScopesKey = "scopes"
+	// ContextSessionIDKey is the login session of a bearer token.
+	ContextSessionIDKey = "session_id"
+)
+
+func ValidRole(role string) bool {
+	if role == RoleAdmin {
+		return true
+	}
+	_, ok := RolePermissions[role]
+	return ok
+}
+
+func ValidPermission(permission string) bool {
+	return contains(AllPermissions, permission)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func HasPermission(roles []string, permission string) bool {
+	for _, role := range roles {
+		if role == RoleAdmin {
+			return true
+		}
+		for _, p := range RolePermissions[role] {
+			if p == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RolesFromClaim converts the roles claim as decoded from JSON.
+func RolesFromClaim(claim interface{}) []string {
+	switch v := claim.(type) {
+	case []string:
+		return v
+	case []interface{}:
+		roles := make([]string, 0, len(v))
+		for _, r := range v {
+			if s, ok := r.(string); ok {
+				roles = append(roles, s)
+			}
+		}
+		return roles
+	}
+	return nil
+}
+
+func Roles(c echo.Context) []string {
+	return RolesFromClaim(c.Get(ContextRolesKey))
+}
+
+// Allowed reports whether the caller's roles grant permission and, for API
+// keys, whether the key was scoped to it.
+func Allowed(c echo.Context, permission string) bool {
+	if !HasPermission(Roles(c), permission) {
+		return false
+	}
+	if scopes, limited := c.Get(ContextScopesKey).([]string); limited {
+		return contains(scopes, permission)
+	}
+	return true
+}
+
+// UserID returns the authenticated user, which services store either as uint
+// or as the float64 decoded from the token claims.
+func UserID(c echo.Context) (uint, bool) {
+	switch v := c.Get(ContextUserIDKey).(type) {
+	case uint:
+		return v, true
+	case float64:
+		return uint(v), true
+	}
+	return 0, false
+}
+
+func forbidden(c echo.Context) error {
+	return c.JSON(http.StatusForbidden, map[string]string{"error": "Insufficient permissions"})
+}
+
+// RequirePermission allows the request only if the roles of the caller grant
+// every listed permission and, for API keys, the key is scoped to them. It
+// must run after the authentication middleware.
+func RequirePermission(permissions ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			for _, p := range permissions {
+				if !Allowed(c, p) {
+					return forbidden(c)
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+// RequireSelfOrPermission lets users access resources addressed by their own
+// ID in the path parameter param; everyone else needs permission.
+func RequireSelfOrPermission(param, permission string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			userID, ok := UserID(c)
+			if !ok {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+			}
+			target, err := strconv.ParseUint(c.Param(param), 10, 64)
+			if err == nil && uint(target) == userID {
+				return next(c)
+			}
+			if !Allowed(c, permission) {
+				return forbidden(c)
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package authz
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ClientIPExtractor returns the echo.IPExtractor for a service behind nginx.
+// trustedProxies is a comma-separated list of CIDRs or addresses. The client
+// IP is the rightmost X-Forwarded-For entry that was not added by a trusted
+// proxy, and the header is ignored on requests that did not come through one,
+// so a client cannot pick the IP that allowlists and rate limits see. Private
+// and loopback ranges are not trusted unless listed.
+func ClientIPExtractor(trustedProxies string) (echo.IPExtractor, error) {
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, entry := range strings.Split(trustedProxies, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		options = append(options, echo.TrustIPRange(network))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
@@ -0,0 +1,53 @@
+package authz
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// An impersonation token lets a support agent act as a customer. It carries
+// the customer's identity and an act claim naming the agent; services store
+// the agent under ContextActorIDKey.
+const (
+	ContextActorIDKey  = "actor_id"
+	ContextReadOnlyKey = "read_only"
+)
+
+// ActorID returns the agent behind an impersonation token.
+func ActorID(c echo.Context) (uint, bool) {
+	id, ok := c.Get(ContextActorIDKey).(uint)
+	return id, ok && id != 0
+}
+
+func Impersonated(c echo.Context) bool {
+	_, ok := ActorID(c)
+	return ok
+}
+
+// SafeMethod reports whether a request with method only reads.
+func SafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// ReadOnlyViolation reports whether a read-only impersonation token is used
+// for a request that changes something.
+func ReadOnlyViolation(c echo.Context) bool {
+	readOnly, _ := c.Get(ContextReadOnlyKey).(bool)
+	return Impersonated(c) && readOnly && !SafeMethod(c.Request().Method)
+}
+
+func ReadOnlyResponse(c echo.Context) error {
+	return c.JSON(http.StatusForbidden, map[string]string{"error": "Impersonation token is read-only", "code": "impersonation_read_only"})
+}
+
+// RefuseImpersonation guards operations an agent must never perform on a
+// customer's behalf, such as moving money.
+func RefuseImpersonation(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if Impersonated(c) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Not allowed while impersonating a user", "code": "impersonation_forbidden"})
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,38 @@
+package authz
+
+import "github.com/labstack/echo/v4"
+
+// KYC tiers from least to most verified. auth-service puts the tier of the
+// user into the kyc_tier claim; payment-service derives account limits from it.
+const (
+	KYCTierUnverified = "unverified"
+	KYCTierBasic      = "basic"
+	KYCTierFull       = "full"
+)
+
+var KYCTiers = []string{KYCTierUnverified, KYCTierBasic, KYCTierFull}
+
+const ContextKYCTierKey = "kyc_tier"
+
+func ValidKYCTier(tier string) bool {
+	return contains(KYCTiers, tier)
+}
+
+// KYCTierRank orders tiers so that a downgrade can be told from an upgrade.
+func KYCTierRank(tier string) int {
+	for i, t := range KYCTiers {
+		if t == tier {
+			return i
+		}
+	}
+	return -1
+}
+
+// KYCTier returns the caller's tier. Tokens issued before tiers existed
+// count as unverified.
+func KYCTier(c echo.Context) string {
+	if tier, _ := c.Get(ContextKYCTierKey).(string); ValidKYCTier(tier) {
+		return tier
+	}
+	return KYCTierUnverified
+}
@@ -0,0 +1,103 @@
+package authz
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type TokenInfo struct {
+	Valid       bool     `json:"valid"`
+	UserID      uint     `json:"user_id"`
+	PhoneNumber string   `json:"phone_number"`
+	Roles       []string `json:"roles"`
+	Scopes      []string `json:"scopes"`
+	ActorID     uint     `json:"actor_id,omitempty"`
+	ReadOnly    bool     `json:"read_only,omitempty"`
+}
+
+var checkClient = http.Client{Timeout: 3 * time.Second}
+
+// CheckToken validates an access token against the /check endpoint of auth-service.
+func CheckToken(checkURL, tokenString string) (*TokenInfo, error) {
+	return CheckCredentials(checkURL, "Bearer "+tokenString, "")
+}
+
+// CheckCredentials validates an Authorization header value, either a bearer
+// token or an API key. clientIP is checked against the API key's allowlist.
+func CheckCredentials(checkURL, authorization, clientIP string) (*TokenInfo, error) {
+	return checkCredentials(checkURL, authorization, clientIP, nil)
+}
+
+// checkCredentials forwards the method and path of the original request, if
+// any, so auth-service can log what an impersonation token was used for.
+func checkCredentials(checkURL, authorization, clientIP string, original *http.Request) (*TokenInfo, error) {
+	req, err := http.NewRequest(http.MethodGet, checkURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authorization)
+	if clientIP != "" {
+		req.Header.Set("X-Forwarded-For", clientIP)
+	}
+	if original != nil {
+		req.Header.Set("X-Forwarded-Host", original.Host)
+		req.Header.Set("X-Forwarded-Method", original.Method)
+		req.Header.Set("X-Forwarded-Uri", original.URL.RequestURI())
+	}
+
+	resp, err := checkClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("token validation failed")
+	}
+
+	var info TokenInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	if !info.Valid || info.UserID == 0 {
+		return nil, errors.New("invalid token response")
+	}
+	return &info, nil
+}
+
+// Authenticate validates the bearer token or API key with auth-service and
+// stores the user ID, roles and key scopes in the context for RequirePermission.
+func Authenticate(checkURL string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			authHeader := c.Request().Header.Get("Authorization")
+			if !strings.HasPrefix(authHeader, "Bearer ") && !strings.HasPrefix(authHeader, "ApiKey ") {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Missing or invalid Authorization header"})
+			}
+
+			info, err := checkCredentials(checkURL, authHeader, c.RealIP(), c.Request())
+			if err != nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid token"})
+			}
+
+			c.Set(ContextUserIDKey, info.UserID)
+			c.Set(ContextRolesKey, info.Roles)
+			if info.Scopes != nil {
+				c.Set(ContextScopesKey, info.Scopes)
+			}
+			if info.ActorID != 0 {
+				c.Set(ContextActorIDKey, info.ActorID)
+				c.Set(ContextReadOnlyKey, info.ReadOnly)
+				if ReadOnlyViolation(c) {
+					return ReadOnlyResponse(c)
+				}
+			}
+			return next(c)
+		}
+	}
+}
@@ -25,7 +25,9 @@ type FraudCheckRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	TransactionId uint64                 `protobuf:"varint,1,opt,name=transaction_id,json=transactionId,proto3" json:"transaction_id,omitempty"`
 	UserId        uint64                 `protobuf:"varint,2,opt,name=user_id,json=userId,proto3" json:"user_id,omitempty"`
-	Amount        float64                `protobuf:"fixed64,3,opt,name=amount,proto3" json:"amount,omitempty"`
+	// Amount in minor units of currency, e.g. 1250 for 12.50 KZT.
+	AmountMinor   int64  `protobuf:"varint,4,opt,name=amount_minor,json=amountMinor,proto3" json:"amount_minor,omitempty"`
+	Currency      string `protobuf:"bytes,5,opt,name=currency,proto3" json:"currency,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -74,13 +76,20 @@ func (x *FraudCheckRequest) GetUserId() uint64 {
 	return 0
 }
 
-func (x *FraudCheckRequest) GetAmount() float64 {
+func (x *FraudCheckRequest) GetAmountMinor() int64 {
 	if x != nil {
-		return x.Amount
+		return x.AmountMinor
 	}
 	return 0
 }
 
+func (x *FraudCheckRequest) GetCurrency() string {
+	if x != nil {
+		return x.Currency
+	}
+	return ""
+}
+
 type FraudCheckResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	FraudScore    float64                `protobuf:"fixed64,1,opt,name=fraud_score,json=fraudScore,proto3" json:"fraud_score,omitempty"`
@@ -137,11 +146,12 @@ var File_shared_fraud_proto protoreflect.FileDescriptor
 
 const file_shared_fraud_proto_rawDesc = "" +
 	"\n" +
-	"\x12shared/fraud.proto\x12\x05fraud\"k\n" +
+	"\x12shared/fraud.proto\x12\x05fraud\"\xa0\x01\n" +
 	"\x11FraudCheckRequest\x12%\n" +
 	"\x0etransaction_id\x18\x01 \x01(\x04R\rtransactionId\x12\x17\n" +
-	"\auser_id\x18\x02 \x01(\x04R\x06userId\x12\x16\n" +
-	"\x06amount\x18\x03 \x01(\x01R\x06amount\"M\n" +
+	"\auser_id\x18\x02 \x01(\x04R\x06userId\x12!\n" +
+	"\famount_minor\x18\x04 \x01(\x03R\vamountMinor\x12\x1a\n" +
+	"\bcurrency\x18\x05 \x01(\tR\bcurrencyJ\x04\b\x03\x10\x04R\x06amount\"M\n" +
 	"\x12FraudCheckResponse\x12\x1f\n" +
 	"\vfraud_score\x18\x01 \x01(\x01R\n" +
 	"fraudScore\x12\x16\n" +
@@ -0,0 +1,211 @@
+// Package money represents amounts exactly, as integer minor units (tiyn,
+// cents) of a currency. Amounts cross service boundaries as decimal strings
+// or minor units, never as floats.
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is the account currency of a service not configured with
+// another one.
+const DefaultCurrency = "KZT"
+
+// exponents maps the supported ISO 4217 codes to their number of decimal places.
+var exponents = map[string]int{
+	"KZT": 2,
+	"USD": 2,
+	"EUR": 2,
+	"RUB": 2,
+}
+
+var (
+	ErrInvalidAmount    = errors.New("amount must be a decimal number such as 12.50")
+	ErrTooManyDecimals  = errors.New("amount has more decimal places than the currency allows")
+	ErrUnknownCurrency  = errors.New("unsupported currency")
+	ErrCurrencyMismatch = errors.New("amounts are in different currencies")
+	ErrOverflow         = errors.New("amount is too large")
+)
+
+// Money is an amount in minor units of Currency. The GORM models embed it
+// with a column prefix, giving <prefix>minor and <prefix>currency columns.
+// The currency column has no default: every row names its currency.
+type Money struct {
+	Minor    int64  `gorm:"not null;default:0"`
+	Currency string `gorm:"size:3;not null"`
+}
+
+// New returns minor units of currency.
+func New(minor int64, currency string) Money {
+	return Money{Minor: minor, Currency: currency}
+}
+
+// Zero returns no money in currency.
+func Zero(currency string) Money {
+	return Money{Currency: currency}
+}
+
+// ValidCurrency reports whether currency is supported.
+func ValidCurrency(currency string) bool {
+	_, ok := exponents[currency]
+	return ok
+}
+
+// Exponent returns the number of decimal places of currency.
+func Exponent(currency string) (int, error) {
+	exp, ok := exponents[currency]
+	if !ok {
+		return 0, ErrUnknownCurrency
+	}
+	return exp, nil
+}
+
+// Parse reads a decimal string such as "12", "12.5" or "-0.05". Exponents,
+// signs other than a leading minus, separators and more decimal places than
+// the currency has are rejected rather than rounded.
+func Parse(amount, currency string) (Money, error) {
+	exp, err := Exponent(currency)
+	if err != nil {
+		return Money{}, err
+	}
+
+	digits := amount
+	negative := strings.HasPrefix(digits, "-")
+	if negative {
+		digits = digits[1:]
+	}
+	whole, fraction, hasPoint := strings.Cut(digits, ".")
+	if whole == "" || (hasPoint && fraction == "") || !allDigits(whole) || !allDigits(fraction) {
+		return Money{}, ErrInvalidAmount
+	}
+	if len(fraction) > exp {
+		return Money{}, ErrTooManyDecimals
+	}
+
+	minor, err := strconv.ParseInt(whole+fraction+strings.Repeat("0", exp-len(fraction)), 10, 64)
+	if err != nil {
+		if errors.Is(err, strconv.ErrRange) {
+			return Money{}, ErrOverflow
+		}
+		return Money{}, ErrInvalidAmount
+	}
+	if negative {
+		minor = -minor
+	}
+	return Money{Minor: minor, Currency: currency}, nil
+}
+
+func allDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats m as a decimal with all of the currency's decimal places,
+// without the currency code.
+func (m Money) String() string {
+	exp, err := Exponent(m.Currency)
+	if err != nil || exp == 0 {
+		return strconv.FormatInt(m.Minor, 10)
+	}
+
+	sign := ""
+	minor := m.Minor
+	if minor < 0 {
+		sign = "-"
+	}
+	// Format the magnitude from the unsigned value so math.MinInt64 works
+	abs := strconv.FormatUint(absUint(minor), 10)
+	if len(abs) <= exp {
+		abs = strings.Repeat("0", exp-len(abs)+1) + abs
+	}
+	return sign + abs[:len(abs)-exp] + "." + abs[len(abs)-exp:]
+}
+
+func absUint(n int64) uint64 {
+	if n < 0 {
+		return uint64(-(n + 1)) + 1
+	}
+	return uint64(n)
+}
+
+// Format is String followed by the currency code, for messages to people.
+func (m Money) Format() string {
+	return m.String() + " " + m.Currency
+}
+
+// Major converts m to whole currency units. The result is approximate and
+// only meant for heuristics such as fraud scores, never for balances.
+func (m Money) Major() float64 {
+	exp, _ := Exponent(m.Currency)
+	return float64(m.Minor) / math.Pow10(exp)
+}
+
+func (m Money) IsZero() bool     { return m.Minor == 0 }
+func (m Money) IsPositive() bool { return m.Minor > 0 }
+func (m Money) IsNegative() bool { return m.Minor < 0 }
+
+// Add returns m + o. Both must be in the same currency.
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	sum := m.Minor + o.Minor
+	if (o.Minor > 0 && sum < m.Minor) || (o.Minor < 0 && sum > m.Minor) {
+		return Money{}, ErrOverflow
+	}
+	return Money{Minor: sum, Currency: m.Currency}, nil
+}
+
+// Sub returns m - o. Both must be in the same currency.
+func (m Money) Sub(o Money) (Money, error) {
+	if o.Minor == math.MinInt64 {
+		return Money{}, ErrOverflow
+	}
+	return m.Add(Money{Minor: -o.Minor, Currency: o.Currency})
+}
+
+// Cmp returns -1, 0 or 1 as m is less than, equal to or greater than o.
+func (m Money) Cmp(o Money) (int, error) {
+	if m.Currency != o.Currency {
+		return 0, ErrCurrencyMismatch
+	}
+	switch {
+	case m.Minor < o.Minor:
+		return -1, nil
+	case m.Minor > o.Minor:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// MarshalJSON writes m as {"amount": "12.50", "currency": "KZT"}.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"amount": m.String(), "currency": m.Currency})
+}
+
+// UnmarshalJSON reads the form written by MarshalJSON and parses the amount
+// strictly.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Amount   string `json:"amount"`
+		Currency string `json:"currency"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return fmt.Errorf("money: %w", err)
+	}
+	parsed, err := Parse(v.Amount, v.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}